@@ -36,6 +36,7 @@
 package cmd
 
 import (
+	"context"
 	"log"
 	"net"
 
@@ -52,31 +53,44 @@ func init() {
 		Help: "start 9p remote file server",
 		Fn:   ninepCmd,
 	})
-}
 
-func ninepCmd(_ *shell.Interface, _ []string) (_ string, err error) {
-	log.Printf("starting 9p remote filesystem server")
-	log.Printf("access with: `mount -t 9p -o trans=tcp,noextend %s <path>`", network.IP)
+	network.RegisterService(&network.Service{
+		Name:  "9p",
+		Port:  564,
+		DNSSD: "_9p._tcp",
+		Serve: serve9p,
+	})
+}
 
-	listener9p, err := net.Listen("tcp", ":564")
+func serve9p(ctx context.Context, listener net.Listener) (err error) {
+	ufslistener, err := ufs.NewUFS(func(l *protocol.Listener) error {
+		return nil
+	})
 
 	if err != nil {
 		return
 	}
 
-	ufslistener, err := ufs.NewUFS(func(l *protocol.Listener) error {
-		return nil
+	// unblock Serve on shutdown
+	stop := context.AfterFunc(ctx, func() {
+		listener.Close()
 	})
+	defer stop()
 
-	if err != nil {
+	if err = ufslistener.Serve(listener); ctx.Err() != nil {
+		return nil
+	}
+
+	return
+}
+
+func ninepCmd(_ *shell.Interface, _ []string) (_ string, err error) {
+	if err = network.StartService("9p"); err != nil {
 		return
 	}
 
-	go func() {
-		if err := ufslistener.Serve(listener9p); err != nil {
-			log.Printf("9p server error: %v", err)
-		}
-	}()
+	log.Printf("starting 9p remote filesystem server")
+	log.Printf("access with: `mount -t 9p -o trans=tcp,noextend %s <path>`", network.IP)
 
 	return
 }
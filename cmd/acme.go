@@ -0,0 +1,76 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/usbarmory/tamago-example/network"
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+func init() {
+	shell.Add(shell.Cmd{
+		Name:    "acme",
+		Args:    4,
+		Pattern: regexp.MustCompile(`^acme(?: (start|stop)(?: ([^\s]+) ([^\s]+)(?: ([^\s]+))?)?)?$`),
+		Syntax:  "(start <url> <domain,...> (<ca path>)?|stop)?",
+		Help:    "show/change ACME (RFC8555) HTTPS certificates",
+		Fn:      acmeCmd,
+	})
+}
+
+func acmeCmd(_ *shell.Interface, arg []string) (res string, err error) {
+	switch arg[0] {
+	case "start":
+		var roots *x509.CertPool
+
+		if len(arg[1]) == 0 {
+			return "", errors.New("missing directory URL and domains")
+		}
+
+		if p := arg[3]; len(p) > 0 {
+			buf, err := os.ReadFile(p)
+
+			if err != nil {
+				return "", err
+			}
+
+			roots = x509.NewCertPool()
+
+			if !roots.AppendCertsFromPEM(buf) {
+				return "", fmt.Errorf("no PEM certificates found in %s", p)
+			}
+		}
+
+		var domains []string
+
+		for d := range strings.SplitSeq(strings.ToLower(arg[2]), ",") {
+			if d = strings.TrimSuffix(d, "."); len(d) > 0 {
+				domains = append(domains, d)
+			}
+		}
+
+		if err = network.StartACME(arg[1], domains, roots); err != nil {
+			return
+		}
+	case "stop":
+		if len(arg[1]) > 0 {
+			return "", errors.New("invalid argument")
+		}
+
+		network.StopACME()
+	}
+
+	return network.ACMEStatus(), nil
+}
@@ -89,6 +89,18 @@ func infoCmd(_ *shell.Interface, _ []string) (string, error) {
 	return res.String(), nil
 }
 
+// UniqueID returns the VM unique identifier, derived from the VirtIO network
+// device MAC address assigned by the host.
+func UniqueID() []byte {
+	if NIC == nil {
+		return nil
+	}
+
+	mac := NIC.Config().MAC
+
+	return mac[:]
+}
+
 func cpuidCmd(_ *shell.Interface, arg []string) (string, error) {
 	var res bytes.Buffer
 
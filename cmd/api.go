@@ -0,0 +1,353 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/usbarmory/tamago/dma"
+
+	"github.com/usbarmory/tamago-example/network"
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+const (
+	apiPrefix = "/api/v1"
+	// maximum file upload size
+	apiMaxUpload = 32 << 20
+	// maximum request body size, other than file uploads
+	apiMaxRequest = 64 << 10
+)
+
+//go:embed openapi.json
+var openAPI []byte
+
+func init() {
+	network.SensitiveRoutes = append(network.SensitiveRoutes, apiPrefix+"/")
+
+	http.HandleFunc("GET "+apiPrefix+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPI)
+	})
+
+	apiHandle("GET /info", apiInfo)
+	apiHandle("GET /uptime", apiUptime)
+	apiHandle("GET /date", apiDate)
+	apiHandle("PUT /date", apiSetDate)
+	apiHandle("GET /dma", apiDMA)
+	apiHandle("GET /services", apiServices)
+	apiHandle("GET /files/{path...}", apiGetFile)
+	apiHandle("PUT /files/{path...}", apiPutFile)
+	apiHandle("DELETE /files/{path...}", apiDeleteFile)
+	apiHandle("GET /commands", apiCommands)
+	apiHandle("POST /commands", apiRunCommand)
+}
+
+func apiReply(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, err error) {
+	apiReply(w, status, map[string]string{"error": err.Error()})
+}
+
+// apiHandle registers an API route, authenticated by WebAuth as a sensitive
+// route.
+func apiHandle(pattern string, fn http.HandlerFunc) {
+	method, route, _ := strings.Cut(pattern, " ")
+	http.HandleFunc(method+" "+apiPrefix+route, fn)
+}
+
+func apiInfo(w http.ResponseWriter, r *http.Request) {
+	name, freq := Target()
+	details, _ := infoCmd(nil, nil)
+
+	apiReply(w, http.StatusOK, map[string]any{
+		"runtime":   runtime.Version(),
+		"os":        runtime.GOOS,
+		"arch":      runtime.GOARCH,
+		"soc":       name,
+		"frequency": freq,
+		"hostname":  Hostname(),
+		"unique_id": fmt.Sprintf("%X", UniqueID()),
+		"details":   details,
+	})
+}
+
+func apiUptime(w http.ResponseWriter, r *http.Request) {
+	ns := uptime()
+
+	apiReply(w, http.StatusOK, map[string]any{
+		"uptime_ns": ns,
+		"uptime":    (time.Duration(ns) * time.Nanosecond).Truncate(time.Second).String(),
+	})
+}
+
+func apiDate(w http.ResponseWriter, r *http.Request) {
+	apiReply(w, http.StatusOK, map[string]string{"date": time.Now().Format(time.RFC3339)})
+}
+
+func apiSetDate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Date string `json:"date"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiMaxRequest)).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	t, err := time.Parse(time.RFC3339, req.Date)
+
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	date(t.UnixNano())
+	apiDate(w, r)
+}
+
+type apiBlock struct {
+	Address uint `json:"address"`
+	Size    uint `json:"size"`
+}
+
+func apiBlocks(blocks map[uint]uint) (list []apiBlock, total uint) {
+	list = []apiBlock{}
+
+	for addr, n := range blocks {
+		list = append(list, apiBlock{addr, n})
+		total += n
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Address < list[j].Address
+	})
+
+	return
+}
+
+func apiDMA(w http.ResponseWriter, r *http.Request) {
+	if dma.Default() == nil {
+		apiError(w, http.StatusNotFound, errors.New("no default DMA region is present"))
+		return
+	}
+
+	free, freeTotal := apiBlocks(dma.Default().FreeBlocks())
+	used, usedTotal := apiBlocks(dma.Default().UsedBlocks())
+
+	apiReply(w, http.StatusOK, map[string]any{
+		"free":        freeTotal,
+		"used":        usedTotal,
+		"free_blocks": free,
+		"used_blocks": used,
+	})
+}
+
+func apiServices(w http.ResponseWriter, r *http.Request) {
+	list := network.ServiceList()
+
+	if list == nil {
+		list = []network.ServiceStatus{}
+	}
+
+	apiReply(w, http.StatusOK, list)
+}
+
+type apiFile struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Dir     bool      `json:"dir"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func apiPath(r *http.Request) (p string, err error) {
+	p = path.Clean("/" + r.PathValue("path"))
+
+	if network.PrivatePath(p) {
+		return "", os.ErrPermission
+	}
+
+	return
+}
+
+func apiGetFile(w http.ResponseWriter, r *http.Request) {
+	p, err := apiPath(r)
+
+	if err != nil {
+		apiError(w, http.StatusForbidden, err)
+		return
+	}
+
+	f, err := os.Open(p)
+
+	if err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !fi.IsDir() {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+		return
+	}
+
+	entries, err := f.ReadDir(-1)
+
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	list := []apiFile{}
+
+	for _, e := range entries {
+		if network.PrivatePath(path.Join(p, e.Name())) {
+			continue
+		}
+
+		if info, err := e.Info(); err == nil {
+			list = append(list, apiFile{info.Name(), info.Size(), info.IsDir(), info.ModTime()})
+		}
+	}
+
+	apiReply(w, http.StatusOK, list)
+}
+
+func apiPutFile(w http.ResponseWriter, r *http.Request) {
+	p, err := apiPath(r)
+
+	if err != nil {
+		apiError(w, http.StatusForbidden, err)
+		return
+	}
+
+	if p == "/" {
+		apiError(w, http.StatusBadRequest, errors.New("invalid path"))
+		return
+	}
+
+	if err := os.MkdirAll(path.Dir(p), 0700); err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, http.MaxBytesReader(w, r.Body, apiMaxUpload))
+
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	apiReply(w, http.StatusCreated, apiFile{Name: path.Base(p), Size: n, ModTime: time.Now()})
+}
+
+func apiDeleteFile(w http.ResponseWriter, r *http.Request) {
+	p, err := apiPath(r)
+
+	if err != nil {
+		apiError(w, http.StatusForbidden, err)
+		return
+	}
+
+	if p == "/" {
+		apiError(w, http.StatusBadRequest, errors.New("invalid path"))
+		return
+	}
+
+	if err := os.RemoveAll(p); err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiCommands(w http.ResponseWriter, r *http.Request) {
+	list := []map[string]string{}
+
+	for _, c := range shell.Commands() {
+		list = append(list, map[string]string{
+			"name":   c.Name,
+			"syntax": c.Syntax,
+			"help":   c.Help,
+		})
+	}
+
+	apiReply(w, http.StatusOK, list)
+}
+
+func apiRunCommand(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Command string `json:"command"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiMaxRequest)).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var output bytes.Buffer
+
+	// commands output, other than their result, is captured
+	console := &shell.Interface{
+		Output: &output,
+	}
+
+	start := time.Now()
+	res, err := console.Run(req.Command)
+
+	reply := map[string]any{
+		"command":     req.Command,
+		"result":      res,
+		"output":      output.String(),
+		"duration_ns": time.Since(start),
+	}
+
+	if err != nil {
+		reply["error"] = err.Error()
+		apiReply(w, http.StatusUnprocessableEntity, reply)
+		return
+	}
+
+	apiReply(w, http.StatusOK, reply)
+}
@@ -23,9 +23,10 @@ const CR = 0x0d
 
 func init() {
 	shell.Add(shell.Cmd{
-		Name: "ble",
-		Help: "BLE serial console",
-		Fn:   bleCmd,
+		Name:     "ble",
+		Help:     "BLE serial console",
+		Terminal: true,
+		Fn:       bleCmd,
 	})
 }
 
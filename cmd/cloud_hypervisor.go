@@ -44,6 +44,10 @@ func uptime() (ns int64) {
 	return vm.AMD64.GetTime() - vm.AMD64.TimerOffset
 }
 
+func adjtime(delta int64) {
+	vm.AMD64.TimerOffset += delta
+}
+
 func lspciCmd(_ *shell.Interface, arg []string) (string, error) {
 	var res bytes.Buffer
 
@@ -12,6 +12,7 @@ import (
 	"net"
 	"regexp"
 
+	"github.com/usbarmory/tamago-example/network"
 	"github.com/usbarmory/tamago-example/shell"
 )
 
@@ -24,6 +25,15 @@ func init() {
 		Help:    "resolve domain",
 		Fn:      dnsCmd,
 	})
+
+	shell.Add(shell.Cmd{
+		Name:    "resolver",
+		Args:    3,
+		Pattern: regexp.MustCompile(`^resolver(?: ([^\s]+))?(?: ([^\s:]+))?(?: pin:([^\s]+))?$`),
+		Syntax:  "(<uri> (<server name>)? (pin:<base64>)?|flush)?",
+		Help:    "show/change DNS resolver (ip:port, tls://ip, https://ip/path)",
+		Fn:      resolverCmd,
+	})
 }
 
 func dnsCmd(_ *shell.Interface, arg []string) (res string, err error) {
@@ -35,3 +45,17 @@ func dnsCmd(_ *shell.Interface, arg []string) (res string, err error) {
 
 	return fmt.Sprintf("%+v", cname), nil
 }
+
+func resolverCmd(_ *shell.Interface, arg []string) (res string, err error) {
+	switch arg[0] {
+	case "":
+	case "flush":
+		network.FlushDNSCache()
+	default:
+		if err = network.SetResolver(arg[0], arg[1], arg[2]); err != nil {
+			return
+		}
+	}
+
+	return network.ResolverStatus(), nil
+}
@@ -0,0 +1,191 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+const (
+	defaultFetchPath = "index.html"
+	progressStep     = 1 << 20
+)
+
+func init() {
+	shell.Add(shell.Cmd{
+		Name:    "fetch",
+		Args:    3,
+		Pattern: regexp.MustCompile(`^fetch (https?://[^\s]+)(?: ([^\s:]+))?(?: sha256:([0-9a-fA-F]{64}))?$`),
+		Syntax:  "<url> (<path>)? (sha256:<hex>)?",
+		Help:    "HTTP(S) download to file, with optional SHA-256 check",
+		Fn:      fetchCmd,
+	})
+
+	shell.Add(shell.Cmd{
+		Name:    "post",
+		Args:    2,
+		Pattern: regexp.MustCompile(`^post (https?://[^\s]+) (.*)$`),
+		Syntax:  "<url> <path>",
+		Help:    "HTTP(S) upload of file",
+		Fn:      postCmd,
+	})
+}
+
+// progress reports transfer progress on the wrapped writer at every
+// progressStep bytes.
+type progress struct {
+	w     io.Writer
+	total int64
+	n     int64
+	last  int64
+	start time.Time
+}
+
+func (p *progress) Write(buf []byte) (n int, err error) {
+	n = len(buf)
+	p.n += int64(n)
+
+	if p.n-p.last >= progressStep {
+		p.last = p.n
+		p.print()
+	}
+
+	return
+}
+
+func (p *progress) print() {
+	rate := float64(p.n) / time.Since(p.start).Seconds() / 1024
+
+	if p.total > 0 {
+		fmt.Fprintf(p.w, "\r%d/%d bytes (%d%%) %.0f KiB/s ", p.n, p.total, p.n*100/p.total, rate)
+	} else {
+		fmt.Fprintf(p.w, "\r%d bytes %.0f KiB/s ", p.n, rate)
+	}
+}
+
+func fetchCmd(console *shell.Interface, arg []string) (res string, err error) {
+	u, err := url.Parse(arg[0])
+
+	if err != nil {
+		return
+	}
+
+	dst := arg[1]
+
+	if len(dst) == 0 {
+		if dst = path.Base(u.Path); dst == "/" || dst == "." {
+			dst = defaultFetchPath
+		}
+	}
+
+	resp, err := http.Get(u.String())
+
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response, %s", resp.Status)
+	}
+
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	p := &progress{
+		w:     console.Output,
+		total: resp.ContentLength,
+		start: time.Now(),
+	}
+
+	fmt.Fprintf(console.Output, "fetching %s to %s\n", u, dst)
+
+	n, err := io.Copy(io.MultiWriter(f, h, p), resp.Body)
+
+	p.print()
+	fmt.Fprintln(console.Output)
+
+	if err != nil {
+		return
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	if len(arg[2]) > 0 && !strings.EqualFold(sum, arg[2]) {
+		os.Remove(dst)
+		return "", fmt.Errorf("SHA-256 mismatch, got %s", sum)
+	}
+
+	return fmt.Sprintf("%s (%d bytes) sha256:%s", dst, n, sum), nil
+}
+
+func postCmd(console *shell.Interface, arg []string) (res string, err error) {
+	f, err := os.Open(arg[1])
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+
+	if err != nil {
+		return
+	}
+
+	p := &progress{
+		w:     console.Output,
+		total: fi.Size(),
+		start: time.Now(),
+	}
+
+	req, err := http.NewRequest(http.MethodPost, arg[0], io.TeeReader(f, p))
+
+	if err != nil {
+		return
+	}
+
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	fmt.Fprintf(console.Output, "posting %s (%d bytes) to %s\n", arg[1], fi.Size(), arg[0])
+
+	resp, err := http.DefaultClient.Do(req)
+
+	p.print()
+	fmt.Fprintln(console.Output)
+
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("unexpected response, %s", resp.Status)
+	}
+
+	return resp.Status, nil
+}
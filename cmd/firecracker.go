@@ -55,6 +55,10 @@ func uptime() (ns int64) {
 	return microvm.AMD64.GetTime() - microvm.AMD64.TimerOffset
 }
 
+func adjtime(delta int64) {
+	microvm.AMD64.TimerOffset += delta
+}
+
 func Target() (name string, freq uint32) {
 	return microvm.AMD64.Name(), microvm.AMD64.Freq()
 }
@@ -0,0 +1,108 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/usbarmory/tamago-example/network"
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+const defaultBanTime = 60
+
+func init() {
+	shell.Add(shell.Cmd{
+		Name:    "firewall",
+		Args:    5,
+		Pattern: regexp.MustCompile(`^firewall(?: ([^\s]+) (allow|deny|default|limit|flush)(?: ([^\s]+))?(?: ([^\s]+))?(?: (\d+))?)?$`),
+		Syntax:  "(<svc> (allow|deny|default|limit|flush) ...)?",
+		Help:    "show or change service connection ACLs and limits",
+		Fn:      firewallCmd,
+	})
+}
+
+func parseRule(allow bool, src string, iface string) (r network.FirewallRule, err error) {
+	r.Allow = allow
+	r.Interface = iface
+
+	if src == "any" {
+		return
+	}
+
+	if !strings.Contains(src, "/") {
+		if ip := net.ParseIP(src); ip != nil && ip.To4() == nil {
+			src += "/128"
+		} else {
+			src += "/32"
+		}
+	}
+
+	_, r.Network, err = net.ParseCIDR(src)
+
+	return
+}
+
+func firewallCmd(_ *shell.Interface, arg []string) (res string, err error) {
+	service := arg[0]
+
+	switch arg[1] {
+	case "":
+		return network.Firewall(), nil
+	case "allow", "deny":
+		if len(arg[2]) == 0 {
+			return "", errors.New("missing source, use <cidr> or any")
+		}
+
+		var r network.FirewallRule
+
+		if r, err = parseRule(arg[1] == "allow", arg[2], arg[3]); err != nil {
+			return "", fmt.Errorf("invalid source, %v", err)
+		}
+
+		err = network.FirewallAddRule(service, r)
+	case "default":
+		switch arg[2] {
+		case "allow", "deny":
+			err = network.FirewallDefault(service, arg[2] == "deny")
+		default:
+			err = errors.New("invalid action, use allow or deny")
+		}
+	case "limit":
+		var conns int
+		var rate float64
+
+		ban := defaultBanTime
+
+		if conns, err = strconv.Atoi(arg[2]); err != nil {
+			return "", fmt.Errorf("invalid connection limit, %v", err)
+		}
+
+		if rate, err = strconv.ParseFloat(arg[3], 64); err != nil || rate < 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+			return "", fmt.Errorf("invalid rate")
+		}
+
+		if len(arg[4]) > 0 {
+			ban, _ = strconv.Atoi(arg[4])
+		}
+
+		burst := int(math.Ceil(2 * rate))
+		err = network.FirewallLimit(service, conns, rate, burst, time.Duration(ban)*time.Second)
+	case "flush":
+		err = network.FirewallFlush(service)
+	}
+
+	return
+}
@@ -29,6 +29,10 @@ func uptime() (ns int64) {
 	return gcp.AMD64.GetTime() - gcp.AMD64.TimerOffset
 }
 
+func adjtime(delta int64) {
+	gcp.AMD64.TimerOffset += delta
+}
+
 func Target() (name string, freq uint32) {
 	return gcp.AMD64.Name(), gcp.AMD64.Freq()
 }
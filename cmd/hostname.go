@@ -0,0 +1,36 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build amd64 || imx8mpevk || mx6ullevk || usbarmory || sifive_u
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Hostname returns a device host name derived from the board name and its
+// unique ID.
+func Hostname() string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '-'
+		}
+	}, boardName)
+
+	name = strings.Trim(name, "-")
+
+	if id := UniqueID(); len(id) >= 3 {
+		name = fmt.Sprintf("%s-%x", name, id[len(id)-3:])
+	}
+
+	return name
+}
@@ -22,27 +22,35 @@ func init() {
 		Help: "CAAM/DCP hardware unique key derivation",
 		Fn:   hukCmd,
 	})
-}
 
-func hukCmd(_ *shell.Interface, arg []string) (res string, err error) {
-	var key []byte
+	deriveHUK = hukDerive
+}
 
+// hukDerive derives a key from the CAAM/DCP hardware unique key and the
+// argument diversifier.
+func hukDerive(diversifier []byte) (key []byte, source string, err error) {
 	switch {
 	case CAAM != nil:
 		key = make([]byte, sha256.Size)
-		err = CAAM.DeriveKey([]byte(testDiversifier), key)
-		res = "CAAM DeriveKey"
+		err = CAAM.DeriveKey(diversifier, key)
+		source = "CAAM DeriveKey"
 	case DCP != nil:
 		iv := make([]byte, aes.BlockSize)
-		key, err = DCP.DeriveKey([]byte(testDiversifier), iv, -1)
-		res = "DCP DeriveKey"
+		key, err = DCP.DeriveKey(diversifier, iv, -1)
+		source = "DCP DeriveKey"
 	default:
 		err = errors.New("unavailable")
 	}
 
+	return
+}
+
+func hukCmd(_ *shell.Interface, arg []string) (res string, err error) {
+	key, source, err := hukDerive([]byte(testDiversifier))
+
 	if err != nil {
 		return "", err
 	}
 
-	return fmt.Sprintf("%s: %x", res, key), nil
+	return fmt.Sprintf("%s: %x", source, key), nil
 }
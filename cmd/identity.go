@@ -0,0 +1,134 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/usbarmory/tamago-example/network"
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+// IdentitySeed represents the software fallback secret for device identity
+// keys derivation, on targets lacking a hardware unique key, it is meant to
+// be set at build time (see IDENTITY_SEED in the Makefile).
+var IdentitySeed string
+
+const identityDiversifier = "tamago-example identity"
+
+// deriveHUK, when available, derives a key from the hardware unique key.
+var deriveHUK func(diversifier []byte) (key []byte, source string, err error)
+
+func init() {
+	shell.Add(shell.Cmd{
+		Name:    "identity",
+		Args:    2,
+		Pattern: regexp.MustCompile(`^identity(?: (ca|ssh)(?: (.*))?)?$`),
+		Syntax:  "(ca (<path>)?|ssh)?",
+		Help:    "show/export device TLS CA certificate and SSH host key",
+		Fn:      identityCmd,
+	})
+
+	network.IdentityKey = identityKey
+}
+
+// identityKey returns the device identity secret, derived from the hardware
+// unique key (or the build time seed) and bound to the device unique ID.
+func identityKey() (key []byte, source string, err error) {
+	var secret []byte
+
+	if deriveHUK != nil {
+		secret, source, err = deriveHUK([]byte(identityDiversifier))
+	}
+
+	if len(secret) == 0 && len(IdentitySeed) > 0 {
+		secret, source, err = []byte(IdentitySeed), "build seed", nil
+	}
+
+	if len(secret) == 0 {
+		return nil, "", fmt.Errorf("no hardware unique key or identity seed available (%v)", err)
+	}
+
+	h := sha256.New()
+	h.Write(secret)
+	h.Write(UniqueID())
+
+	return h.Sum(nil), source, nil
+}
+
+func identityCmd(_ *shell.Interface, arg []string) (res string, err error) {
+	var buf bytes.Buffer
+
+	switch arg[0] {
+	case "ca":
+		pem, err := network.IdentityCAPEM()
+
+		if err != nil {
+			return "", err
+		}
+
+		if p := arg[1]; len(p) > 0 {
+			if err = os.WriteFile(p, pem, 0600); err != nil {
+				return "", err
+			}
+
+			return fmt.Sprintf("CA certificate written to %s", p), nil
+		}
+
+		return string(pem), nil
+	case "ssh":
+		if len(arg[1]) > 0 {
+			return "", errors.New("invalid argument")
+		}
+
+		signer, err := network.SSHHostKey()
+
+		if err != nil {
+			return "", err
+		}
+
+		// known_hosts format
+		fmt.Fprintf(&buf, "%s %s", network.Hostname(), ssh.MarshalAuthorizedKey(signer.PublicKey()))
+		fmt.Fprintf(&buf, "%s", ssh.FingerprintSHA256(signer.PublicKey()))
+
+		return buf.String(), nil
+	}
+
+	source, err := network.IdentitySource()
+
+	if err != nil {
+		return
+	}
+
+	ca, err := network.IdentityCA()
+
+	if err != nil {
+		return
+	}
+
+	signer, err := network.SSHHostKey()
+
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(&buf, "Keys ............: %s\n", source)
+	fmt.Fprintf(&buf, "TLS CA ..........: %s\n", ca.Subject.CommonName)
+	fmt.Fprintf(&buf, "TLS CA SHA-256 ..: % X\n", sha256.Sum256(ca.Raw))
+	fmt.Fprintf(&buf, "SSH host key ....: %s", ssh.FingerprintSHA256(signer.PublicKey()))
+
+	return strings.TrimSpace(buf.String()), nil
+}
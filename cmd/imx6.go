@@ -26,6 +26,7 @@ import (
 	"github.com/usbarmory/tamago/soc/nxp/snvs"
 
 	"github.com/usbarmory/tamago-example/internal/semihosting"
+	"github.com/usbarmory/tamago-example/network"
 	"github.com/usbarmory/tamago-example/shell"
 )
 
@@ -114,6 +115,11 @@ func init() {
 	if imx6ul.CAAM != nil {
 		imx6ul.CAAM.DeriveKeyMemory, _ = dma.NewRegion(imx6ul.OCRAM_START, imx6ul.OCRAM_SIZE, false)
 	}
+
+	network.RegisterMetrics(func(m *network.Metrics) {
+		m.Gauge("tamago_soc_temperature_celsius", "SoC temperature (TEMPMON).", float64(imx6ul.TEMPMON.Read()))
+		snvsMetrics(m)
+	})
 }
 
 func date(epoch int64) {
@@ -124,6 +130,10 @@ func uptime() (ns int64) {
 	return imx6ul.ARM.GetTime() - imx6ul.ARM.TimerOffset
 }
 
+func adjtime(delta int64) {
+	imx6ul.ARM.TimerOffset += delta
+}
+
 func infoCmd(_ *shell.Interface, _ []string) (string, error) {
 	var res bytes.Buffer
 
@@ -176,6 +186,12 @@ func infoCmd(_ *shell.Interface, _ []string) (string, error) {
 	return res.String(), nil
 }
 
+// UniqueID returns the SoC unique identifier.
+func UniqueID() []byte {
+	id := imx6ul.UniqueID()
+	return id[:]
+}
+
 func freqCmd(_ *shell.Interface, arg []string) (res string, err error) {
 	var mhz uint64
 
@@ -16,6 +16,7 @@ import (
 	_ "unsafe"
 
 	"github.com/usbarmory/crucible/fusemap"
+	"github.com/usbarmory/crucible/otp"
 
 	"github.com/usbarmory/tamago/dma"
 	"github.com/usbarmory/tamago/soc/nxp/dcp"
@@ -23,6 +24,7 @@ import (
 	"github.com/usbarmory/tamago/soc/nxp/snvs"
 
 	"github.com/usbarmory/tamago-example/internal/semihosting"
+	"github.com/usbarmory/tamago-example/network"
 	"github.com/usbarmory/tamago-example/shell"
 )
 
@@ -90,6 +92,8 @@ func init() {
 	if imx8mp.CAAM != nil {
 		imx8mp.CAAM.DeriveKeyMemory, _ = dma.NewRegion(imx8mp.OCRAM_START, imx8mp.OCRAM_SIZE, false)
 	}
+
+	network.RegisterMetrics(snvsMetrics)
 }
 
 func date(epoch int64) {
@@ -100,6 +104,10 @@ func uptime() (ns int64) {
 	return imx8mp.ARM64.GetTime() - imx8mp.ARM64.TimerOffset
 }
 
+func adjtime(delta int64) {
+	imx8mp.ARM64.TimerOffset += delta
+}
+
 func infoCmd(_ *shell.Interface, _ []string) (string, error) {
 	var res bytes.Buffer
 
@@ -119,6 +127,22 @@ func infoCmd(_ *shell.Interface, _ []string) (string, error) {
 	return res.String(), nil
 }
 
+// UniqueID returns the SoC unique identifier, read from its fuses.
+func UniqueID() (id []byte) {
+	// OCOTP_HW_OCOTP_UNIQUE_ID[0:1], bank 0 words 1-2
+	for word := 2; word >= 1; word-- {
+		val, err := otp.ReadOCOTP(OCOTP, 0, word, 0, 32)
+
+		if err != nil {
+			return nil
+		}
+
+		id = append(id, val...)
+	}
+
+	return
+}
+
 func cryptoTest() {
 	spawn(btcdTest)
 	spawn(kemTest)
@@ -0,0 +1,134 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/usbarmory/tamago-example/network"
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+const (
+	defaultIperfTime      = 10 * time.Second
+	defaultIperfTCPLength = 128 * 1024
+	defaultIperfUDPLength = 1448
+	// iperf3 default UDP bitrate
+	defaultIperfUDPBandwidth = 1000000
+)
+
+func init() {
+	shell.Add(shell.Cmd{
+		Name:    "iperf",
+		Args:    2,
+		Pattern: regexp.MustCompile(`^iperf ([^\s]+)((?: -[uR]| -[Ptbl] [\d.]+[KMG]?)*)$`),
+		Syntax:  "<host> (-u)? (-R)? (-P|-t|-b|-l <n>)?",
+		Help:    "iperf3 throughput test client, reporting ISR CPU time",
+		Fn:      iperfCmd,
+	})
+}
+
+// parseUnits parses a value with an optional K, M or G suffix, multiplied by
+// powers of the argument base.
+func parseUnits(s string, base uint64) (n uint64, err error) {
+	mul := uint64(1)
+
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mul = base
+	case strings.HasSuffix(s, "M"):
+		mul = base * base
+	case strings.HasSuffix(s, "G"):
+		mul = base * base * base
+	}
+
+	v, err := strconv.ParseFloat(strings.TrimRight(s, "KMG"), 64)
+
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid value %s", s)
+	}
+
+	return uint64(v * float64(mul)), nil
+}
+
+func iperfCmd(console *shell.Interface, arg []string) (res string, err error) {
+	var n uint64
+
+	opts := network.IperfOptions{
+		Parallel: 1,
+		Time:     defaultIperfTime,
+	}
+
+	args := strings.Fields(arg[1])
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-u":
+			opts.UDP = true
+			continue
+		case "-R":
+			opts.Reverse = true
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return "", fmt.Errorf("missing %s value", args[i])
+		}
+
+		base := uint64(1000)
+
+		if args[i] == "-l" {
+			base = 1024
+		}
+
+		if n, err = parseUnits(args[i+1], base); err != nil {
+			return
+		}
+
+		switch args[i] {
+		case "-P":
+			opts.Parallel = int(n)
+		case "-t":
+			opts.Time = time.Duration(n) * time.Second
+		case "-b":
+			opts.Bandwidth = n
+		case "-l":
+			opts.Length = int(n)
+		}
+
+		i++
+	}
+
+	if opts.UDP {
+		if opts.Length == 0 {
+			opts.Length = defaultIperfUDPLength
+		}
+
+		if opts.Bandwidth == 0 {
+			opts.Bandwidth = defaultIperfUDPBandwidth
+		}
+	} else if opts.Length == 0 {
+		opts.Length = defaultIperfTCPLength
+	}
+
+	if opts.Time <= 0 {
+		return "", fmt.Errorf("invalid time")
+	}
+
+	ip, err := resolve(arg[0])
+
+	if err != nil {
+		return
+	}
+
+	return "", network.Iperf(console.Output, ip, opts)
+}
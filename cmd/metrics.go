@@ -0,0 +1,18 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"github.com/usbarmory/tamago-example/network"
+)
+
+func init() {
+	network.RegisterMetrics(func(m *network.Metrics) {
+		m.Gauge("tamago_uptime_seconds", "Time since boot.", float64(uptime())/1e9)
+	})
+}
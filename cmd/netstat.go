@@ -0,0 +1,41 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/usbarmory/tamago-example/network"
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+func init() {
+	shell.Add(shell.Cmd{
+		Name:    "netstat",
+		Args:    1,
+		Pattern: regexp.MustCompile(`^netstat(?: (\d+))?$`),
+		Syntax:  "(<sec>)?",
+		Help:    "show sockets and network statistics (deltas over interval)",
+		Fn:      netstatCmd,
+	})
+}
+
+func netstatCmd(_ *shell.Interface, arg []string) (res string, err error) {
+	var sec int
+
+	if len(arg[0]) > 0 {
+		if sec, err = strconv.Atoi(arg[0]); err != nil {
+			return "", fmt.Errorf("invalid interval, %v", err)
+		}
+	}
+
+	return network.Netstat(time.Duration(sec) * time.Second), nil
+}
@@ -12,35 +12,69 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/beevik/ntp"
 
+	"github.com/usbarmory/tamago-example/internal/nts"
 	"github.com/usbarmory/tamago-example/shell"
 )
 
 func init() {
 	shell.Add(shell.Cmd{
 		Name:    "ntp",
-		Args:    1,
-		Pattern: regexp.MustCompile(`^ntp (.*)`),
-		Syntax:  "<host>",
-		Help:    "change runtime date and time via NTP",
+		Args:    2,
+		Pattern: regexp.MustCompile(`^ntp ([^\s]+)((?: [^\s]+)*)$`),
+		Syntax:  "(<host>|start (<host>)*|stop|status|nts on|off)",
+		Help:    "change date and time via NTP or NTS (nts://<host>), or sync continuously",
 		Fn:      ntpCmd,
 	})
 }
 
 func ntpCmd(_ *shell.Interface, arg []string) (res string, err error) {
-	ip, err := net.DefaultResolver.LookupIP(context.Background(), "ip4", arg[0])
+	switch arg[0] {
+	case "start":
+		return "", startNTP(strings.Fields(arg[1]))
+	case "stop":
+		return "", stopNTP()
+	case "status":
+		return ntpStatus()
+	case "nts":
+		mode := strings.TrimSpace(arg[1])
 
-	if err != nil {
-		return
+		if mode != "" && mode != "on" && mode != "off" {
+			return "", fmt.Errorf("invalid arguments")
+		}
+
+		return ntsMode(mode), nil
+	}
+
+	if len(arg[1]) > 0 {
+		return "", fmt.Errorf("invalid arguments")
 	}
 
-	ntpR, err := ntp.QueryWithOptions(
-		ip[0].String(),
-		ntp.QueryOptions{},
-	)
+	var ntpR *ntp.Response
+
+	ke, authenticated := isNTS(arg[0])
+
+	switch {
+	case authenticated:
+		ntpR, err = ntsQuery(ke)
+	case ntsRequired.Load():
+		return "", fmt.Errorf("%v, use %s<host>", errUnauthenticated, ntsScheme)
+	default:
+		var ip []net.IP
+
+		if ip, err = net.DefaultResolver.LookupIP(context.Background(), "ip4", arg[0]); err != nil {
+			return
+		}
+
+		ntpR, err = ntp.QueryWithOptions(
+			ip[0].String(),
+			ntp.QueryOptions{},
+		)
+	}
 
 	if err != nil {
 		return "", fmt.Errorf("query error: %v", err)
@@ -52,5 +86,9 @@ func ntpCmd(_ *shell.Interface, arg []string) (res string, err error) {
 
 	date(ntpR.Time.UnixNano())
 
+	if authenticated {
+		nts.Trusted.Store(true)
+	}
+
 	return fmt.Sprintf("%s", time.Now().Format(time.RFC3339)), nil
 }
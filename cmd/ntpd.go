@@ -0,0 +1,773 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/beevik/ntp"
+
+	"github.com/usbarmory/tamago-example/internal/nts"
+)
+
+// NTP daemon parameters, loosely following RFC 5905 defaults.
+const (
+	ntpPoll         = 64 * time.Second
+	ntpBurst        = 4
+	ntpBurstPoll    = 2 * time.Second
+	ntpSlewInterval = 1 * time.Second
+	ntpTimeout      = 5 * time.Second
+
+	ntpFilterSize  = 8
+	ntpMaxPeers    = 8
+	ntpMinCluster  = 3
+	ntpHistorySize = 32
+	ntpDriftPoints = 16
+
+	// offset beyond which the clock is stepped rather than slewed
+	ntpStepThreshold = 0.128
+	// maximum slew rate and frequency correction (s/s)
+	ntpMaxSlew = 500e-6
+	ntpMaxFreq = 500e-6
+	// maximum root distance of a selectable peer
+	ntpMaxDist = 1.5
+	// dispersion growth rate (s/s)
+	ntpPhi = 15e-6
+)
+
+// DefaultNTPServers are queried when the NTP daemon is started without
+// servers.
+var DefaultNTPServers = []string{
+	"0.pool.ntp.org",
+	"1.pool.ntp.org",
+	"2.pool.ntp.org",
+	"3.pool.ntp.org",
+}
+
+type ntpSample struct {
+	offset float64
+	delay  float64
+	disp   float64
+	ts     time.Time
+}
+
+// ntpPeer represents an NTP server association.
+type ntpPeer struct {
+	host string
+	addr net.IP
+
+	// NTS session, nil for unauthenticated associations
+	nts     *nts.Session
+	cookies int
+
+	samples []ntpSample
+	reach   uint8
+	lastErr error
+
+	stratum   uint8
+	rootDelay float64
+	rootDisp  float64
+
+	// clock filter output
+	offset float64
+	delay  float64
+	disp   float64
+	jitter float64
+	ts     time.Time
+
+	// selection tally code
+	tally byte
+}
+
+// distance returns the peer root distance.
+func (p *ntpPeer) distance() float64 {
+	age := time.Since(p.ts).Seconds()
+	return (p.rootDelay+p.delay)/2 + p.rootDisp + p.disp + ntpPhi*age + p.jitter
+}
+
+// filter implements the clock filter algorithm (RFC 5905 10.), selecting the
+// lowest delay sample.
+func (p *ntpPeer) filter() {
+	samples := slices.Clone(p.samples)
+
+	slices.SortFunc(samples, func(a, b ntpSample) int {
+		switch {
+		case a.delay < b.delay:
+			return -1
+		case a.delay > b.delay:
+			return 1
+		}
+
+		return 0
+	})
+
+	best := samples[0]
+
+	p.offset = best.offset
+	p.delay = best.delay
+	p.ts = best.ts
+	p.disp = 0
+	p.jitter = 0
+
+	for i, s := range samples {
+		p.disp += (s.disp + ntpPhi*time.Since(s.ts).Seconds()) / math.Pow(2, float64(i+1))
+		p.jitter += math.Pow(s.offset-best.offset, 2)
+	}
+
+	if n := len(samples); n > 1 {
+		p.jitter = math.Sqrt(p.jitter / float64(n-1))
+	}
+
+	p.jitter = max(p.jitter, best.disp)
+}
+
+type ntpEvent struct {
+	ts     time.Time
+	offset float64
+	freq   float64
+	action string
+	peer   string
+}
+
+type ntpDriftPoint struct {
+	// raw timer (s)
+	x float64
+	// true time minus raw timer (s)
+	y float64
+}
+
+// ntpDaemon represents the NTP time synchronization daemon.
+type ntpDaemon struct {
+	sync.Mutex
+
+	servers []string
+	peers   []*ntpPeer
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	sys    *ntpPeer
+	offset float64
+	jitter float64
+	synced bool
+	update time.Time
+
+	// pending slew and frequency correction (s/s)
+	slew float64
+	freq float64
+
+	drift   []ntpDriftPoint
+	driftY0 int64
+	history []ntpEvent
+}
+
+var (
+	ntpMutex sync.Mutex
+	ntpd     *ntpDaemon
+)
+
+func (d *ntpDaemon) resolve() {
+	var peers []*ntpPeer
+
+	for _, host := range d.servers {
+		var s *nts.Session
+
+		server := host
+
+		if ke, ok := isNTS(host); ok {
+			var err error
+
+			if s, err = nts.KeyExchange(ke); err != nil {
+				log.Printf("ntp: could not establish NTS keys with %s, %v", ke, err)
+				continue
+			}
+
+			server = s.Server
+		}
+
+		ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip4", server)
+
+		if err != nil {
+			log.Printf("ntp: could not resolve %s, %v", host, err)
+			continue
+		}
+
+		for _, ip := range ips {
+			if len(peers) == ntpMaxPeers {
+				break
+			}
+
+			if !slices.ContainsFunc(peers, func(p *ntpPeer) bool { return p.addr.Equal(ip) }) {
+				peers = append(peers, &ntpPeer{host: host, addr: ip, nts: s})
+			}
+
+			// NTS cookies are bound to a single association
+			if s != nil {
+				break
+			}
+		}
+	}
+
+	d.Lock()
+	d.peers = peers
+	d.Unlock()
+}
+
+func (d *ntpDaemon) poll() {
+	var wg sync.WaitGroup
+
+	d.Lock()
+	peers := slices.Clone(d.peers)
+	d.Unlock()
+
+	for _, p := range peers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			var r *ntp.Response
+			var err error
+
+			// peer state is protected by the daemon lock, except during
+			// the query itself
+			addr := p.addr.String()
+
+			switch {
+			case p.nts != nil:
+				r, err = p.nts.Query(addr)
+			case ntsRequired.Load():
+				err = errUnauthenticated
+			default:
+				r, err = ntp.QueryWithOptions(addr, ntp.QueryOptions{Timeout: ntpTimeout})
+			}
+
+			d.Lock()
+			defer d.Unlock()
+
+			if p.nts != nil {
+				p.cookies = p.nts.Cookies()
+			}
+
+			p.apply(r, err)
+		}()
+	}
+
+	wg.Wait()
+	d.clock()
+}
+
+func (p *ntpPeer) apply(r *ntp.Response, err error) {
+	p.reach <<= 1
+
+	if err == nil {
+		err = r.Validate()
+	}
+
+	if p.lastErr = err; err != nil {
+		return
+	}
+
+	p.reach |= 1
+	p.stratum = r.Stratum
+	p.rootDelay = r.RootDelay.Seconds()
+	p.rootDisp = r.RootDispersion.Seconds()
+
+	s := ntpSample{
+		offset: r.ClockOffset.Seconds(),
+		delay:  max(r.RTT.Seconds(), 0),
+		disp:   r.Precision.Seconds(),
+		ts:     time.Now(),
+	}
+
+	if len(p.samples) == ntpFilterSize {
+		p.samples = p.samples[1:]
+	}
+
+	p.samples = append(p.samples, s)
+	p.filter()
+}
+
+// selectPeers implements the selection and cluster algorithms (RFC 5905
+// 11.2.1 and 11.2.2), it must be called with the daemon locked.
+func (d *ntpDaemon) selectPeers() (survivors []*ntpPeer) {
+	var candidates []*ntpPeer
+
+	type edge struct {
+		val float64
+		typ int
+	}
+
+	var edges []edge
+
+	for _, p := range d.peers {
+		p.tally = ' '
+
+		if p.reach == 0 || len(p.samples) == 0 || p.stratum == 0 || p.stratum >= 16 {
+			continue
+		}
+
+		if lambda := p.distance(); lambda < ntpMaxDist {
+			p.tally = 'x'
+			candidates = append(candidates, p)
+			edges = append(edges,
+				edge{p.offset - lambda, -1},
+				edge{p.offset, 0},
+				edge{p.offset + lambda, 1},
+			)
+		}
+	}
+
+	n := len(candidates)
+
+	if n == 0 {
+		return
+	}
+
+	slices.SortFunc(edges, func(a, b edge) int {
+		switch {
+		case a.val < b.val:
+			return -1
+		case a.val > b.val:
+			return 1
+		}
+
+		return 0
+	})
+
+	// intersection algorithm, find the smallest interval containing
+	// points from the largest number of truechimers
+	var low, high float64
+	var found bool
+
+	for allow := 0; 2*allow < n; allow++ {
+		chime := 0
+		midpoints := 0
+
+		// bounds not found in this iteration must not carry over
+		// (A.5.5.1. clock_select(), RFC5905)
+		low = math.Inf(1)
+		high = math.Inf(-1)
+
+		for _, e := range edges {
+			chime -= e.typ
+
+			if chime >= n-allow {
+				low = e.val
+				break
+			}
+
+			if e.typ == 0 {
+				midpoints += 1
+			}
+		}
+
+		chime = 0
+
+		for i := len(edges) - 1; i >= 0; i-- {
+			e := edges[i]
+			chime += e.typ
+
+			if chime >= n-allow {
+				high = e.val
+				break
+			}
+
+			if e.typ == 0 {
+				midpoints += 1
+			}
+		}
+
+		if midpoints > allow {
+			continue
+		}
+
+		if low <= high {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return
+	}
+
+	for _, p := range candidates {
+		if p.offset >= low && p.offset <= high {
+			p.tally = '-'
+			survivors = append(survivors, p)
+		}
+	}
+
+	slices.SortFunc(survivors, func(a, b *ntpPeer) int {
+		ma := ntpMaxDist*float64(a.stratum) + a.distance()
+		mb := ntpMaxDist*float64(b.stratum) + b.distance()
+
+		switch {
+		case ma < mb:
+			return -1
+		case ma > mb:
+			return 1
+		}
+
+		return 0
+	})
+
+	// cluster algorithm, prune survivors with the largest selection jitter
+	for len(survivors) > ntpMinCluster {
+		maxJitter := -1.0
+		minJitter := math.MaxFloat64
+		worst := 0
+
+		for i, p := range survivors {
+			var jitter float64
+
+			for _, q := range survivors {
+				jitter += math.Pow(p.offset-q.offset, 2)
+			}
+
+			jitter = math.Sqrt(jitter / float64(len(survivors)-1))
+
+			if jitter > maxJitter {
+				maxJitter = jitter
+				worst = i
+			}
+
+			minJitter = min(minJitter, p.jitter)
+		}
+
+		if maxJitter <= minJitter {
+			break
+		}
+
+		survivors = slices.Delete(survivors, worst, worst+1)
+	}
+
+	for _, p := range survivors {
+		p.tally = '+'
+	}
+
+	return
+}
+
+// combine implements the combine algorithm (RFC 5905 11.2.3).
+func combine(survivors []*ntpPeer) (offset float64, jitter float64) {
+	var weight float64
+
+	for _, p := range survivors {
+		w := 1 / p.distance()
+		weight += w
+		offset += w * p.offset
+	}
+
+	offset /= weight
+
+	for _, p := range survivors {
+		jitter += math.Pow(p.offset-offset, 2) / p.distance()
+	}
+
+	jitter = math.Sqrt(jitter / weight)
+
+	return
+}
+
+func (d *ntpDaemon) record(offset float64, action string) {
+	peer := "-"
+
+	if d.sys != nil {
+		peer = d.sys.addr.String()
+	}
+
+	if len(d.history) == ntpHistorySize {
+		d.history = d.history[1:]
+	}
+
+	d.history = append(d.history, ntpEvent{
+		ts:     time.Now(),
+		offset: offset,
+		freq:   d.freq,
+		action: action,
+		peer:   peer,
+	})
+}
+
+// trackDrift estimates the frequency error of the raw timer through a linear
+// regression of its offset against true time.
+func (d *ntpDaemon) trackDrift(offset float64) {
+	var sx, sy, sxx, sxy float64
+
+	raw := uptime()
+	y := time.Now().UnixNano() + int64(offset*1e9) - raw
+
+	if len(d.drift) == 0 {
+		d.driftY0 = y
+	}
+
+	if len(d.drift) == ntpDriftPoints {
+		d.drift = d.drift[1:]
+	}
+
+	d.drift = append(d.drift, ntpDriftPoint{
+		x: float64(raw) / 1e9,
+		y: float64(y-d.driftY0) / 1e9,
+	})
+
+	n := float64(len(d.drift))
+
+	// require a meaningful observation interval
+	if n < 3 || d.drift[len(d.drift)-1].x-d.drift[0].x < ntpPoll.Seconds() {
+		return
+	}
+
+	for _, p := range d.drift {
+		sx += p.x
+		sy += p.y
+		sxx += p.x * p.x
+		sxy += p.x * p.y
+	}
+
+	if den := n*sxx - sx*sx; den != 0 {
+		d.freq = max(min((n*sxy-sx*sy)/den, ntpMaxFreq), -ntpMaxFreq)
+	}
+}
+
+// clock selects the system peer and disciplines the clock.
+func (d *ntpDaemon) clock() {
+	d.Lock()
+	defer d.Unlock()
+
+	survivors := d.selectPeers()
+
+	if len(survivors) == 0 {
+		d.sys = nil
+		return
+	}
+
+	d.sys = survivors[0]
+	d.sys.tally = '*'
+
+	offset, jitter := combine(survivors)
+
+	authenticated := !slices.ContainsFunc(survivors, func(p *ntpPeer) bool { return p.nts == nil })
+
+	d.offset = offset
+	d.jitter = jitter
+	d.update = time.Now()
+
+	if !d.synced || math.Abs(offset) > ntpStepThreshold {
+		adjtime(int64(offset * 1e9))
+
+		d.slew = 0
+		d.synced = true
+		d.record(offset, "step")
+
+		// samples predating the step are invalid
+		for _, p := range d.peers {
+			p.samples = nil
+		}
+
+		// the drift estimate is unaffected as it tracks the raw timer
+		d.trackDrift(0)
+
+		if authenticated {
+			nts.Trusted.Store(true)
+		}
+
+		log.Printf("ntp: clock stepped by %v to %s (%s)", time.Duration(offset*1e9), d.sys.addr, d.sys.host)
+
+		return
+	}
+
+	if authenticated {
+		nts.Trusted.Store(true)
+	}
+
+	d.slew = offset
+	d.trackDrift(offset)
+	d.record(offset, "slew")
+}
+
+// adjust applies pending slew and frequency correction over the argument
+// interval.
+func (d *ntpDaemon) adjust(interval float64) {
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.synced {
+		return
+	}
+
+	limit := ntpMaxSlew * interval
+	slew := max(min(d.slew, limit), -limit)
+	d.slew -= slew
+
+	adjtime(int64((slew + d.freq*interval) * 1e9))
+}
+
+func (d *ntpDaemon) run(ctx context.Context) {
+	defer close(d.done)
+
+	d.resolve()
+
+	slew := time.NewTicker(ntpSlewInterval)
+	defer slew.Stop()
+
+	last := uptime()
+	poll := time.NewTimer(0)
+	burst := ntpBurst
+
+	for {
+		select {
+		case <-ctx.Done():
+			poll.Stop()
+			return
+		case <-slew.C:
+			now := uptime()
+			d.adjust(float64(now-last) / 1e9)
+			last = now
+		case <-poll.C:
+			d.Lock()
+			resolved := len(d.peers) > 0
+			d.Unlock()
+
+			if !resolved {
+				d.resolve()
+			}
+
+			d.poll()
+
+			if burst > 0 {
+				burst -= 1
+				poll.Reset(ntpBurstPoll)
+			} else {
+				poll.Reset(ntpPoll)
+			}
+		}
+	}
+}
+
+func startNTP(servers []string) (err error) {
+	ntpMutex.Lock()
+	defer ntpMutex.Unlock()
+
+	if ntpd != nil {
+		return errors.New("NTP daemon already started")
+	}
+
+	if len(servers) == 0 {
+		servers = DefaultNTPServers
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ntpd = &ntpDaemon{
+		servers: servers,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	go ntpd.run(ctx)
+
+	log.Printf("ntp: daemon started (%v)", servers)
+
+	return
+}
+
+func stopNTP() (err error) {
+	ntpMutex.Lock()
+	defer ntpMutex.Unlock()
+
+	if ntpd == nil {
+		return errors.New("NTP daemon not started")
+	}
+
+	ntpd.cancel()
+	<-ntpd.done
+	ntpd = nil
+
+	log.Printf("ntp: daemon stopped")
+
+	return
+}
+
+func ntpStatus() (string, error) {
+	var buf bytes.Buffer
+
+	ntpMutex.Lock()
+	d := ntpd
+	ntpMutex.Unlock()
+
+	if d == nil {
+		return "", errors.New("NTP daemon not started")
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	switch {
+	case d.sys != nil:
+		fmt.Fprintf(&buf, "synchronized to %s (%s), stratum %d\n", d.sys.addr, d.sys.host, d.sys.stratum+1)
+	case d.synced:
+		fmt.Fprintf(&buf, "unsynchronized (no majority of truechimers), holdover\n")
+	default:
+		fmt.Fprintf(&buf, "unsynchronized\n")
+	}
+
+	fmt.Fprintf(&buf, "offset %+.3f ms, jitter %.3f ms, pending slew %+.3f ms, frequency %+.3f ppm\n",
+		d.offset*1e3, d.jitter*1e3, d.slew*1e3, d.freq*1e6)
+
+	fmt.Fprintf(&buf, "%s\n", ntsMode(""))
+
+	if !d.update.IsZero() {
+		fmt.Fprintf(&buf, "last update %v ago\n", time.Since(d.update).Truncate(time.Second))
+	}
+
+	fmt.Fprintln(&buf)
+
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, " \tRemote\tHost\tSt\tReach\tAuth\tDelay (ms)\tOffset (ms)\tJitter (ms)\tLast error\n")
+
+	for _, p := range d.peers {
+		auth := "none"
+		lastErr := "-"
+
+		if p.nts != nil {
+			auth = fmt.Sprintf("nts (%d)", p.cookies)
+		}
+
+		if p.lastErr != nil {
+			lastErr = p.lastErr.Error()
+		}
+
+		fmt.Fprintf(w, "%c\t%s\t%s\t%d\t%03o\t%s\t%.3f\t%+.3f\t%.3f\t%s\n",
+			p.tally, p.addr, p.host, p.stratum, p.reach, auth, p.delay*1e3, p.offset*1e3, p.jitter*1e3, lastErr)
+	}
+
+	w.Flush()
+
+	fmt.Fprintf(&buf, "\n(* system peer, + survivor, - outlier, x falseticker)\n\nOffset history:\n")
+
+	w = tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+
+	for _, e := range d.history {
+		fmt.Fprintf(w, "%s\t%+.3f ms\t%+.3f ppm\t%s\t%s\n", e.ts.Format(time.RFC3339), e.offset*1e3, e.freq*1e6, e.action, e.peer)
+	}
+
+	w.Flush()
+
+	return buf.String(), nil
+}
@@ -0,0 +1,71 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/beevik/ntp"
+
+	"github.com/usbarmory/tamago-example/internal/nts"
+)
+
+// Network Time Security for NTP (RFC 8915) server URI scheme.
+const ntsScheme = "nts://"
+
+var (
+	// ntsRequired refuses unauthenticated time when set
+	ntsRequired atomic.Bool
+
+	errUnauthenticated = errors.New("unauthenticated time refused")
+)
+
+func init() {
+	nts.Timeout = ntpTimeout
+}
+
+// ntsQuery performs an NTS authenticated query to the argument NTS-KE server.
+func ntsQuery(ke string) (r *ntp.Response, err error) {
+	s, err := nts.KeyExchange(ke)
+
+	if err != nil {
+		return
+	}
+
+	ip, err := net.DefaultResolver.LookupIP(context.Background(), "ip4", s.Server)
+
+	if err != nil {
+		return
+	}
+
+	return s.Query(ip[0].String())
+}
+
+// ntsMode sets or reports whether unauthenticated time is refused.
+func ntsMode(mode string) string {
+	switch mode {
+	case "on":
+		ntsRequired.Store(true)
+	case "off":
+		ntsRequired.Store(false)
+	}
+
+	if ntsRequired.Load() {
+		return "unauthenticated time refused"
+	}
+
+	return "unauthenticated time accepted"
+}
+
+func isNTS(host string) (ke string, ok bool) {
+	return strings.CutPrefix(host, ntsScheme)
+}
@@ -0,0 +1,54 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/usbarmory/tamago-example/network"
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+func init() {
+	shell.Add(shell.Cmd{
+		Name:    "pcap",
+		Args:    3,
+		Pattern: regexp.MustCompile(`^pcap (start|stop|status)(?: (/[^\s]*))?(?: (.*))?$`),
+		Syntax:  "(start (<path>)? (<filter>)?|stop|status)",
+		Help:    "packet capture (pcapng), streamed at /debug/pcap",
+		Fn:      pcapCmd,
+	})
+}
+
+func pcapCmd(_ *shell.Interface, arg []string) (res string, err error) {
+	switch arg[0] {
+	case "start":
+		filter, err := network.ParseCaptureFilter(arg[2])
+
+		if err != nil {
+			return "", err
+		}
+
+		if err = network.StartCapture(arg[1], filter); err != nil {
+			return "", err
+		}
+
+		if len(arg[1]) > 0 {
+			res = fmt.Sprintf("capturing to %s and /debug/pcap", arg[1])
+		} else {
+			res = "capturing to /debug/pcap"
+		}
+	case "stop":
+		err = network.StopCapture()
+	case "status":
+		res = network.CaptureStatus()
+	}
+
+	return
+}
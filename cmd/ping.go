@@ -0,0 +1,109 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/usbarmory/tamago-example/network"
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+const (
+	defaultPingCount    = 4
+	defaultPingSize     = 56
+	defaultPingInterval = 1 * time.Second
+	maxHops             = 30
+)
+
+func init() {
+	shell.Add(shell.Cmd{
+		Name:    "ping",
+		Args:    2,
+		Pattern: regexp.MustCompile(`^ping ([^\s]+)((?: -[csi] [\d.]+)*)$`),
+		Syntax:  "<host> (-c <n>)? (-s <size>)? (-i <sec>)?",
+		Help:    "send ICMP echo requests",
+		Fn:      pingCmd,
+	})
+
+	shell.Add(shell.Cmd{
+		Name:    "traceroute",
+		Args:    1,
+		Pattern: regexp.MustCompile(`^traceroute ([^\s]+)$`),
+		Syntax:  "<host>",
+		Help:    "trace route to host via UDP probes",
+		Fn:      tracerouteCmd,
+	})
+}
+
+func resolve(host string) (ip net.IP, err error) {
+	if ip = net.ParseIP(host); ip != nil {
+		return
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip4", host)
+
+	if err != nil {
+		return
+	}
+
+	return ips[0], nil
+}
+
+func pingCmd(console *shell.Interface, arg []string) (res string, err error) {
+	count := defaultPingCount
+	size := defaultPingSize
+	interval := defaultPingInterval
+
+	opts := strings.Fields(arg[1])
+
+	for i := 0; i+1 < len(opts); i += 2 {
+		switch opts[i] {
+		case "-c":
+			if count, err = strconv.Atoi(opts[i+1]); err != nil || count <= 0 {
+				return "", fmt.Errorf("invalid count")
+			}
+		case "-s":
+			if size, err = strconv.Atoi(opts[i+1]); err != nil {
+				return "", fmt.Errorf("invalid size, %v", err)
+			}
+		case "-i":
+			sec, err := strconv.ParseFloat(opts[i+1], 64)
+
+			if err != nil || sec <= 0 {
+				return "", fmt.Errorf("invalid interval")
+			}
+
+			interval = time.Duration(sec * float64(time.Second))
+		}
+	}
+
+	ip, err := resolve(arg[0])
+
+	if err != nil {
+		return
+	}
+
+	return "", network.Ping(console.Output, ip, count, size, interval)
+}
+
+func tracerouteCmd(console *shell.Interface, arg []string) (res string, err error) {
+	ip, err := resolve(arg[0])
+
+	if err != nil {
+		return
+	}
+
+	return "", network.Traceroute(console.Output, ip, maxHops)
+}
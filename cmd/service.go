@@ -0,0 +1,61 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/usbarmory/tamago-example/network"
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+func init() {
+	shell.Add(shell.Cmd{
+		Name:    "service",
+		Args:    4,
+		Pattern: regexp.MustCompile(`^service (list|start|stop|restart|bind)(?: ([^\s]+))?(?: (?:([^\s:]+))?:(\d+))?$`),
+		Syntax:  "(list|<op> <name>|bind <name> (<iface>)?:<port>)",
+		Help:    "network service manager (op: start|stop|restart)",
+		Fn:      serviceCmd,
+	})
+}
+
+func serviceCmd(_ *shell.Interface, arg []string) (res string, err error) {
+	name := arg[1]
+
+	if arg[0] != "list" && len(name) == 0 {
+		return "", fmt.Errorf("missing service name")
+	}
+
+	switch arg[0] {
+	case "list":
+		res = network.Services()
+	case "start":
+		err = network.StartService(name)
+	case "stop":
+		err = network.StopService(name)
+	case "restart":
+		err = network.RestartService(name)
+	case "bind":
+		if len(arg[3]) == 0 {
+			return "", fmt.Errorf("missing port")
+		}
+
+		port, err := strconv.ParseUint(arg[3], 10, 16)
+
+		if err != nil {
+			return "", fmt.Errorf("invalid port, %v", err)
+		}
+
+		return "", network.BindService(name, arg[2], uint16(port))
+	}
+
+	return
+}
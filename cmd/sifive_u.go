@@ -51,6 +51,11 @@ func infoCmd(_ *shell.Interface, _ []string) (string, error) {
 	return res.String(), nil
 }
 
+// UniqueID returns the SoC unique identifier.
+func UniqueID() []byte {
+	return nil
+}
+
 func rebootCmd(_ *shell.Interface, _ []string) (_ string, err error) {
 	return "", errors.New("unimplemented")
 }
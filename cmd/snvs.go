@@ -0,0 +1,33 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory
+
+package cmd
+
+import (
+	"github.com/usbarmory/tamago-example/network"
+)
+
+// b2f converts a boolean to a metric value.
+func b2f(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// snvsMetrics exports the SNVS Secure State Machine state and tamper
+// detection status.
+func snvsMetrics(m *network.Metrics) {
+	ssm := SNVS.Monitor()
+
+	m.Gauge("tamago_snvs_ssm_state", "SNVS Secure State Machine state.", float64(ssm.State))
+	m.Gauge("tamago_snvs_violation", "SNVS tamper detection status.", b2f(ssm.Clock), "source", "clock")
+	m.Gauge("tamago_snvs_violation", "SNVS tamper detection status.", b2f(ssm.Temperature), "source", "temperature")
+	m.Gauge("tamago_snvs_violation", "SNVS tamper detection status.", b2f(ssm.Voltage), "source", "voltage")
+	m.Gauge("tamago_snvs_hac", "SNVS High Assurance Counter.", float64(ssm.HAC))
+}
@@ -0,0 +1,125 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/usbarmory/tamago-example/network"
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+// SSHAuthorizedKeys represents the base64 encoded authorized_keys for the SSH
+// server, it is meant to be set at build time (see AUTHORIZED_KEYS in the
+// Makefile).
+var SSHAuthorizedKeys string
+
+func init() {
+	shell.Add(shell.Cmd{
+		Name:    "sshauth",
+		Args:    3,
+		Pattern: regexp.MustCompile(`^sshauth(?: (ca|password|off)(?: ([^\s]+))?(?: ([^\s]+))?)?$`),
+		Syntax:  "(ca <path>|password <user> <pw>|off)?",
+		Help:    "show/change SSH server authentication",
+		Fn:      sshauthCmd,
+	})
+
+	shell.Add(shell.Cmd{
+		Name:    "sshpriv",
+		Args:    2,
+		Pattern: regexp.MustCompile(`^sshpriv(?: ([^\s]+) (admin|readonly|deny))?$`),
+		Syntax:  "(<principal> <admin|readonly|deny>)?",
+		Help:    "show/change SSH principal privilege level (* for any)",
+		Fn:      sshprivCmd,
+	})
+
+	if len(SSHAuthorizedKeys) == 0 {
+		return
+	}
+
+	buf, err := base64.StdEncoding.DecodeString(SSHAuthorizedKeys)
+
+	if err == nil {
+		err = network.SetSSHAuthorizedKeys(buf)
+	}
+
+	if err != nil {
+		log.Printf("invalid build time authorized keys, %v", err)
+	}
+}
+
+func sshauthCmd(_ *shell.Interface, arg []string) (res string, err error) {
+	switch arg[0] {
+	case "":
+	case "ca":
+		var keys []ssh.PublicKey
+
+		if len(arg[1]) == 0 || len(arg[2]) > 0 {
+			return "", errors.New("invalid certificate authority path")
+		}
+
+		buf, err := os.ReadFile(arg[1])
+
+		if err != nil {
+			return "", err
+		}
+
+		for _, line := range bytes.Split(buf, []byte("\n")) {
+			if line = bytes.TrimSpace(line); len(line) == 0 || line[0] == '#' {
+				continue
+			}
+
+			key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+
+			if err != nil {
+				return "", fmt.Errorf("invalid key in %s, %v", arg[1], err)
+			}
+
+			keys = append(keys, key)
+		}
+
+		if len(keys) == 0 {
+			return "", fmt.Errorf("no public keys found in %s", arg[1])
+		}
+
+		network.SetSSHUserCAs(keys)
+	case "password":
+		if len(arg[1]) == 0 || len(arg[2]) == 0 {
+			return "", errors.New("missing user or password")
+		}
+
+		network.SetSSHPassword(arg[1], arg[2])
+	case "off":
+		network.SetSSHUserCAs(nil)
+		network.SetSSHPassword("", "")
+	}
+
+	return network.SSHAuthStatus(), nil
+}
+
+func sshprivCmd(_ *shell.Interface, arg []string) (res string, err error) {
+	if len(arg[0]) > 0 {
+		p, err := network.ParseSSHPrivilege(arg[1])
+
+		if err != nil {
+			return "", err
+		}
+
+		network.SetSSHPrincipal(arg[0], p)
+	}
+
+	return network.SSHAuthStatus(), nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/usbarmory/tamago-example/network"
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+func init() {
+	shell.Add(shell.Cmd{
+		Name:    "syslog",
+		Args:    3,
+		Pattern: regexp.MustCompile(`^syslog (start|stop|status)(?: ((?:udp|tcp|tls)://[^\s]+))?(?: (\d+))?$`),
+		Syntax:  "(start <uri> (<msg/sec>)?|stop|status)",
+		Help:    "remote syslog (RFC5424) forwarding (udp|tcp|tls://host:port)",
+		Fn:      syslogCmd,
+	})
+}
+
+func syslogCmd(_ *shell.Interface, arg []string) (res string, err error) {
+	switch arg[0] {
+	case "start":
+		var limit int
+
+		if len(arg[1]) == 0 {
+			return "", fmt.Errorf("missing syslog server URI")
+		}
+
+		if len(arg[2]) > 0 {
+			if limit, err = strconv.Atoi(arg[2]); err != nil {
+				return "", fmt.Errorf("invalid rate, %v", err)
+			}
+		}
+
+		target, _ := Target()
+
+		if err = network.StartSyslog(arg[1], target, limit); err != nil {
+			return
+		}
+
+		res = fmt.Sprintf("forwarding logs to %s", arg[1])
+	case "stop":
+		network.StopSyslog()
+	case "status":
+		res = network.SyslogStatus()
+	}
+
+	return
+}
@@ -60,7 +60,10 @@ func tailscaleCmd(console *shell.Interface, arg []string) (res string, err error
 	}
 
 	c := *console
-	network.StartSSHServer(listenerSSH, &c)
+
+	if err = network.StartSSHServer(listenerSSH, &c); err != nil {
+		return
+	}
 
 	listenerHTTP, err := s.Listen("tcp", fmt.Sprintf(":%d", 80))
 
@@ -74,8 +77,11 @@ func tailscaleCmd(console *shell.Interface, arg []string) (res string, err error
 		return
 	}
 
-	network.StartWebServer(listenerHTTP, status.TailscaleIPs[0].String(), 80, false)
-	network.StartWebServer(listenerHTTPS, status.TailscaleIPs[0].String(), 443, true)
+	if err = network.StartWebServer(listenerHTTP, status.TailscaleIPs[0].String(), 80, false, nil); err != nil {
+		return
+	}
+
+	err = network.StartWebServer(listenerHTTPS, status.TailscaleIPs[0].String(), 443, true, nil)
 
 	return
 }
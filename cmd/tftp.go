@@ -0,0 +1,103 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/usbarmory/tamago-example/network"
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+func init() {
+	shell.Add(shell.Cmd{
+		Name:    "tftp",
+		Args:    6,
+		Pattern: regexp.MustCompile(`^tftp (?:(get|put) ([^\s]+) ([^\s]+)(?: ([^\s]+))?|(serve)(?: (rw))?)$`),
+		Syntax:  "(get|put) <host> <remote> (<local>)?|serve (rw)?",
+		Help:    "TFTP file transfer or server (read-only unless rw)",
+		Fn:      tftpCmd,
+	})
+}
+
+func tftpCmd(console *shell.Interface, arg []string) (res string, err error) {
+	var n int64
+
+	if arg[4] == "serve" {
+		network.TFTPWritable = arg[5] == "rw"
+
+		if err = network.RestartService("tftp"); err != nil {
+			return
+		}
+
+		mode := "read-only"
+
+		if network.TFTPWritable {
+			mode = "read-write"
+		}
+
+		return fmt.Sprintf("serving %s (%s), stop with `service stop tftp`", network.TFTPRoot, mode), nil
+	}
+
+	ip, err := resolve(arg[1])
+
+	if err != nil {
+		return
+	}
+
+	remote := arg[2]
+	local := arg[3]
+
+	if len(local) == 0 {
+		local = path.Base(remote)
+	}
+
+	start := time.Now()
+
+	switch arg[0] {
+	case "get":
+		f, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		fmt.Fprintf(console.Output, "receiving %s from %s to %s\n", remote, ip, local)
+
+		if n, err = network.TFTPGet(ip, remote, f); err != nil {
+			os.Remove(local)
+			return "", err
+		}
+	case "put":
+		f, err := os.Open(local)
+
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(console.Output, "sending %s to %s as %s\n", local, ip, remote)
+
+		if n, err = network.TFTPPut(ip, remote, f, fi.Size()); err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%d bytes transferred in %v", n, time.Since(start)), nil
+}
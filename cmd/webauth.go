@@ -0,0 +1,72 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/usbarmory/tamago-example/network"
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+func init() {
+	shell.Add(shell.Cmd{
+		Name:    "webauth",
+		Args:    3,
+		Pattern: regexp.MustCompile(`^webauth(?: (basic|bearer|ca|off)(?: ([^\s]+))?(?: ([^\s]+))?)?$`),
+		Syntax:  "(basic <user> <pw>|bearer <token>|ca <pem>|off)?",
+		Help:    "show/change authentication of sensitive web routes",
+		Fn:      webauthCmd,
+	})
+}
+
+func webauthCmd(_ *shell.Interface, arg []string) (res string, err error) {
+	switch arg[0] {
+	case "":
+	case "basic":
+		if len(arg[1]) == 0 || len(arg[2]) == 0 {
+			return "", errors.New("missing user or password")
+		}
+
+		network.SetWebBasicAuth(arg[1], arg[2])
+	case "bearer":
+		if len(arg[1]) == 0 {
+			return "", errors.New("missing token")
+		}
+
+		network.SetWebBearerToken(arg[1])
+	case "ca":
+		if len(arg[1]) == 0 {
+			return "", errors.New("missing certificate path")
+		}
+
+		buf, err := os.ReadFile(arg[1])
+
+		if err != nil {
+			return "", err
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(buf) {
+			return "", fmt.Errorf("no PEM certificates found in %s", arg[1])
+		}
+
+		network.SetWebClientCAs(pool)
+	case "off":
+		network.SetWebBasicAuth("", "")
+		network.SetWebBearerToken("")
+		network.SetWebClientCAs(nil)
+	}
+
+	return network.WebAuthStatus(), nil
+}
@@ -0,0 +1,71 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/usbarmory/tamago-example/network"
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+func init() {
+	shell.Add(shell.Cmd{
+		Name:    "wg",
+		Args:    2,
+		Pattern: regexp.MustCompile(`^wg (up|down|show|genkey)(?: ([^\s]+))?$`),
+		Syntax:  "(up <config path>|down|show|genkey)",
+		Help:    "WireGuard tunnel (wg-quick config), serving SSH and HTTP",
+		Fn:      wgCmd,
+	})
+}
+
+func wgCmd(console *shell.Interface, arg []string) (res string, err error) {
+	switch arg[0] {
+	case "up":
+		if len(arg[1]) == 0 {
+			return "", fmt.Errorf("missing configuration path")
+		}
+
+		buf, err := os.ReadFile(arg[1])
+
+		if err != nil {
+			return "", err
+		}
+
+		cfg, err := network.ParseWireGuardConfig(buf)
+
+		if err != nil {
+			return "", fmt.Errorf("invalid configuration, %v", err)
+		}
+
+		c := *console
+
+		if err = network.StartWireGuard(cfg, &c); err != nil {
+			return "", err
+		}
+
+		res = fmt.Sprintf("tunnel up at %s", cfg.Address)
+	case "down":
+		err = network.StopWireGuard()
+	case "show":
+		res, err = network.WireGuardStatus()
+	case "genkey":
+		privateKey, publicKey, err := network.WireGuardKeyPair()
+
+		if err != nil {
+			return "", err
+		}
+
+		res = fmt.Sprintf("PrivateKey = %s\n# PublicKey = %s", privateKey, publicKey)
+	}
+
+	return
+}
@@ -0,0 +1,467 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package nts implements a Network Time Security (RFC 8915) client for NTPv4,
+// with AEAD_AES_SIV_CMAC_256 (RFC 5297) authentication.
+package nts
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+// Network Time Security for NTP (RFC 8915) parameters.
+const (
+	ntsKEPort = 4460
+	ntsALPN   = "ntske/1"
+	ntsLabel  = "EXPORTER-network-time-security"
+
+	// maximum number of cookies held for each server
+	ntsMaxCookies = 8
+	// maximum NTS-KE response size
+	ntsMaxKE = 65536
+
+	// NTS-KE record types (RFC 8915 4.1.)
+	ntsRecordEnd          = 0
+	ntsRecordNextProtocol = 1
+	ntsRecordError        = 2
+	ntsRecordWarning      = 3
+	ntsRecordAEAD         = 4
+	ntsRecordCookie       = 5
+	ntsRecordServer       = 6
+	ntsRecordPort         = 7
+	ntsRecordCritical     = 0x8000
+
+	// NTPv4 protocol identifier
+	ntsProtocolNTPv4 = 0
+	// AEAD_AES_SIV_CMAC_256 (RFC 5297)
+	ntsAEADSIV = 15
+
+	// NTP extension field types (RFC 8915 5.7.)
+	ntsUniqueIdentifier  = 0x0104
+	ntsCookie            = 0x0204
+	ntsCookiePlaceholder = 0x0304
+	ntsAuthenticator     = 0x0404
+
+	ntpHeaderSize = 48
+	ntpPort       = 123
+)
+
+var (
+	// Timeout represents the NTS-KE and NTP query timeout.
+	Timeout = 5 * time.Second
+
+	// Trusted must be set once the clock is synchronized through NTS, until
+	// then NTS-KE certificate validity periods are not checked against it.
+	Trusted atomic.Bool
+
+	// certificate roots, the host ones when nil
+	roots *x509.CertPool
+)
+
+// Session represents NTS-KE negotiated state for an NTP server.
+type Session struct {
+	// Server is the negotiated NTP server address.
+	Server string
+	// Port is the negotiated NTP server port.
+	Port int
+
+	// NTS-KE server address
+	ke string
+
+	c2s     []byte
+	s2c     []byte
+	cookies [][]byte
+}
+
+func ntsRecord(buf *bytes.Buffer, typ uint16, body []byte) {
+	binary.Write(buf, binary.BigEndian, typ)
+	binary.Write(buf, binary.BigEndian, uint16(len(body)))
+	buf.Write(body)
+}
+
+// ntsVerify validates the NTS-KE server certificate chain, until the clock is
+// trusted the chain is validated at its latest issuance time to avoid
+// circular dependency on the time being set.
+func ntsVerify(host string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) (err error) {
+		if cs.NegotiatedProtocol != ntsALPN {
+			return errors.New("ALPN negotiation failed")
+		}
+
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("missing server certificate")
+		}
+
+		opts := x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+		}
+
+		for _, cert := range cs.PeerCertificates {
+			if cert.NotBefore.After(opts.CurrentTime) {
+				opts.CurrentTime = cert.NotBefore
+			}
+		}
+
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		if Trusted.Load() {
+			opts.CurrentTime = time.Now()
+		}
+
+		_, err = cs.PeerCertificates[0].Verify(opts)
+
+		return
+	}
+}
+
+// KeyExchange performs NTS Key Establishment (RFC 8915 4.) with the argument
+// server, in host[:port] format.
+func KeyExchange(addr string) (s *Session, err error) {
+	host, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		host = addr
+		port = strconv.Itoa(ntsKEPort)
+	}
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: Timeout},
+		Config: &tls.Config{
+			ServerName:         host,
+			MinVersion:         tls.VersionTLS13,
+			NextProtos:         []string{ntsALPN},
+			InsecureSkipVerify: true,
+			VerifyConnection:   ntsVerify(host),
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	c, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+
+	if err != nil {
+		return nil, fmt.Errorf("NTS-KE connection error, %v", err)
+	}
+	defer c.Close()
+
+	conn := c.(*tls.Conn)
+	conn.SetDeadline(time.Now().Add(Timeout))
+
+	req := &bytes.Buffer{}
+	ntsRecord(req, ntsRecordCritical|ntsRecordNextProtocol, []byte{0, ntsProtocolNTPv4})
+	ntsRecord(req, ntsRecordAEAD, []byte{0, ntsAEADSIV})
+	ntsRecord(req, ntsRecordCritical|ntsRecordEnd, nil)
+
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		return
+	}
+
+	s = &Session{
+		Server: host,
+		Port:   ntpPort,
+		ke:     addr,
+	}
+
+	r := io.LimitReader(conn, ntsMaxKE)
+	hdr := make([]byte, 4)
+
+	var protocol, aead bool
+
+	for {
+		if _, err = io.ReadFull(r, hdr); err != nil {
+			return nil, fmt.Errorf("NTS-KE read error, %v", err)
+		}
+
+		critical := binary.BigEndian.Uint16(hdr[0:2])&ntsRecordCritical != 0
+		typ := binary.BigEndian.Uint16(hdr[0:2]) &^ ntsRecordCritical
+		body := make([]byte, binary.BigEndian.Uint16(hdr[2:4]))
+
+		if _, err = io.ReadFull(r, body); err != nil {
+			return nil, fmt.Errorf("NTS-KE read error, %v", err)
+		}
+
+		switch typ {
+		case ntsRecordEnd:
+			switch {
+			case !protocol:
+				return nil, errors.New("NTS-KE protocol negotiation failed")
+			case !aead:
+				return nil, errors.New("NTS-KE AEAD negotiation failed")
+			case len(s.cookies) == 0:
+				return nil, errors.New("NTS-KE returned no cookies")
+			}
+
+			return s, s.exportKeys(conn)
+		case ntsRecordNextProtocol:
+			if !bytes.Equal(body, []byte{0, ntsProtocolNTPv4}) {
+				return nil, errors.New("NTS-KE unsupported protocol")
+			}
+
+			protocol = true
+		case ntsRecordError:
+			if len(body) < 2 {
+				return nil, errors.New("NTS-KE error")
+			}
+
+			return nil, fmt.Errorf("NTS-KE error %d", binary.BigEndian.Uint16(body))
+		case ntsRecordWarning:
+			continue
+		case ntsRecordAEAD:
+			if !bytes.Equal(body, []byte{0, ntsAEADSIV}) {
+				return nil, errors.New("NTS-KE unsupported AEAD algorithm")
+			}
+
+			aead = true
+		case ntsRecordCookie:
+			if len(s.cookies) < ntsMaxCookies {
+				s.cookies = append(s.cookies, body)
+			}
+		case ntsRecordServer:
+			s.Server = string(body)
+		case ntsRecordPort:
+			if len(body) != 2 {
+				return nil, errors.New("NTS-KE invalid port")
+			}
+
+			s.Port = int(binary.BigEndian.Uint16(body))
+		default:
+			if critical {
+				return nil, fmt.Errorf("NTS-KE unsupported critical record %d", typ)
+			}
+		}
+	}
+}
+
+// exportKeys derives the NTS keys (RFC 8915 5.1.) from the argument NTS-KE
+// connection.
+func (s *Session) exportKeys(conn *tls.Conn) (err error) {
+	cs := conn.ConnectionState()
+	ctx := []byte{0, ntsProtocolNTPv4, 0, ntsAEADSIV, 0}
+
+	if s.c2s, err = cs.ExportKeyingMaterial(ntsLabel, ctx, 32); err != nil {
+		return
+	}
+
+	ctx[4] = 1
+	s.s2c, err = cs.ExportKeyingMaterial(ntsLabel, ctx, 32)
+
+	return
+}
+
+// rekey performs a new key establishment, as required when cookies are
+// exhausted or rejected.
+func (s *Session) rekey() (err error) {
+	n, err := KeyExchange(s.ke)
+
+	if err != nil {
+		return
+	}
+
+	s.c2s = n.c2s
+	s.s2c = n.s2c
+	s.cookies = n.cookies
+
+	return
+}
+
+// Cookies returns the number of cookies held for the session.
+func (s *Session) Cookies() int {
+	return len(s.cookies)
+}
+
+// Query performs an authenticated NTPv4 query to the argument address, the
+// session must not be used concurrently.
+func (s *Session) Query(addr string) (r *ntp.Response, err error) {
+	if len(s.cookies) == 0 {
+		if err = s.rekey(); err != nil {
+			return
+		}
+	}
+
+	opts := ntp.QueryOptions{
+		Timeout:    Timeout,
+		Port:       s.Port,
+		Extensions: []ntp.Extension{&ntsRequest{session: s}},
+	}
+
+	return ntp.QueryWithOptions(addr, opts)
+}
+
+// ntsRequest implements ntp.Extension for a single authenticated NTPv4
+// request/response exchange (RFC 8915 5.).
+type ntsRequest struct {
+	session *Session
+	uid     []byte
+}
+
+func ntsExtensionField(buf *bytes.Buffer, typ uint16, body []byte) {
+	// padded to a word boundary, with a 16 bytes minimum (RFC 7822)
+	n := max((4+len(body)+3)&^3, 16)
+
+	binary.Write(buf, binary.BigEndian, typ)
+	binary.Write(buf, binary.BigEndian, uint16(n))
+	buf.Write(body)
+	buf.Write(make([]byte, n-4-len(body)))
+}
+
+func (e *ntsRequest) ProcessQuery(buf *bytes.Buffer) (err error) {
+	s := e.session
+
+	if len(s.cookies) == 0 {
+		return errors.New("no NTS cookies")
+	}
+
+	e.uid = make([]byte, 32)
+	nonce := make([]byte, 16)
+
+	if _, err = rand.Read(e.uid); err != nil {
+		return
+	}
+
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	// cookies are never reused, regardless of the query outcome
+	cookie := s.cookies[0]
+	s.cookies = s.cookies[1:]
+
+	ntsExtensionField(buf, ntsUniqueIdentifier, e.uid)
+	ntsExtensionField(buf, ntsCookie, cookie)
+
+	// request replacement of all consumed cookies
+	for i := len(s.cookies) + 1; i < ntsMaxCookies; i++ {
+		ntsExtensionField(buf, ntsCookiePlaceholder, make([]byte, len(cookie)))
+	}
+
+	ciphertext, err := sivSeal(s.c2s, nil, buf.Bytes(), nonce)
+
+	if err != nil {
+		return
+	}
+
+	auth := &bytes.Buffer{}
+	binary.Write(auth, binary.BigEndian, uint16(len(nonce)))
+	binary.Write(auth, binary.BigEndian, uint16(len(ciphertext)))
+	auth.Write(nonce)
+	auth.Write(ciphertext)
+
+	ntsExtensionField(buf, ntsAuthenticator, auth.Bytes())
+
+	return
+}
+
+func (e *ntsRequest) ProcessResponse(buf []byte) (err error) {
+	var uid bool
+
+	s := e.session
+
+	if len(buf) < ntpHeaderSize {
+		return errors.New("invalid NTP response")
+	}
+
+	// NTS negative acknowledgment (RFC 8915 5.7.), being unauthenticated it
+	// is only honoured when carrying the request unique identifier
+	nak := buf[1] == 0 && string(buf[12:16]) == "NTSN"
+
+	for off := ntpHeaderSize; off+4 <= len(buf); {
+		typ := binary.BigEndian.Uint16(buf[off:])
+		n := int(binary.BigEndian.Uint16(buf[off+2:]))
+
+		if n < 4 || n%4 != 0 || off+n > len(buf) {
+			return errors.New("invalid NTP extension field")
+		}
+
+		body := buf[off+4 : off+n]
+
+		switch typ {
+		case ntsUniqueIdentifier:
+			uid = subtle.ConstantTimeCompare(body[:min(len(body), len(e.uid))], e.uid) == 1
+
+			if nak && uid {
+				s.cookies = nil
+				return errors.New("NTS cookie rejected")
+			}
+		case ntsAuthenticator:
+			if nak {
+				break
+			}
+
+			if !uid {
+				return errors.New("NTS unique identifier mismatch")
+			}
+
+			return e.authenticate(buf[:off], body)
+		}
+
+		off += n
+	}
+
+	if nak {
+		return errors.New("NTS negative acknowledgment unique identifier mismatch")
+	}
+
+	return errors.New("NTS authenticator missing")
+}
+
+func (e *ntsRequest) authenticate(ad []byte, body []byte) (err error) {
+	if len(body) < 4 {
+		return errors.New("invalid NTS authenticator")
+	}
+
+	nonceLen := int(binary.BigEndian.Uint16(body[0:]))
+	ciphertextLen := int(binary.BigEndian.Uint16(body[2:]))
+	off := 4 + (nonceLen+3)&^3
+
+	if off+ciphertextLen > len(body) {
+		return errors.New("invalid NTS authenticator")
+	}
+
+	nonce := body[4 : 4+nonceLen]
+	ciphertext := body[off : off+ciphertextLen]
+
+	plaintext, err := sivOpen(e.session.s2c, ciphertext, ad, nonce)
+
+	if err != nil {
+		return errors.New("NTS authentication failed")
+	}
+
+	for off := 0; off+4 <= len(plaintext); {
+		typ := binary.BigEndian.Uint16(plaintext[off:])
+		n := int(binary.BigEndian.Uint16(plaintext[off+2:]))
+
+		if n < 4 || off+n > len(plaintext) {
+			break
+		}
+
+		if typ == ntsCookie && len(e.session.cookies) < ntsMaxCookies {
+			e.session.cookies = append(e.session.cookies, bytes.Clone(plaintext[off+4:off+n]))
+		}
+
+		off += n
+	}
+
+	return
+}
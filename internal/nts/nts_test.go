@@ -0,0 +1,458 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package nts
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func unhex(s string) []byte {
+	buf, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+
+	if err != nil {
+		panic(err)
+	}
+
+	return buf
+}
+
+// RFC 5297 Appendix A test vectors
+var sivTests = []struct {
+	name       string
+	key        string
+	ad         []string
+	plaintext  string
+	ciphertext string
+}{
+	{
+		name:       "A.1 deterministic authenticated encryption",
+		key:        "fffefdfc fbfaf9f8 f7f6f5f4 f3f2f1f0 f0f1f2f3 f4f5f6f7 f8f9fafb fcfdfeff",
+		ad:         []string{"10111213 14151617 18191a1b 1c1d1e1f 20212223 24252627"},
+		plaintext:  "11223344 55667788 99aabbcc ddee",
+		ciphertext: "85632d07 c6e8f37f 950acd32 0a2ecc93 40c02b96 90c4dc04 daef7f6a fe5c",
+	},
+	{
+		name: "A.2 nonce-based authenticated encryption",
+		key:  "7f7e7d7c 7b7a7978 77767574 73727170 40414243 44454647 48494a4b 4c4d4e4f",
+		ad: []string{
+			"00112233 44556677 8899aabb ccddeeff deaddada deaddada ffeeddcc bbaa9988 77665544 33221100",
+			"10203040 50607080 90a0",
+			"09f91102 9d74e35b d84156c5 635688c0",
+		},
+		plaintext:  "74686973 20697320 736f6d65 20706c61 696e7465 78742074 6f20656e 63727970 74207573 696e6720 5349562d 414553",
+		ciphertext: "7bdb6e3b 432667eb 06f4d14b ff2fbd0f cb900f2f ddbe4043 26601965 c889bf17 dba77ceb 094fa663 b7a3f748 ba8af829 ea64ad54 4a272e9c 485b62a3 fd5c0d",
+	},
+}
+
+func TestSIV(t *testing.T) {
+	for _, tt := range sivTests {
+		var ad [][]byte
+
+		for _, s := range tt.ad {
+			ad = append(ad, unhex(s))
+		}
+
+		key := unhex(tt.key)
+		plaintext := unhex(tt.plaintext)
+		ciphertext := unhex(tt.ciphertext)
+
+		out, err := sivSeal(key, plaintext, ad...)
+
+		if err != nil {
+			t.Fatalf("%s: seal error, %v", tt.name, err)
+		}
+
+		if !bytes.Equal(out, ciphertext) {
+			t.Errorf("%s: ciphertext %x != %x", tt.name, out, ciphertext)
+		}
+
+		if out, err = sivOpen(key, ciphertext, ad...); err != nil {
+			t.Fatalf("%s: open error, %v", tt.name, err)
+		}
+
+		if !bytes.Equal(out, plaintext) {
+			t.Errorf("%s: plaintext %x != %x", tt.name, out, plaintext)
+		}
+
+		ciphertext[len(ciphertext)-1] ^= 1
+
+		if _, err = sivOpen(key, ciphertext, ad...); err == nil {
+			t.Errorf("%s: tampered ciphertext authenticated", tt.name)
+		}
+	}
+}
+
+// stand-in NTP server behaviours
+const (
+	serveTime = iota
+	serveForged
+	serveNAK
+	serveForgedNAK
+)
+
+// standIn implements a local NTS-KE and NTS authenticated NTP server.
+type standIn struct {
+	sync.Mutex
+
+	t    *testing.T
+	ke   net.Listener
+	conn net.PacketConn
+	mode atomic.Int32
+
+	// NTS keys (c2s, s2c) by issued cookie
+	keys map[string][2][]byte
+}
+
+func newStandIn(t *testing.T) (s *standIn) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots = x509.NewCertPool()
+	roots.AddCert(cert)
+
+	s = &standIn{
+		t:    t,
+		keys: make(map[string][2][]byte),
+	}
+
+	s.ke, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+		MinVersion:   tls.VersionTLS13,
+		NextProtos:   []string{ntsALPN},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.conn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		s.ke.Close()
+		s.conn.Close()
+		roots = nil
+	})
+
+	go s.serveKE()
+	go s.serveNTP()
+
+	return
+}
+
+func (s *standIn) serveKE() {
+	for {
+		c, err := s.ke.Accept()
+
+		if err != nil {
+			return
+		}
+
+		conn := c.(*tls.Conn)
+
+		if err = s.keyExchange(conn); err != nil {
+			s.t.Errorf("stand-in NTS-KE error, %v", err)
+		}
+
+		conn.Close()
+	}
+}
+
+func (s *standIn) keyExchange(conn *tls.Conn) (err error) {
+	hdr := make([]byte, 4)
+
+	for {
+		if _, err = io.ReadFull(conn, hdr); err != nil {
+			return
+		}
+
+		body := make([]byte, binary.BigEndian.Uint16(hdr[2:4]))
+
+		if _, err = io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		if binary.BigEndian.Uint16(hdr[0:2])&^ntsRecordCritical == ntsRecordEnd {
+			break
+		}
+	}
+
+	c := &Session{}
+
+	if err = c.exportKeys(conn); err != nil {
+		return
+	}
+
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(s.conn.LocalAddr().(*net.UDPAddr).Port))
+
+	res := &bytes.Buffer{}
+	ntsRecord(res, ntsRecordCritical|ntsRecordNextProtocol, []byte{0, ntsProtocolNTPv4})
+	ntsRecord(res, ntsRecordAEAD, []byte{0, ntsAEADSIV})
+	ntsRecord(res, ntsRecordPort, port)
+
+	for range ntsMaxCookies {
+		ntsRecord(res, ntsRecordCookie, s.cookie(c.c2s, c.s2c))
+	}
+
+	ntsRecord(res, ntsRecordCritical|ntsRecordEnd, nil)
+
+	_, err = conn.Write(res.Bytes())
+
+	return
+}
+
+func (s *standIn) cookie(c2s []byte, s2c []byte) []byte {
+	cookie := make([]byte, 64)
+	rand.Read(cookie)
+
+	s.Lock()
+	s.keys[string(cookie)] = [2][]byte{c2s, s2c}
+	s.Unlock()
+
+	return cookie
+}
+
+func (s *standIn) serveNTP() {
+	buf := make([]byte, 4096)
+
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+
+		if err != nil {
+			return
+		}
+
+		res, err := s.respond(buf[:n])
+
+		if err != nil {
+			s.t.Errorf("stand-in NTP error, %v", err)
+			continue
+		}
+
+		s.conn.WriteTo(res, addr)
+	}
+}
+
+func ntpTimestamp(t time.Time) []byte {
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint32(ts[0:], uint32(t.Unix()+2208988800))
+	binary.BigEndian.PutUint32(ts[4:], uint32(uint64(t.Nanosecond())<<32/1e9))
+
+	return ts
+}
+
+func (s *standIn) respond(req []byte) (res []byte, err error) {
+	var uid []byte
+	var keys [2][]byte
+	var authenticated bool
+
+	placeholders := 0
+
+	for off := ntpHeaderSize; off+4 <= len(req); {
+		typ := binary.BigEndian.Uint16(req[off:])
+		n := int(binary.BigEndian.Uint16(req[off+2:]))
+		body := req[off+4 : off+n]
+
+		switch typ {
+		case ntsUniqueIdentifier:
+			uid = req[off : off+n]
+		case ntsCookie:
+			s.Lock()
+			keys = s.keys[string(body)]
+			delete(s.keys, string(body))
+			s.Unlock()
+		case ntsCookiePlaceholder:
+			placeholders++
+		case ntsAuthenticator:
+			nonceLen := int(binary.BigEndian.Uint16(body[0:]))
+			ciphertextLen := int(binary.BigEndian.Uint16(body[2:]))
+			nonce := body[4 : 4+nonceLen]
+			ciphertext := body[4+(nonceLen+3)&^3:][:ciphertextLen]
+
+			if _, err = sivOpen(keys[0], ciphertext, req[:off], nonce); err != nil {
+				return
+			}
+
+			authenticated = true
+		}
+
+		off += n
+	}
+
+	if !authenticated || uid == nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	now := time.Now()
+	buf := &bytes.Buffer{}
+	hdr := make([]byte, ntpHeaderSize)
+
+	hdr[0] = 4<<3 | 4 // NTPv4 server
+	hdr[1] = 1
+	copy(hdr[12:16], "TEST")
+	copy(hdr[24:32], req[40:48])
+	copy(hdr[32:40], ntpTimestamp(now))
+	copy(hdr[40:48], ntpTimestamp(now))
+
+	switch s.mode.Load() {
+	case serveNAK, serveForgedNAK:
+		hdr[1] = 0
+		copy(hdr[12:16], "NTSN")
+	}
+
+	buf.Write(hdr)
+
+	switch s.mode.Load() {
+	case serveNAK:
+		buf.Write(uid)
+		return buf.Bytes(), nil
+	case serveForgedNAK:
+		ntsExtensionField(buf, ntsUniqueIdentifier, make([]byte, 32))
+		return buf.Bytes(), nil
+	case serveForged:
+		keys[1] = make([]byte, 32)
+	}
+
+	buf.Write(uid)
+
+	plaintext := &bytes.Buffer{}
+
+	for range placeholders + 1 {
+		ntsExtensionField(plaintext, ntsCookie, s.cookie(keys[0], keys[1]))
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+
+	ciphertext, err := sivSeal(keys[1], plaintext.Bytes(), buf.Bytes(), nonce)
+
+	if err != nil {
+		return
+	}
+
+	auth := &bytes.Buffer{}
+	binary.Write(auth, binary.BigEndian, uint16(len(nonce)))
+	binary.Write(auth, binary.BigEndian, uint16(len(ciphertext)))
+	auth.Write(nonce)
+	auth.Write(ciphertext)
+
+	ntsExtensionField(buf, ntsAuthenticator, auth.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	srv := newStandIn(t)
+
+	s, err := KeyExchange(srv.ke.Addr().String())
+
+	if err != nil {
+		t.Fatalf("key exchange error, %v", err)
+	}
+
+	if s.Port != srv.conn.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("negotiated port %d not honoured", s.Port)
+	}
+
+	if s.Cookies() != ntsMaxCookies {
+		t.Fatalf("got %d cookies, expected %d", s.Cookies(), ntsMaxCookies)
+	}
+
+	r, err := s.Query(s.Server)
+
+	if err != nil {
+		t.Fatalf("query error, %v", err)
+	}
+
+	if r.Stratum != 1 || r.ClockOffset.Abs() > time.Second {
+		t.Fatalf("unexpected response, stratum:%d offset:%v", r.Stratum, r.ClockOffset)
+	}
+
+	if s.Cookies() != ntsMaxCookies {
+		t.Fatalf("consumed cookie not replaced (%d)", s.Cookies())
+	}
+
+	// responses not authenticated with the S2C key are refused
+	srv.mode.Store(serveForged)
+
+	if _, err = s.Query(s.Server); err == nil {
+		t.Fatal("forged response accepted")
+	}
+
+	// a negative acknowledgment not carrying the request unique identifier
+	// is ignored
+	srv.mode.Store(serveForgedNAK)
+
+	if _, err = s.Query(s.Server); err == nil {
+		t.Fatal("forged NTS-NAK accepted")
+	}
+
+	if s.Cookies() == 0 {
+		t.Fatal("forged NTS-NAK discarded cookies")
+	}
+
+	// a genuine negative acknowledgment discards cookies, the next query
+	// performs a new key establishment
+	srv.mode.Store(serveNAK)
+
+	if _, err = s.Query(s.Server); err == nil {
+		t.Fatal("NTS-NAK not reported")
+	}
+
+	if s.Cookies() != 0 {
+		t.Fatalf("NTS-NAK retained %d cookies", s.Cookies())
+	}
+
+	srv.mode.Store(serveTime)
+
+	if _, err = s.Query(s.Server); err != nil {
+		t.Fatalf("query error after NTS-NAK, %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package nts
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+// cmacDouble implements the dbl() operation (RFC 5297 2.3.).
+func cmacDouble(b []byte) {
+	carry := b[0] >> 7
+
+	for i := 0; i < len(b)-1; i++ {
+		b[i] = b[i]<<1 | b[i+1]>>7
+	}
+
+	b[len(b)-1] = b[len(b)-1]<<1 ^ 0x87*carry
+}
+
+// cmac implements AES-CMAC (RFC 4493).
+func cmac(c cipher.Block, msg []byte) []byte {
+	k := make([]byte, aes.BlockSize)
+	c.Encrypt(k, k)
+	cmacDouble(k)
+
+	n := len(msg)
+	last := make([]byte, aes.BlockSize)
+
+	if n == 0 || n%aes.BlockSize != 0 {
+		cmacDouble(k)
+		r := n % aes.BlockSize
+		copy(last, msg[n-r:])
+		last[r] = 0x80
+		msg = msg[:n-r]
+	} else {
+		copy(last, msg[n-aes.BlockSize:])
+		msg = msg[:n-aes.BlockSize]
+	}
+
+	subtle.XORBytes(last, last, k)
+
+	x := make([]byte, aes.BlockSize)
+
+	for i := 0; i < len(msg); i += aes.BlockSize {
+		subtle.XORBytes(x, x, msg[i:i+aes.BlockSize])
+		c.Encrypt(x, x)
+	}
+
+	subtle.XORBytes(x, x, last)
+	c.Encrypt(x, x)
+
+	return x
+}
+
+// s2v implements the S2V operation (RFC 5297 2.4.).
+func s2v(c cipher.Block, ad [][]byte, plaintext []byte) []byte {
+	d := cmac(c, make([]byte, aes.BlockSize))
+
+	for _, s := range ad {
+		cmacDouble(d)
+		subtle.XORBytes(d, d, cmac(c, s))
+	}
+
+	var t []byte
+
+	if len(plaintext) >= aes.BlockSize {
+		t = bytes.Clone(plaintext)
+		n := len(t) - aes.BlockSize
+		subtle.XORBytes(t[n:], t[n:], d)
+	} else {
+		cmacDouble(d)
+		t = make([]byte, aes.BlockSize)
+		copy(t, plaintext)
+		t[len(plaintext)] = 0x80
+		subtle.XORBytes(t, t, d)
+	}
+
+	return cmac(c, t)
+}
+
+func sivCTR(key []byte, v []byte, in []byte) (out []byte, err error) {
+	c, err := aes.NewCipher(key)
+
+	if err != nil {
+		return
+	}
+
+	iv := bytes.Clone(v)
+	iv[8] &= 0x7f
+	iv[12] &= 0x7f
+
+	out = make([]byte, len(in))
+	cipher.NewCTR(c, iv).XORKeyStream(out, in)
+
+	return
+}
+
+// sivSeal implements AES-SIV encryption (RFC 5297) of the argument plaintext
+// with the argument associated data components, the key size selects the
+// AES variant (e.g. 32 bytes for AEAD_AES_SIV_CMAC_256).
+func sivSeal(key []byte, plaintext []byte, ad ...[]byte) (out []byte, err error) {
+	if len(key) != 32 && len(key) != 48 && len(key) != 64 {
+		return nil, errors.New("invalid key size")
+	}
+
+	c, err := aes.NewCipher(key[:len(key)/2])
+
+	if err != nil {
+		return
+	}
+
+	v := s2v(c, ad, plaintext)
+	ciphertext, err := sivCTR(key[len(key)/2:], v, plaintext)
+
+	return append(v, ciphertext...), err
+}
+
+// sivOpen implements AES-SIV decryption (RFC 5297) of the argument ciphertext
+// with the argument associated data components.
+func sivOpen(key []byte, ciphertext []byte, ad ...[]byte) (plaintext []byte, err error) {
+	if len(key) != 32 && len(key) != 48 && len(key) != 64 {
+		return nil, errors.New("invalid key size")
+	}
+
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errors.New("invalid ciphertext")
+	}
+
+	c, err := aes.NewCipher(key[:len(key)/2])
+
+	if err != nil {
+		return
+	}
+
+	v := ciphertext[:aes.BlockSize]
+
+	if plaintext, err = sivCTR(key[len(key)/2:], v, ciphertext[aes.BlockSize:]); err != nil {
+		return
+	}
+
+	if subtle.ConstantTimeCompare(v, s2v(c, ad, plaintext)) != 1 {
+		return nil, errors.New("authentication failed")
+	}
+
+	return
+}
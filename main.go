@@ -22,7 +22,7 @@ func main() {
 	log.SetFlags(0)
 
 	logFile, _ := os.OpenFile("/tamago-example.log", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	log.SetOutput(io.MultiWriter(os.Stdout, logFile))
+	log.SetOutput(io.MultiWriter(os.Stdout, logFile, network.Syslog, network.SessionLog))
 
 	name, _ := cmd.Target()
 
@@ -35,6 +35,9 @@ func main() {
 	}
 
 	if hasUSB, hasEth := cmd.HasNetwork(); hasUSB || hasEth {
+		network.Hostname = cmd.Hostname
+		network.UniqueID = cmd.UniqueID
+
 		if err := network.Init(console, hasUSB, hasEth, &cmd.NIC); err != nil {
 			log.Print(err)
 		}
@@ -0,0 +1,214 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// ACMECacheDir represents the filesystem directory for ACME account and
+// certificates storage, it is never served by the web servers.
+var ACMECacheDir = "/acme"
+
+var (
+	acmeMutex   sync.Mutex
+	acmeManager *autocert.Manager
+	acmeDomains []string
+	acmeURL     string
+)
+
+func init() {
+	// HTTP-01 challenge responses, served by the HTTP server
+	http.HandleFunc(acmeChallengePath, func(w http.ResponseWriter, r *http.Request) {
+		acmeMutex.Lock()
+		m := acmeManager
+		acmeMutex.Unlock()
+
+		if m == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		m.HTTPHandler(nil).ServeHTTP(w, r)
+	})
+}
+
+// acmeHello returns a ClientHelloInfo for the argument domain, meant to
+// trigger ECDSA certificate issuance, and renewal, ahead of client requests.
+func acmeHello(domain string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:        domain,
+		CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+	}
+}
+
+// StartACME enables certificate issuance, and automatic renewal, through the
+// argument ACME (RFC8555) directory URL for the argument domains, which are
+// validated through HTTP-01 (port 80) or TLS-ALPN-01 (port 443) challenges.
+//
+// The optional roots are used to authenticate the ACME server, in place of the
+// system ones (e.g. for a local Pebble instance).
+func StartACME(directory string, domains []string, roots *x509.CertPool) (err error) {
+	if len(domains) == 0 {
+		return errors.New("no domains")
+	}
+
+	client := &acme.Client{
+		DirectoryURL: directory,
+	}
+
+	if roots != nil {
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Client:     client,
+	}
+
+	acmeMutex.Lock()
+	acmeManager = m
+	acmeDomains = domains
+	acmeURL = directory
+	acmeMutex.Unlock()
+
+	// request certificates ahead of clients, which also schedules their
+	// renewal
+	for _, domain := range domains {
+		go func() {
+			if _, err := m.GetCertificate(acmeHello(domain)); err != nil {
+				log.Printf("acme: %s certificate request failed, %v", domain, err)
+				return
+			}
+
+			log.Printf("acme: %s certificate available", domain)
+		}()
+	}
+
+	return
+}
+
+// StopACME disables ACME certificates, previously issued certificates are
+// retained in ACMECacheDir.
+func StopACME() {
+	acmeMutex.Lock()
+	defer acmeMutex.Unlock()
+
+	acmeManager = nil
+	acmeDomains = nil
+	acmeURL = ""
+}
+
+// ACMEStatus returns the ACME directory, and its domains certificates status.
+func ACMEStatus() string {
+	var s strings.Builder
+
+	acmeMutex.Lock()
+	m, domains, directory := acmeManager, acmeDomains, acmeURL
+	acmeMutex.Unlock()
+
+	if m == nil {
+		return "ACME disabled"
+	}
+
+	fmt.Fprintf(&s, "ACME directory: %s", directory)
+
+	for _, domain := range domains {
+		var cert *tls.Certificate
+
+		// only stored certificates are looked up, to avoid new requests
+		if _, err := m.Cache.Get(context.Background(), domain); err == nil {
+			cert, _ = m.GetCertificate(acmeHello(domain))
+		}
+
+		if cert == nil || cert.Leaf == nil {
+			fmt.Fprintf(&s, "\n%s: pending", domain)
+			continue
+		}
+
+		fmt.Fprintf(&s, "\n%s: issued by %s, expires %s", domain,
+			cert.Leaf.Issuer.CommonName, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	return s.String()
+}
+
+// acmeCertificate returns a certificate source which serves ACME
+// certificates, and TLS-ALPN-01 challenges, when enabled for the requested
+// server name, falling back to the argument source otherwise.
+func acmeCertificate(fallback CertificateFunc) CertificateFunc {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		acmeMutex.Lock()
+		m, domains := acmeManager, acmeDomains
+		acmeMutex.Unlock()
+
+		if m == nil {
+			return fallback(hello)
+		}
+
+		if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			return m.GetCertificate(hello)
+		}
+
+		if !slices.Contains(domains, strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")) {
+			return fallback(hello)
+		}
+
+		cert, err := m.GetCertificate(hello)
+
+		if err != nil {
+			log.Printf("acme: %s certificate unavailable, %v", hello.ServerName, err)
+			return fallback(hello)
+		}
+
+		return cert, nil
+	}
+}
+
+// acmePrivate returns whether the argument path is within ACMECacheDir, which
+// holds private keys and must never be served.
+func acmePrivate(p string) bool {
+	p = path.Clean("/" + p)
+	dir := path.Clean("/" + ACMECacheDir)
+
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// PrivatePath returns whether the argument path is within a directory which
+// must never be served or modified by file transfer services: ACMECacheDir,
+// holding private keys, and the SSHAuthorizedKeysPath one, which controls SSH
+// access and privilege levels.
+func PrivatePath(p string) bool {
+	p = path.Clean("/" + p)
+	sshDir := path.Dir(path.Clean("/" + SSHAuthorizedKeysPath))
+
+	return acmePrivate(p) || p == sshDir || strings.HasPrefix(p, sshDir+"/")
+}
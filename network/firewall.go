@@ -0,0 +1,516 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maximum number of tracked connection sources per service
+const maxSources = 1024
+
+// FirewallRule represents an inbound connection filtering rule.
+type FirewallRule struct {
+	// Allow is the action taken on matching connections
+	Allow bool
+	// Network is the source address range, any source matches when nil.
+	Network *net.IPNet
+	// Interface is the receiving interface, any interface matches when
+	// empty.
+	Interface string
+}
+
+func (r *FirewallRule) match(ip net.IP, iface string) bool {
+	if r.Network != nil && !r.Network.Contains(ip) {
+		return false
+	}
+
+	return len(r.Interface) == 0 || r.Interface == iface
+}
+
+func (r *FirewallRule) String() string {
+	action := "deny"
+	src := "any"
+	iface := "any"
+
+	if r.Allow {
+		action = "allow"
+	}
+
+	if r.Network != nil {
+		src = r.Network.String()
+	}
+
+	if len(r.Interface) > 0 {
+		iface = r.Interface
+	}
+
+	return fmt.Sprintf("%s %s on %s", action, src, iface)
+}
+
+// FirewallPolicy represents the inbound connection policy of a service.
+type FirewallPolicy struct {
+	// Rules are evaluated in order, the first matching rule applies.
+	Rules []FirewallRule
+	// Deny is the action taken on connections matching no rule
+	Deny bool
+
+	// MaxConns is the maximum number of concurrent connections (0 for
+	// unlimited).
+	MaxConns int
+	// Rate is the maximum rate of connections per second from a single
+	// source (0 for unlimited), with bursts up to Burst connections. On
+	// datagram services, where sources cannot be trusted, it is the
+	// maximum rate of datagrams from all sources.
+	Rate  float64
+	Burst int
+	// BanTime is the time a source exceeding Rate is rejected
+	BanTime time.Duration
+}
+
+// DefaultFirewallPolicy is applied to services without a specific policy.
+var DefaultFirewallPolicy = FirewallPolicy{
+	MaxConns: 32,
+	Rate:     5,
+	Burst:    10,
+	BanTime:  1 * time.Minute,
+}
+
+var (
+	errBanned      = errors.New("banned")
+	errRateLimited = errors.New("rate exceeded")
+)
+
+type source struct {
+	limiter  *rate.Limiter
+	banned   time.Time
+	lastSeen time.Time
+}
+
+// firewall holds the policy and state of a service.
+type firewall struct {
+	sync.Mutex
+
+	policy  FirewallPolicy
+	conns   int
+	sources map[string]*source
+	packets *rate.Limiter
+
+	accepted uint64
+	rejected uint64
+}
+
+var (
+	firewallMutex sync.Mutex
+	firewalls     = make(map[string]*firewall)
+)
+
+func serviceFirewall(name string) *firewall {
+	firewallMutex.Lock()
+	defer firewallMutex.Unlock()
+
+	fw, ok := firewalls[name]
+
+	if !ok {
+		fw = &firewall{
+			policy:  DefaultFirewallPolicy,
+			sources: make(map[string]*source),
+		}
+
+		fw.policy.Rules = slices.Clone(DefaultFirewallPolicy.Rules)
+		firewalls[name] = fw
+	}
+
+	return fw
+}
+
+// purge removes stale sources and, when still at capacity, evicts the least
+// recently seen one, must be called with the firewall locked.
+func (fw *firewall) purge(now time.Time) {
+	if len(fw.sources) < maxSources {
+		return
+	}
+
+	var oldest string
+
+	for ip, src := range fw.sources {
+		if now.After(src.banned) && now.Sub(src.lastSeen) > fw.policy.BanTime {
+			delete(fw.sources, ip)
+			continue
+		}
+
+		if len(oldest) == 0 || src.lastSeen.Before(fw.sources[oldest].lastSeen) {
+			oldest = ip
+		}
+	}
+
+	if len(fw.sources) >= maxSources {
+		delete(fw.sources, oldest)
+	}
+}
+
+// count updates the accepted and rejected counters according to the argument
+// check result, must be called with the firewall locked.
+func (fw *firewall) count(err error) {
+	if err != nil {
+		fw.rejected += 1
+	} else {
+		fw.accepted += 1
+	}
+}
+
+// denied evaluates the policy rules against an inbound connection (or
+// datagram), must be called with the firewall locked.
+func (fw *firewall) denied(ip net.IP, iface string) bool {
+	for _, r := range fw.policy.Rules {
+		if r.match(ip, iface) {
+			return !r.Allow
+		}
+	}
+
+	return fw.policy.Deny
+}
+
+// check evaluates an inbound connection, on success the connection slot must
+// be released once closed.
+func (fw *firewall) check(ip net.IP, iface string) (err error) {
+	fw.Lock()
+	defer fw.Unlock()
+
+	defer func() { fw.count(err) }()
+
+	p := &fw.policy
+
+	if fw.denied(ip, iface) {
+		return errors.New("denied by rule")
+	}
+
+	if p.Rate > 0 {
+		now := time.Now()
+		key := ip.String()
+		src, ok := fw.sources[key]
+
+		if !ok {
+			fw.purge(now)
+			src = &source{limiter: rate.NewLimiter(rate.Limit(p.Rate), max(p.Burst, 1))}
+			fw.sources[key] = src
+		}
+
+		src.lastSeen = now
+
+		if now.Before(src.banned) {
+			// silently rejected to avoid flooding the log
+			return errBanned
+		}
+
+		if !src.limiter.AllowN(now, 1) {
+			src.banned = now.Add(p.BanTime)
+			return fmt.Errorf("rate exceeded, banned for %v", p.BanTime)
+		}
+	}
+
+	if p.MaxConns > 0 && fw.conns >= p.MaxConns {
+		return errors.New("too many connections")
+	}
+
+	fw.conns += 1
+
+	return
+}
+
+// checkPacket evaluates an inbound datagram, as its source address can be
+// spoofed the rate limit applies to all sources and no source is banned.
+func (fw *firewall) checkPacket(ip net.IP, iface string) (err error) {
+	fw.Lock()
+	defer fw.Unlock()
+
+	defer func() { fw.count(err) }()
+
+	p := &fw.policy
+
+	if fw.denied(ip, iface) {
+		return errors.New("denied by rule")
+	}
+
+	if p.Rate > 0 {
+		if fw.packets == nil {
+			fw.packets = rate.NewLimiter(rate.Limit(p.Rate), max(p.Burst, 1))
+		}
+
+		if !fw.packets.Allow() {
+			// silently rejected to avoid flooding the log
+			return errRateLimited
+		}
+	}
+
+	return
+}
+
+func (fw *firewall) release() {
+	fw.Lock()
+	defer fw.Unlock()
+
+	fw.conns -= 1
+}
+
+// firewallConn releases its firewall connection slot on Close.
+type firewallConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *firewallConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// firewallListener filters inbound connections according to the service
+// firewall policy.
+type firewallListener struct {
+	net.Listener
+
+	service string
+	iface   string
+	fw      *firewall
+}
+
+func lookupFirewall(service string) (fw *firewall, err error) {
+	if _, err = lookupService(service); err != nil {
+		return
+	}
+
+	return serviceFirewall(service), nil
+}
+
+func newFirewallListener(service string, iface string, l net.Listener) net.Listener {
+	return &firewallListener{
+		Listener: l,
+		service:  service,
+		iface:    iface,
+		fw:       serviceFirewall(service),
+	}
+}
+
+func (l *firewallListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+
+		if err != nil {
+			return nil, err
+		}
+
+		var ip net.IP
+
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = addr.IP
+		}
+
+		if err = l.fw.check(ip, l.iface); err != nil {
+			if err != errBanned {
+				log.Printf("firewall: %s rejected %s on %s, %v", l.service, conn.RemoteAddr(), l.iface, err)
+			}
+
+			conn.Close()
+			continue
+		}
+
+		return &firewallConn{Conn: conn, release: l.fw.release}, nil
+	}
+}
+
+// firewallPacketConn filters inbound datagrams according to the service
+// firewall policy, as datagrams are connectionless only rules and a service
+// wide rate limit apply.
+type firewallPacketConn struct {
+	net.PacketConn
+
+	service string
+	iface   string
+	fw      *firewall
+}
+
+func newFirewallPacketConn(service string, iface string, conn net.PacketConn) net.PacketConn {
+	return &firewallPacketConn{
+		PacketConn: conn,
+		service:    service,
+		iface:      iface,
+		fw:         serviceFirewall(service),
+	}
+}
+
+func (c *firewallPacketConn) ReadFrom(buf []byte) (n int, addr net.Addr, err error) {
+	for {
+		if n, addr, err = c.PacketConn.ReadFrom(buf); err != nil {
+			return
+		}
+
+		var ip net.IP
+
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			ip = udpAddr.IP
+		}
+
+		if err = c.fw.checkPacket(ip, c.iface); err != nil {
+			if err != errRateLimited {
+				log.Printf("firewall: %s rejected %s on %s, %v", c.service, addr, c.iface, err)
+			}
+
+			continue
+		}
+
+		return
+	}
+}
+
+// FirewallAddRule appends a rule to the policy of the named service.
+func FirewallAddRule(service string, r FirewallRule) (err error) {
+	fw, err := lookupFirewall(service)
+
+	if err != nil {
+		return
+	}
+
+	fw.Lock()
+	defer fw.Unlock()
+
+	fw.policy.Rules = append(fw.policy.Rules, r)
+
+	return
+}
+
+// FirewallDefault sets the action taken on connections to the named service
+// matching no rule.
+func FirewallDefault(service string, deny bool) (err error) {
+	fw, err := lookupFirewall(service)
+
+	if err != nil {
+		return
+	}
+
+	fw.Lock()
+	defer fw.Unlock()
+
+	fw.policy.Deny = deny
+
+	return
+}
+
+// FirewallLimit sets the connection limits of the named service.
+func FirewallLimit(service string, maxConns int, limit float64, burst int, banTime time.Duration) (err error) {
+	fw, err := lookupFirewall(service)
+
+	if err != nil {
+		return
+	}
+
+	fw.Lock()
+	defer fw.Unlock()
+
+	fw.policy.MaxConns = maxConns
+	fw.policy.Rate = limit
+	fw.policy.Burst = burst
+	fw.policy.BanTime = banTime
+
+	// reset limiters to apply the new rate
+	clear(fw.sources)
+	fw.packets = nil
+
+	return
+}
+
+// FirewallFlush removes all rules and bans of the named service.
+func FirewallFlush(service string) (err error) {
+	fw, err := lookupFirewall(service)
+
+	if err != nil {
+		return
+	}
+
+	fw.Lock()
+	defer fw.Unlock()
+
+	fw.policy.Rules = nil
+	fw.policy.Deny = false
+	clear(fw.sources)
+	fw.packets = nil
+
+	return
+}
+
+// Firewall returns the firewall policy and state of all services.
+func Firewall() string {
+	var buf bytes.Buffer
+	var names []string
+
+	serviceMutex.Lock()
+
+	for name := range daemons {
+		names = append(names, name)
+	}
+
+	serviceMutex.Unlock()
+
+	slices.Sort(names)
+
+	for _, name := range names {
+		var banned []string
+
+		fw := serviceFirewall(name)
+		fw.Lock()
+
+		p := fw.policy
+		now := time.Now()
+
+		for ip, src := range fw.sources {
+			if now.Before(src.banned) {
+				banned = append(banned, fmt.Sprintf("%s (%v)", ip, src.banned.Sub(now).Truncate(time.Second)))
+			}
+		}
+
+		fmt.Fprintf(&buf, "%s: connections %d/%d, accepted %d, rejected %d\n", name, fw.conns, p.MaxConns, fw.accepted, fw.rejected)
+
+		fw.Unlock()
+
+		w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+
+		for i, r := range p.Rules {
+			fmt.Fprintf(w, "  %d\t%s\n", i+1, &r)
+		}
+
+		action := "allow"
+
+		if p.Deny {
+			action = "deny"
+		}
+
+		fmt.Fprintf(w, "  *\t%s any on any\n", action)
+		w.Flush()
+
+		if p.Rate > 0 {
+			fmt.Fprintf(&buf, "  rate limit %.1f/s (burst %d), ban %v\n", p.Rate, p.Burst, p.BanTime)
+		}
+
+		if len(banned) > 0 {
+			slices.Sort(banned)
+			fmt.Fprintf(&buf, "  banned: %v\n", banned)
+		}
+	}
+
+	return buf.String()
+}
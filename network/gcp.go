@@ -49,7 +49,7 @@ func Init(console *shell.Interface, _ bool, _ bool, nic **vnet.Net) (err error)
 		return fmt.Errorf("could not initialize VirtIO device, %v", err)
 	}
 
-	iface, err := initStack(console, dev, true)
+	iface, err := initStack(console, dev, virtioMAC(dev), true)
 
 	if err != nil {
 		return fmt.Errorf("could not start network stack, %v", err)
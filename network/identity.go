@@ -0,0 +1,251 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// IdentityKey, when set, returns the device secret from which persistent TLS
+// and SSH host keys are deterministically derived, random keys are generated
+// on each boot otherwise.
+var IdentityKey func() (key []byte, source string, err error)
+
+// key derivation labels
+const (
+	identityCALabel   = "tamago-example TLS CA key"
+	identityTLSLabel  = "tamago-example TLS server key"
+	identitySSHLabel  = "tamago-example SSH host key"
+	identityCASubject = "TamaGo Example CA"
+)
+
+var (
+	identityOnce sync.Once
+	identityErr  error
+
+	identitySeed   []byte
+	identitySource string
+
+	identityCA    *x509.Certificate
+	identityCAKey *ecdsa.PrivateKey
+)
+
+// deriveBytes returns key material for the argument label, derived from the
+// identity seed.
+func deriveBytes(label string, n int) ([]byte, error) {
+	return hkdf.Key(sha256.New, identitySeed, nil, label, n)
+}
+
+// deriveECDSA returns a P-256 private key for the argument label, derived
+// from the identity seed.
+func deriveECDSA(label string) (key *ecdsa.PrivateKey, err error) {
+	// retry, on the unlikely event of a scalar out of range
+	for i := 0; i < 16; i++ {
+		buf, err := deriveBytes(fmt.Sprintf("%s %d", label, i), 32)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if key, err = ecdsa.ParseRawPrivateKey(elliptic.P256(), buf); err == nil {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("could not derive %s", label)
+}
+
+func loadIdentity() {
+	err := errors.New("no identity key available")
+
+	if IdentityKey != nil {
+		identitySeed, identitySource, err = IdentityKey()
+	}
+
+	if err != nil {
+		log.Printf("identity: using ephemeral keys, %v", err)
+
+		identitySeed = make([]byte, 32)
+		identitySource = "ephemeral"
+		rand.Read(identitySeed)
+	}
+
+	if identityCAKey, err = deriveECDSA(identityCALabel); err != nil {
+		identityErr = err
+		return
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&identityCAKey.PublicKey)
+
+	if err != nil {
+		identityErr = err
+		return
+	}
+
+	// the CA serial number is bound to its key
+	h := sha256.Sum256(pub)
+	serial := new(big.Int).SetBytes(h[:16])
+
+	validFrom, _ := time.Parse(time.RFC3339, "1981-01-07T00:00:00Z")
+	validUntil, _ := time.Parse(time.RFC3339, "2031-01-07T00:00:00Z")
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization:       []string{"TamaGo Example"},
+			OrganizationalUnit: []string{"TamaGo test certificates"},
+			CommonName:         fmt.Sprintf("%s %s", identityCASubject, Hostname()),
+		},
+		SignatureAlgorithm:    x509.ECDSAWithSHA256,
+		NotBefore:             validFrom,
+		NotAfter:              validUntil,
+		SubjectKeyId:          h[:20],
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+
+	// a nil random source selects deterministic (RFC 6979) signatures, so
+	// that the CA certificate is identical across boots
+	der, err := x509.CreateCertificate(nil, template, template, &identityCAKey.PublicKey, identityCAKey)
+
+	if err != nil {
+		identityErr = err
+		return
+	}
+
+	if identityCA, err = x509.ParseCertificate(der); err != nil {
+		identityErr = err
+		return
+	}
+
+	log.Printf("identity: %s keys, CA SHA-256 fingerprint: % X", identitySource, sha256.Sum256(der))
+}
+
+func identity() error {
+	identityOnce.Do(loadIdentity)
+	return identityErr
+}
+
+// IdentitySource returns the source of the device identity keys.
+func IdentitySource() (string, error) {
+	if err := identity(); err != nil {
+		return "", err
+	}
+
+	return identitySource, nil
+}
+
+// IdentityCA returns the device local certificate authority, which issues
+// the TLS server certificates.
+func IdentityCA() (*x509.Certificate, error) {
+	if err := identity(); err != nil {
+		return nil, err
+	}
+
+	return identityCA, nil
+}
+
+// IdentityCAPEM returns the device local certificate authority in PEM format.
+func IdentityCAPEM() ([]byte, error) {
+	ca, err := IdentityCA()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), nil
+}
+
+// SSHHostKey returns the device SSH host key.
+func SSHHostKey() (ssh.Signer, error) {
+	if err := identity(); err != nil {
+		return nil, err
+	}
+
+	seed, err := deriveBytes(identitySSHLabel, ed25519.SeedSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(seed))
+}
+
+// TLSCertificate returns a TLS server certificate for the argument address,
+// issued by the device local certificate authority.
+func TLSCertificate(address net.IP) (cert tls.Certificate, err error) {
+	if err = identity(); err != nil {
+		return
+	}
+
+	key, err := deriveECDSA(identityTLSLabel)
+
+	if err != nil {
+		return
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<63-1))
+
+	if err != nil {
+		return
+	}
+
+	name := Hostname()
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization:       []string{"TamaGo Example"},
+			OrganizationalUnit: []string{"TamaGo test certificates"},
+			CommonName:         name,
+		},
+		DNSNames:           []string{name, name + ".local"},
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+		NotBefore:          identityCA.NotBefore,
+		NotAfter:           identityCA.NotAfter,
+		KeyUsage:           x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if address != nil {
+		template.IPAddresses = []net.IP{address}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, identityCA, &key.PublicKey, identityCAKey)
+
+	if err != nil {
+		return
+	}
+
+	log.Printf("identity: TLS certificate IP: %s, Serial: %X, SHA-256 fingerprint: % X", address, serial, sha256.Sum256(der))
+
+	cert = tls.Certificate{
+		Certificate: [][]byte{der, identityCA.Raw},
+		PrivateKey:  key,
+	}
+
+	return
+}
@@ -8,6 +8,8 @@
 package network
 
 import (
+	"fmt"
+	"log"
 	"net"
 
 	"github.com/usbarmory/tamago/soc/nxp/usb"
@@ -16,24 +18,71 @@ import (
 	"github.com/usbarmory/go-net/imx-usb"
 )
 
-const HostMAC = "1a:55:89:a2:69:42"
+// HostMAC, when set, overrides the derived Ethernet over USB host MAC address.
+var HostMAC = ""
 
 func handleUSBInterrupt(usb *usb.USB) {
 	usb.ServiceInterrupts()
 }
 
-func initEthernetOverUSB(port *usb.USB, stack gnet.Stack) (err error) {
+// tapStack wraps a network stack to inspect frames received from the ECM
+// endpoint, see tapTransmit for transmitted ones.
+type tapStack struct {
+	gnet.Stack
+}
+
+func (s *tapStack) RecvInboundPacket(buf []byte) {
+	tap(usbName, buf, false)
+	s.Stack.RecvInboundPacket(buf)
+}
+
+// tapTransmit wraps the ECM bulk IN endpoint functions to inspect frames
+// transmitted to the host.
+func tapTransmit(device *usb.Device) {
+	for _, conf := range device.Configurations {
+		for _, iface := range conf.Interfaces {
+			for _, ep := range iface.Endpoints {
+				// skip all but bulk IN endpoints (e.g. notifications)
+				if ep.Function == nil || ep.Direction() != usb.IN || ep.Attributes&0b11 != 2 {
+					continue
+				}
+
+				fn := ep.Function
+
+				ep.Function = func(buf []byte, lastErr error) (res []byte, err error) {
+					if res, err = fn(buf, lastErr); err == nil && len(res) > 0 {
+						tap(usbName, res, true)
+					}
+
+					return
+				}
+			}
+		}
+	}
+}
+
+func initEthernetOverUSB(port *usb.USB, stack gnet.Stack, mac net.HardwareAddr) (err error) {
 	ecm := &usbnet.ECM{
-		Stack: stack,
+		Stack: &tapStack{stack},
 	}
 
-	ecm.HostMAC, _ = net.ParseMAC(HostMAC)
-	ecm.DeviceMAC, _ = net.ParseMAC(MAC)
+	ecm.HostMAC = deriveMAC(usbName + "-host")
+	ecm.DeviceMAC = mac
+
+	if len(HostMAC) > 0 {
+		if ecm.HostMAC, err = net.ParseMAC(HostMAC); err != nil {
+			return fmt.Errorf("invalid host MAC address, %v", err)
+		}
+	}
+
+	log.Printf("%s host MAC address %s", usbName, ecm.HostMAC)
 
 	if err = ecm.Init(); err != nil {
 		return
 	}
 
+	tapTransmit(ecm.Device)
+
 	port.Device = ecm.Device
 	port.Init()
 	port.DeviceMode()
@@ -12,6 +12,7 @@ import (
 	"log"
 	"net"
 	"runtime/goos"
+	"time"
 
 	"github.com/usbarmory/tamago-example/shell"
 	"github.com/usbarmory/tamago/arm"
@@ -24,10 +25,13 @@ import (
 
 func handleEthernetInterrupt(eth *enet.ENET, iface *gnet.Interface, buf []byte) {
 	for {
-		if n, err := eth.Receive(buf); err != nil || n == 0 {
+		n, err := eth.Receive(buf)
+
+		if err != nil || n == 0 {
 			return
 		}
 
+		tap(ethName, buf[:n], false)
 		iface.Stack.RecvInboundPacket(buf)
 		eth.ClearInterrupt(enet.IRQ_RXF)
 	}
@@ -49,6 +53,8 @@ func startInterruptHandler(usb *usb.USB, eth *enet.ENET, iface *gnet.Interface)
 	}
 
 	isr := func() {
+		defer accountISR(time.Now())
+
 		irq := imx6ul.GIC.GetInterrupt(true)
 
 		switch {
@@ -69,6 +75,8 @@ func startInterruptHandler(usb *usb.USB, eth *enet.ENET, iface *gnet.Interface)
 			return
 		}
 
+		defer accountIdle(time.Now())
+
 		imx6ul.ARM.SetAlarm(pollUntil)
 		imx6ul.ARM.WaitInterrupt()
 	}
@@ -80,23 +88,29 @@ func Init(console *shell.Interface, hasUSB bool, hasEth bool, nic **enet.ENET) (
 	var usb *usb.USB
 	var eth *enet.ENET
 	var iface *gnet.Interface
+	var mac net.HardwareAddr
 
 	if hasUSB {
 		usb = imx6ul.USB1
 
-		if iface, err = initStack(console, nil, !hasEth); err != nil {
+		if mac, err = deviceMAC(usbName); err != nil {
+			return fmt.Errorf("invalid MAC address, %v", err)
+		}
+
+		if iface, err = initStack(console, nil, mac, !hasEth); err != nil {
 			return fmt.Errorf("could not start network stack, %v", err)
 		}
 
-		if err = initEthernetOverUSB(usb, iface.Stack); err != nil {
+		if err = initEthernetOverUSB(usb, iface.Stack, mac); err != nil {
 			return fmt.Errorf("could not initialize Ethernet over USB, %v", err)
 		}
 
 		// With both USB and Ethernet available each port gets its own
 		// separate stack, Go runtime network is kept on the latter.
 		if hasEth {
-			l, _ := iface.Stack.(*gnet.GVisorStack).ListenerTCP4(22)
-			StartSSHServer(l, console)
+			if err = startSSHService("ssh-"+usbName, usbName, console); err != nil {
+				return fmt.Errorf("could not start SSH server, %v", err)
+			}
 		}
 	}
 
@@ -107,14 +121,18 @@ func Init(console *shell.Interface, hasUSB bool, hasEth bool, nic **enet.ENET) (
 			eth = imx6ul.ENET1
 		}
 
+		if mac, err = deviceMAC(ethName); err != nil {
+			return fmt.Errorf("invalid MAC address, %v", err)
+		}
+
 		*nic = eth
-		eth.MAC, _ = net.ParseMAC(MAC)
+		eth.MAC = mac
 
 		if err = eth.Init(); err != nil {
 			return fmt.Errorf("could not initialize Ethernet, %v", err)
 		}
 
-		if iface, err = initStack(console, eth, true); err != nil {
+		if iface, err = initStack(console, eth, mac, true); err != nil {
 			return fmt.Errorf("could not start network stack, %v", err)
 		}
 
@@ -10,8 +10,8 @@ package network
 import (
 	"fmt"
 	"log"
-	"net"
 	"runtime/goos"
+	"time"
 
 	"github.com/usbarmory/tamago/arm64"
 	"github.com/usbarmory/tamago/soc/nxp/enet"
@@ -23,10 +23,13 @@ import (
 
 func handleEthernetInterrupt(eth *enet.ENET, iface *gnet.Interface, buf []byte) {
 	for {
-		if n, err := eth.Receive(buf); err != nil || n == 0 {
+		n, err := eth.Receive(buf)
+
+		if err != nil || n == 0 {
 			return
 		}
 
+		tap(ethName, buf[:n], false)
 		iface.Stack.RecvInboundPacket(buf)
 		eth.ClearInterrupt(enet.IRQ_RXF)
 	}
@@ -44,6 +47,8 @@ func startInterruptHandler(eth *enet.ENET, iface *gnet.Interface) {
 	}
 
 	isr := func() {
+		defer accountISR(time.Now())
+
 		irq := imx8mp.GIC.GetInterrupt()
 
 		switch {
@@ -62,6 +67,8 @@ func startInterruptHandler(eth *enet.ENET, iface *gnet.Interface) {
 			return
 		}
 
+		defer accountIdle(time.Now())
+
 		imx8mp.ARM64.SetAlarm(pollUntil)
 		imx8mp.ARM64.WaitInterrupt()
 	}
@@ -73,8 +80,14 @@ func Init(console *shell.Interface, _ bool, _ bool, nic **enet.ENET) (err error)
 	var eth *enet.ENET
 	var iface *gnet.Interface
 
+	mac, err := deviceMAC(ethName)
+
+	if err != nil {
+		return fmt.Errorf("invalid MAC address, %v", err)
+	}
+
 	eth = imx8mp.ENET1
-	eth.MAC, _ = net.ParseMAC(MAC)
+	eth.MAC = mac
 
 	*nic = eth
 
@@ -82,7 +95,7 @@ func Init(console *shell.Interface, _ bool, _ bool, nic **enet.ENET) (err error)
 		return fmt.Errorf("could not initialize network device, %v", err)
 	}
 
-	if iface, err = initStack(console, eth, true); err != nil {
+	if iface, err = initStack(console, eth, mac, true); err != nil {
 		return fmt.Errorf("could not start network stack, %v", err)
 	}
 
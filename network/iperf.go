@@ -0,0 +1,1084 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// iperf3 protocol constants
+const (
+	IperfPort = 5201
+
+	iperfCookieSize = 37
+	iperfMaxJSON    = 64 * 1024
+	iperfMaxStreams = 32
+	iperfMaxLen     = 1 << 20
+
+	// maximum UDP payload size
+	iperfMaxDatagram = 65507
+
+	// UDP datagram header (timestamp and sequence number)
+	iperfUDPHeaderSize   = 12
+	iperfUDPHeaderSize64 = 16
+)
+
+// iperf3 control connection states
+const (
+	iperfTestStart       = 1
+	iperfTestRunning     = 2
+	iperfTestEnd         = 4
+	iperfParamExchange   = 9
+	iperfCreateStreams   = 10
+	iperfServerTerminate = 11
+	iperfClientTerminate = 12
+	iperfExchangeResults = 13
+	iperfDisplayResults  = 14
+	iperfDone            = 16
+	iperfAccessDenied    = 0xff // -1
+	iperfServerError     = 0xfe // -2
+)
+
+var (
+	// iperf3 UDP stream connection handshake
+	iperfUDPConnect       = []byte("9876")
+	iperfUDPConnectLegacy = []byte{0x15, 0xcd, 0x5b, 0x07}
+	iperfUDPReply         = []byte("6789")
+)
+
+// IperfTimeout represents the maximum time to wait for iperf3 control
+// messages and stream setup.
+var IperfTimeout = 10 * time.Second
+
+// IperfOptions represents iperf3 client test parameters.
+type IperfOptions struct {
+	// UDP selects UDP streams instead of TCP ones
+	UDP bool
+	// Reverse selects server to client transfers
+	Reverse bool
+	// Parallel is the number of streams
+	Parallel int
+	// Time is the test duration
+	Time time.Duration
+	// Bandwidth is the target bitrate per stream in bits/sec (0 for
+	// unlimited)
+	Bandwidth uint64
+	// Length is the size of each write (or datagram for UDP)
+	Length int
+}
+
+type iperfParams struct {
+	TCP           bool   `json:"tcp,omitempty"`
+	UDP           bool   `json:"udp,omitempty"`
+	Omit          int    `json:"omit"`
+	Time          int    `json:"time"`
+	Num           uint64 `json:"num,omitempty"`
+	Parallel      int    `json:"parallel"`
+	Reverse       bool   `json:"reverse,omitempty"`
+	Bidirectional bool   `json:"bidirectional,omitempty"`
+	Len           int    `json:"len"`
+	Bandwidth     uint64 `json:"bandwidth,omitempty"`
+	Counters64    int    `json:"udp_counters_64bit,omitempty"`
+	ClientVersion string `json:"client_version,omitempty"`
+}
+
+func (p *iperfParams) validate() error {
+	switch {
+	case p.TCP == p.UDP:
+		return errors.New("unsupported protocol")
+	case p.Bidirectional:
+		return errors.New("bidirectional mode not supported")
+	case p.Parallel < 1 || p.Parallel > iperfMaxStreams:
+		return fmt.Errorf("invalid number of streams (max %d)", iperfMaxStreams)
+	case p.UDP && (p.Len < iperfUDPHeaderSize64 || p.Len > iperfMaxDatagram):
+		return errors.New("invalid datagram length")
+	case p.Len < 1 || p.Len > iperfMaxLen:
+		return errors.New("invalid length")
+	}
+
+	return nil
+}
+
+type iperfStreamResult struct {
+	ID          int     `json:"id"`
+	Bytes       uint64  `json:"bytes"`
+	Retransmits int64   `json:"retransmits"`
+	Jitter      float64 `json:"jitter"`
+	Errors      int64   `json:"errors"`
+	Packets     int64   `json:"packets"`
+	StartTime   float64 `json:"start_time"`
+	EndTime     float64 `json:"end_time"`
+}
+
+type iperfResults struct {
+	CPUUtilTotal         float64             `json:"cpu_util_total"`
+	CPUUtilUser          float64             `json:"cpu_util_user"`
+	CPUUtilSystem        float64             `json:"cpu_util_system"`
+	SenderHasRetransmits int                 `json:"sender_has_retransmits"`
+	Streams              []iperfStreamResult `json:"streams"`
+}
+
+func (r *iperfResults) sum() (n uint64, duration float64) {
+	for _, st := range r.Streams {
+		n += st.Bytes
+		duration = max(duration, st.EndTime-st.StartTime)
+	}
+
+	return
+}
+
+func (r *iperfResults) loss() (jitter float64, lost int64, total int64) {
+	for _, st := range r.Streams {
+		jitter += st.Jitter
+		lost += st.Errors
+		total += st.Packets
+	}
+
+	if len(r.Streams) > 0 {
+		jitter /= float64(len(r.Streams))
+	}
+
+	return
+}
+
+// iperfStream represents an iperf3 data stream.
+type iperfStream struct {
+	id int
+
+	// TCP or connected UDP socket
+	conn net.Conn
+	// shared UDP socket and peer (server UDP streams)
+	pc   net.PacketConn
+	peer net.Addr
+
+	bytes atomic.Uint64
+
+	// packets sent, or highest sequence number received, over UDP
+	packets    int64
+	received   int64
+	errors     int64
+	outOfOrder int64
+	jitter     float64
+	transit    float64
+
+	start time.Time
+	end   time.Time
+}
+
+// iperfStreamID returns the iperf3 stream identifier, which skips 2 for
+// historical reasons.
+func iperfStreamID(i int) int {
+	if i == 0 {
+		return 1
+	}
+
+	return i + 2
+}
+
+func (st *iperfStream) write(buf []byte) (int, error) {
+	if st.peer != nil {
+		return st.pc.WriteTo(buf, st.peer)
+	}
+
+	return st.conn.Write(buf)
+}
+
+// receive accounts a UDP datagram, computing loss and jitter as in RFC 1889.
+func (st *iperfStream) receive(pkt []byte, now time.Time, counters64 bool) {
+	var seq int64
+
+	st.bytes.Add(uint64(len(pkt)))
+
+	if len(pkt) < iperfUDPHeaderSize {
+		return
+	}
+
+	sec := binary.BigEndian.Uint32(pkt[0:4])
+	usec := binary.BigEndian.Uint32(pkt[4:8])
+
+	if counters64 && len(pkt) >= iperfUDPHeaderSize64 {
+		seq = int64(binary.BigEndian.Uint64(pkt[8:16]))
+	} else {
+		seq = int64(binary.BigEndian.Uint32(pkt[8:12]))
+	}
+
+	if seq > st.packets {
+		st.errors += seq - st.packets - 1
+		st.packets = seq
+	} else {
+		st.outOfOrder += 1
+
+		if st.errors > 0 {
+			st.errors -= 1
+		}
+	}
+
+	sent := float64(sec) + float64(usec)/1e6
+	transit := float64(now.UnixNano())/1e9 - sent
+
+	if st.received > 0 {
+		st.jitter += (math.Abs(transit-st.transit) - st.jitter) / 16
+	}
+
+	st.transit = transit
+	st.received += 1
+}
+
+func (st *iperfStream) send(ctx context.Context, p *iperfParams) {
+	buf := make([]byte, p.Len)
+	start := time.Now()
+
+	for ctx.Err() == nil {
+		if p.UDP {
+			now := time.Now()
+			st.packets += 1
+
+			binary.BigEndian.PutUint32(buf[0:4], uint32(now.Unix()))
+			binary.BigEndian.PutUint32(buf[4:8], uint32(now.Nanosecond()/1000))
+
+			if p.Counters64 != 0 {
+				binary.BigEndian.PutUint64(buf[8:16], uint64(st.packets))
+			} else {
+				binary.BigEndian.PutUint32(buf[8:12], uint32(st.packets))
+			}
+		}
+
+		n, err := st.write(buf)
+
+		if err != nil {
+			return
+		}
+
+		total := st.bytes.Add(uint64(n))
+
+		if p.Num > 0 && total >= p.Num {
+			return
+		}
+
+		if p.Bandwidth > 0 {
+			due := start.Add(time.Duration(float64(total*8) / float64(p.Bandwidth) * float64(time.Second)))
+
+			if d := time.Until(due); d > 0 {
+				time.Sleep(d)
+			}
+		}
+	}
+}
+
+func (st *iperfStream) recv(p *iperfParams) {
+	buf := make([]byte, max(p.Len, iperfMaxDatagram))
+
+	for {
+		n, err := st.conn.Read(buf)
+
+		if p.UDP && n > 0 {
+			st.receive(buf[:n], time.Now(), p.Counters64 != 0)
+		} else {
+			st.bytes.Add(uint64(n))
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (st *iperfStream) result(start time.Time, sender bool) iperfStreamResult {
+	r := iperfStreamResult{
+		ID:          st.id,
+		Bytes:       st.bytes.Load(),
+		Retransmits: -1,
+		Packets:     st.packets,
+		StartTime:   st.start.Sub(start).Seconds(),
+		EndTime:     st.end.Sub(start).Seconds(),
+	}
+
+	if !sender {
+		r.Jitter = st.jitter
+		r.Errors = st.errors
+	}
+
+	return r
+}
+
+// iperfTest represents an iperf3 test session.
+type iperfTest struct {
+	params iperfParams
+	cookie []byte
+	ctl    net.Conn
+
+	streams []*iperfStream
+	// server UDP socket
+	udp *gonet.UDPConn
+	// server TCP data connections
+	accept chan net.Conn
+
+	start    time.Time
+	end      time.Time
+	cpuStart cpuSample
+	cpuEnd   cpuSample
+}
+
+func (t *iperfTest) close() {
+	for _, st := range t.streams {
+		if st.conn != nil {
+			st.conn.Close()
+		}
+	}
+
+	if t.udp != nil {
+		t.udp.Close()
+	}
+
+	t.ctl.Close()
+}
+
+func writeState(conn net.Conn, state byte) (err error) {
+	_, err = conn.Write([]byte{state})
+	return
+}
+
+func readState(conn net.Conn) (state byte, err error) {
+	buf := make([]byte, 1)
+
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return
+	}
+
+	return buf[0], nil
+}
+
+func expectState(conn net.Conn, expected byte) (err error) {
+	state, err := readState(conn)
+
+	switch {
+	case err != nil:
+		return
+	case state == iperfAccessDenied:
+		return errors.New("server busy")
+	case state == iperfServerError, state == iperfServerTerminate:
+		return errors.New("server error")
+	case state != expected:
+		return fmt.Errorf("unexpected state %d", state)
+	}
+
+	return
+}
+
+func writeJSON(conn net.Conn, v any) (err error) {
+	buf, err := json.Marshal(v)
+
+	if err != nil {
+		return
+	}
+
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(buf)))
+	_, err = conn.Write(append(msg, buf...))
+
+	return
+}
+
+func readJSON(conn net.Conn, v any) (err error) {
+	var size uint32
+
+	if err = binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return
+	}
+
+	if size > iperfMaxJSON {
+		return errors.New("invalid JSON length")
+	}
+
+	buf := make([]byte, size)
+
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return
+	}
+
+	return json.Unmarshal(buf, v)
+}
+
+// transfer runs all data streams until the argument context is canceled.
+func (t *iperfTest) transfer(ctx context.Context, sender bool, wg *sync.WaitGroup) {
+	t.start = time.Now()
+	t.cpuStart = sampleCPU()
+
+	// unblock pending reads and writes on test end
+	context.AfterFunc(ctx, func() {
+		now := time.Now()
+
+		for _, st := range t.streams {
+			if st.conn != nil {
+				st.conn.SetDeadline(now)
+			}
+		}
+
+		if t.udp != nil {
+			t.udp.SetDeadline(now)
+		}
+	})
+
+	for _, st := range t.streams {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			st.start = time.Now()
+
+			switch {
+			case sender:
+				st.send(ctx, &t.params)
+			case st.conn != nil:
+				st.recv(&t.params)
+			default:
+				<-ctx.Done()
+			}
+
+			st.end = time.Now()
+		}()
+	}
+
+	if !sender && t.udp != nil {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			t.demux()
+		}()
+	}
+}
+
+func (t *iperfTest) finish() {
+	t.end = time.Now()
+	t.cpuEnd = sampleCPU()
+}
+
+// demux dispatches datagrams received on the server UDP socket to their
+// streams.
+func (t *iperfTest) demux() {
+	buf := make([]byte, iperfMaxDatagram)
+	streams := make(map[string]*iperfStream)
+
+	for _, st := range t.streams {
+		streams[st.peer.String()] = st
+	}
+
+	for {
+		n, addr, err := t.udp.ReadFrom(buf)
+
+		if err != nil {
+			return
+		}
+
+		if st, ok := streams[addr.String()]; ok {
+			st.receive(buf[:n], time.Now(), t.params.Counters64 != 0)
+		}
+	}
+}
+
+func (t *iperfTest) bytes() (n uint64) {
+	for _, st := range t.streams {
+		n += st.bytes.Load()
+	}
+
+	return
+}
+
+func (t *iperfTest) results(sender bool) *iperfResults {
+	total, isr := t.cpuEnd.utilization(t.cpuStart)
+
+	// ISR time is reported as system time
+	r := &iperfResults{
+		CPUUtilTotal:  total,
+		CPUUtilUser:   max(total-isr, 0),
+		CPUUtilSystem: isr,
+	}
+
+	for _, st := range t.streams {
+		r.Streams = append(r.Streams, st.result(t.start, sender))
+	}
+
+	return r
+}
+
+func (t *iperfTest) isr() string {
+	return fmt.Sprintf("ISR %v in %d IRQs", t.cpuEnd.isr-t.cpuStart.isr, t.cpuEnd.irqs-t.cpuStart.irqs)
+}
+
+func (t *iperfTest) acceptTCP() (err error) {
+	timeout := time.After(IperfTimeout)
+
+	for i := range t.params.Parallel {
+		select {
+		case conn := <-t.accept:
+			t.streams = append(t.streams, &iperfStream{id: iperfStreamID(i), conn: conn})
+		case <-timeout:
+			return errors.New("stream setup timeout")
+		}
+	}
+
+	return
+}
+
+func (t *iperfTest) acceptUDP() (err error) {
+	buf := make([]byte, iperfMaxDatagram)
+	peers := make(map[string]bool)
+
+	t.udp.SetReadDeadline(time.Now().Add(IperfTimeout))
+	defer t.udp.SetReadDeadline(time.Time{})
+
+	for len(t.streams) < t.params.Parallel {
+		n, addr, err := t.udp.ReadFrom(buf)
+
+		if err != nil {
+			return err
+		}
+
+		msg := buf[:n]
+
+		if !bytes.Equal(msg, iperfUDPConnect) && !bytes.Equal(msg, iperfUDPConnectLegacy) {
+			continue
+		}
+
+		if _, err = t.udp.WriteTo(iperfUDPReply, addr); err != nil {
+			return err
+		}
+
+		if peers[addr.String()] {
+			continue
+		}
+
+		peers[addr.String()] = true
+
+		t.streams = append(t.streams, &iperfStream{
+			id:   iperfStreamID(len(t.streams)),
+			pc:   t.udp,
+			peer: addr,
+		})
+	}
+
+	return
+}
+
+// serve runs an iperf3 test as server on its control connection.
+func (t *iperfTest) serve(ctx context.Context, s *stack.Stack, nicID tcpip.NICID, port uint16) (err error) {
+	var wg sync.WaitGroup
+	var remote iperfResults
+
+	ctl := t.ctl
+	stop := context.AfterFunc(ctx, func() { ctl.Close() })
+	defer stop()
+
+	ctl.SetDeadline(time.Now().Add(IperfTimeout))
+
+	if err = writeState(ctl, iperfParamExchange); err != nil {
+		return
+	}
+
+	if err = readJSON(ctl, &t.params); err != nil {
+		return fmt.Errorf("invalid parameters, %v", err)
+	}
+
+	if err = t.params.validate(); err != nil {
+		return
+	}
+
+	if t.params.UDP {
+		laddr := &tcpip.FullAddress{NIC: nicID, Port: port}
+
+		if t.udp, err = gonet.DialUDP(s, laddr, nil, ipv4.ProtocolNumber); err != nil {
+			return
+		}
+	}
+
+	if err = writeState(ctl, iperfCreateStreams); err != nil {
+		return
+	}
+
+	if t.params.UDP {
+		err = t.acceptUDP()
+	} else {
+		err = t.acceptTCP()
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not create streams, %v", err)
+	}
+
+	if err = writeState(ctl, iperfTestStart); err != nil {
+		return
+	}
+
+	if err = writeState(ctl, iperfTestRunning); err != nil {
+		return
+	}
+
+	ctl.SetDeadline(time.Time{})
+
+	tctx, cancel := context.WithCancel(ctx)
+	t.transfer(tctx, t.params.Reverse, &wg)
+
+	// the client signals the end of the test
+	state, err := readState(ctl)
+
+	cancel()
+	wg.Wait()
+	t.finish()
+
+	switch {
+	case err != nil:
+		return
+	case state == iperfClientTerminate:
+		return errors.New("client terminated")
+	case state != iperfTestEnd:
+		return fmt.Errorf("unexpected state %d", state)
+	}
+
+	ctl.SetDeadline(time.Now().Add(IperfTimeout))
+
+	if err = writeState(ctl, iperfExchangeResults); err != nil {
+		return
+	}
+
+	if err = readJSON(ctl, &remote); err != nil {
+		return fmt.Errorf("invalid results, %v", err)
+	}
+
+	if err = writeJSON(ctl, t.results(t.params.Reverse)); err != nil {
+		return
+	}
+
+	if err = writeState(ctl, iperfDisplayResults); err != nil {
+		return
+	}
+
+	// the client might close the connection without acknowledgment
+	readState(ctl)
+
+	return
+}
+
+// iperfServer represents the iperf3 server, running one test at a time.
+type iperfServer struct {
+	sync.Mutex
+
+	iface string
+	port  uint16
+	test  *iperfTest
+}
+
+func (srv *iperfServer) handle(ctx context.Context, conn net.Conn) {
+	cookie := make([]byte, iperfCookieSize)
+
+	conn.SetReadDeadline(time.Now().Add(IperfTimeout))
+
+	if _, err := io.ReadFull(conn, cookie); err != nil {
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	srv.Lock()
+	t := srv.test
+
+	switch {
+	case t != nil && bytes.Equal(cookie, t.cookie):
+		srv.Unlock()
+
+		select {
+		case t.accept <- conn:
+		default:
+			conn.Close()
+		}
+
+		return
+	case t != nil:
+		srv.Unlock()
+
+		writeState(conn, iperfAccessDenied)
+		conn.Close()
+
+		return
+	}
+
+	t = &iperfTest{
+		cookie: cookie,
+		ctl:    conn,
+		accept: make(chan net.Conn, iperfMaxStreams),
+	}
+
+	srv.test = t
+	srv.Unlock()
+
+	defer func() {
+		srv.Lock()
+		srv.test = nil
+		srv.Unlock()
+
+		t.close()
+
+		// discard streams connected after setup
+		for len(t.accept) > 0 {
+			(<-t.accept).Close()
+		}
+	}()
+
+	s, nicID, err := gvisor(Interfaces[srv.iface])
+
+	if err == nil {
+		err = t.serve(ctx, s, nicID, srv.port)
+	}
+
+	if err != nil {
+		log.Printf("iperf3: test from %s failed, %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	proto := "TCP"
+	mode := "receiver"
+
+	if t.params.UDP {
+		proto = "UDP"
+	}
+
+	if t.params.Reverse {
+		mode = "sender"
+	}
+
+	duration := t.end.Sub(t.start)
+	total := t.bytes()
+	cpu, isr := t.cpuEnd.utilization(t.cpuStart)
+
+	log.Printf("iperf3: %s %s %s x%d, %d bytes in %v (%s), CPU %.1f%% (ISR %.1f%%), %s",
+		conn.RemoteAddr(), proto, mode, len(t.streams), total, duration.Truncate(time.Millisecond),
+		strings.TrimSpace(formatBitrate(float64(total)*8/duration.Seconds())), cpu, isr, t.isr())
+}
+
+func serveIperf(ctx context.Context, l net.Listener) error {
+	srv := &iperfServer{
+		iface: serviceInterface(ctx),
+		port:  IperfPort,
+	}
+
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		srv.port = uint16(addr.Port)
+	}
+
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		go srv.handle(ctx, conn)
+	}
+}
+
+func formatBytes(n float64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%6.2f GBytes", n/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%6.2f MBytes", n/(1<<20))
+	default:
+		return fmt.Sprintf("%6.2f KBytes", n/(1<<10))
+	}
+}
+
+func formatBitrate(bps float64) string {
+	switch {
+	case math.IsNaN(bps) || math.IsInf(bps, 0):
+		return "     - bits/sec"
+	case bps >= 1e9:
+		return fmt.Sprintf("%6.2f Gbits/sec", bps/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%6.2f Mbits/sec", bps/1e6)
+	default:
+		return fmt.Sprintf("%6.2f Kbits/sec", bps/1e3)
+	}
+}
+
+func iperfCookie() []byte {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+
+	cookie := make([]byte, iperfCookieSize)
+	rand.Read(cookie)
+
+	for i := range cookie {
+		cookie[i] = alphabet[int(cookie[i])%len(alphabet)]
+	}
+
+	// NUL terminated
+	cookie[iperfCookieSize-1] = 0
+
+	return cookie
+}
+
+func (t *iperfTest) connect(ctx context.Context, s *stack.Stack, addr tcpip.FullAddress, i int) (err error) {
+	st := &iperfStream{id: iperfStreamID(i)}
+
+	if !t.params.UDP {
+		if st.conn, err = gonet.DialContextTCP(ctx, s, addr, ipv4.ProtocolNumber); err != nil {
+			return
+		}
+
+		t.streams = append(t.streams, st)
+		_, err = st.conn.Write(t.cookie)
+
+		return
+	}
+
+	if st.conn, err = gonet.DialUDP(s, nil, &addr, ipv4.ProtocolNumber); err != nil {
+		return
+	}
+
+	t.streams = append(t.streams, st)
+	buf := make([]byte, len(iperfUDPReply))
+
+	st.conn.SetReadDeadline(time.Now().Add(IperfTimeout))
+	defer st.conn.SetReadDeadline(time.Time{})
+
+	if _, err = st.conn.Write(iperfUDPConnect); err != nil {
+		return
+	}
+
+	if _, err = io.ReadFull(st.conn, buf); err != nil {
+		return
+	}
+
+	if !bytes.Equal(buf, iperfUDPReply) {
+		return errors.New("invalid UDP connect reply")
+	}
+
+	return
+}
+
+// report prints interval throughput reports until the argument context is
+// canceled.
+func (t *iperfTest) report(ctx context.Context, w io.Writer) {
+	var prev uint64
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	last := t.start
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n := t.bytes()
+			d := now.Sub(last)
+
+			fmt.Fprintf(w, "[SUM] %6.2f-%-6.2f sec  %s  %s\n",
+				last.Sub(t.start).Seconds(), now.Sub(t.start).Seconds(),
+				formatBytes(float64(n-prev)), formatBitrate(float64(n-prev)*8/d.Seconds()))
+
+			prev = n
+			last = now
+		}
+	}
+}
+
+func (t *iperfTest) summary(w io.Writer, local *iperfResults, remote *iperfResults) {
+	sender, receiver := local, remote
+	senderSide, receiverSide := "local", "remote"
+
+	if t.params.Reverse {
+		sender, receiver = remote, local
+		senderSide, receiverSide = "remote", "local"
+	}
+
+	fmt.Fprintln(w, "- - - - - - - - - - - - - - - - - - - - - - - - -")
+
+	for _, r := range []struct {
+		res  *iperfResults
+		name string
+	}{
+		{sender, "sender"},
+		{receiver, "receiver"},
+	} {
+		n, duration := r.res.sum()
+
+		if duration <= 0 {
+			duration = t.end.Sub(t.start).Seconds()
+		}
+
+		fmt.Fprintf(w, "[SUM] %6.2f-%-6.2f sec  %s  %s", 0.0, duration, formatBytes(float64(n)), formatBitrate(float64(n)*8/duration))
+
+		if t.params.UDP && r.res == receiver {
+			jitter, lost, total := r.res.loss()
+			fmt.Fprintf(w, "  %.3f ms  %d/%d (%.2g%%)", jitter*1000, lost, total, 100*float64(lost)/float64(max(total, 1)))
+		}
+
+		fmt.Fprintf(w, "  %s\n", r.name)
+	}
+
+	fmt.Fprintf(w, "CPU utilization: %s/sender %.1f%% (%.1f%%u/%.1f%%s), %s/receiver %.1f%% (%.1f%%u/%.1f%%s)\n",
+		senderSide, sender.CPUUtilTotal, sender.CPUUtilUser, sender.CPUUtilSystem,
+		receiverSide, receiver.CPUUtilTotal, receiver.CPUUtilUser, receiver.CPUUtilSystem)
+	fmt.Fprintf(w, "Local %s\n", t.isr())
+}
+
+// Iperf runs an iperf3 client test against the argument server, printing
+// results, including local ISR CPU time, on the argument writer.
+func Iperf(w io.Writer, server net.IP, opts IperfOptions) (err error) {
+	var wg sync.WaitGroup
+	var remote iperfResults
+
+	name, err := lookupInterface()
+
+	if err != nil {
+		return
+	}
+
+	s, _, err := gvisor(Interfaces[name])
+
+	if err != nil {
+		return
+	}
+
+	t := &iperfTest{
+		cookie: iperfCookie(),
+		params: iperfParams{
+			TCP:       !opts.UDP,
+			UDP:       opts.UDP,
+			Time:      int(opts.Time.Seconds()),
+			Parallel:  opts.Parallel,
+			Reverse:   opts.Reverse,
+			Len:       opts.Length,
+			Bandwidth: opts.Bandwidth,
+		},
+	}
+
+	if err = t.params.validate(); err != nil {
+		return
+	}
+
+	addr := tcpip.FullAddress{
+		Addr: tcpip.AddrFromSlice(server.To4()),
+		Port: IperfPort,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), IperfTimeout)
+	defer cancel()
+
+	if t.ctl, err = gonet.DialContextTCP(ctx, s, addr, ipv4.ProtocolNumber); err != nil {
+		return
+	}
+
+	defer t.close()
+
+	ctl := t.ctl
+	ctl.SetDeadline(time.Now().Add(IperfTimeout))
+
+	if _, err = ctl.Write(t.cookie); err != nil {
+		return
+	}
+
+	if err = expectState(ctl, iperfParamExchange); err != nil {
+		return
+	}
+
+	if err = writeJSON(ctl, &t.params); err != nil {
+		return
+	}
+
+	if err = expectState(ctl, iperfCreateStreams); err != nil {
+		return
+	}
+
+	for i := range t.params.Parallel {
+		if err = t.connect(ctx, s, addr, i); err != nil {
+			return fmt.Errorf("could not create stream, %v", err)
+		}
+	}
+
+	if err = expectState(ctl, iperfTestStart); err != nil {
+		return
+	}
+
+	if err = expectState(ctl, iperfTestRunning); err != nil {
+		return
+	}
+
+	ctl.SetDeadline(time.Time{})
+
+	fmt.Fprintf(w, "Connected to %s port %d, %d stream(s)\n", server, IperfPort, len(t.streams))
+
+	tctx, stop := context.WithTimeout(context.Background(), opts.Time)
+	defer stop()
+
+	t.transfer(tctx, !t.params.Reverse, &wg)
+	t.report(tctx, w)
+
+	wg.Wait()
+	t.finish()
+
+	ctl.SetDeadline(time.Now().Add(IperfTimeout))
+
+	if err = writeState(ctl, iperfTestEnd); err != nil {
+		return
+	}
+
+	if err = expectState(ctl, iperfExchangeResults); err != nil {
+		return
+	}
+
+	local := t.results(!t.params.Reverse)
+
+	if err = writeJSON(ctl, local); err != nil {
+		return
+	}
+
+	if err = readJSON(ctl, &remote); err != nil {
+		return fmt.Errorf("invalid results, %v", err)
+	}
+
+	if err = expectState(ctl, iperfDisplayResults); err != nil {
+		return
+	}
+
+	if err = writeState(ctl, iperfDone); err != nil {
+		return
+	}
+
+	t.summary(w, local, &remote)
+
+	return
+}
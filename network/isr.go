@@ -0,0 +1,62 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// CPU time accounting of interrupt service routines and idle periods, used to
+// estimate CPU utilization during throughput measurements.
+var (
+	isrTime  atomic.Int64
+	isrCount atomic.Uint64
+	idleTime atomic.Int64
+)
+
+func accountISR(start time.Time) {
+	isrTime.Add(int64(time.Since(start)))
+	isrCount.Add(1)
+}
+
+func accountIdle(start time.Time) {
+	idleTime.Add(int64(time.Since(start)))
+}
+
+type cpuSample struct {
+	ts   time.Time
+	isr  time.Duration
+	idle time.Duration
+	irqs uint64
+}
+
+func sampleCPU() cpuSample {
+	return cpuSample{
+		ts:   time.Now(),
+		isr:  time.Duration(isrTime.Load()),
+		idle: time.Duration(idleTime.Load()),
+		irqs: isrCount.Load(),
+	}
+}
+
+// utilization returns the CPU utilization percentage, overall and within
+// interrupt service routines, since the argument sample.
+func (s cpuSample) utilization(prev cpuSample) (total float64, isr float64) {
+	wall := s.ts.Sub(prev.ts)
+
+	if wall <= 0 {
+		return
+	}
+
+	idle := s.idle - prev.idle
+	total = 100 * float64(wall-idle) / float64(wall)
+	isr = 100 * float64(s.isr-prev.isr) / float64(wall)
+
+	return max(total, 0), isr
+}
@@ -0,0 +1,277 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+
+	"github.com/usbarmory/go-net"
+)
+
+const (
+	mdnsPort = 5353
+	mdnsTTL  = 120
+
+	// p17, 10.2. Announcements to Flush Outdated Cache Entries, RFC6762
+	cacheFlush = 1 << 15
+	// 5.4. Questions Requesting Unicast Responses, RFC6762
+	unicastResponse = 1 << 15
+	// 11. Source Address Check, RFC6762
+	mdnsIPTTL = 255
+	// p15, 6.7. Legacy Unicast Responses, RFC6762
+	legacyTTL = 10
+
+	// p11, 9. Service Type Enumeration, RFC6763
+	serviceTypes = "_services._dns-sd._udp.local."
+)
+
+var mdnsGroup = [4]byte{224, 0, 0, 251}
+
+var (
+	mdnsMutex    sync.Mutex
+	mdnsServices = make(map[string]uint16)
+)
+
+// Advertise registers a DNS-SD service type (e.g. "_ssh._tcp") and its port
+// for announcement by the mDNS responders.
+func Advertise(service string, port uint16) {
+	mdnsMutex.Lock()
+	defer mdnsMutex.Unlock()
+
+	mdnsServices[service] = port
+}
+
+// Withdraw removes a DNS-SD service type from the mDNS responders.
+func Withdraw(service string) {
+	mdnsMutex.Lock()
+	defer mdnsMutex.Unlock()
+
+	delete(mdnsServices, service)
+}
+
+func services() map[string]uint16 {
+	mdnsMutex.Lock()
+	defer mdnsMutex.Unlock()
+
+	return maps.Clone(mdnsServices)
+}
+
+func hostRecord(host dnsmessage.Name, ip [4]byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: host, Class: dnsmessage.ClassINET | cacheFlush, TTL: mdnsTTL},
+		Body:   &dnsmessage.AResource{A: ip},
+	}
+}
+
+func srvRecord(host dnsmessage.Name, instance dnsmessage.Name, port uint16) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: instance, Class: dnsmessage.ClassINET | cacheFlush, TTL: mdnsTTL},
+		Body:   &dnsmessage.SRVResource{Target: host, Port: port},
+	}
+}
+
+func txtRecord(instance dnsmessage.Name) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: instance, Class: dnsmessage.ClassINET | cacheFlush, TTL: mdnsTTL},
+		Body:   &dnsmessage.TXTResource{TXT: []string{""}},
+	}
+}
+
+func ptrRecord(name dnsmessage.Name, ptr dnsmessage.Name) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: mdnsTTL},
+		Body:   &dnsmessage.PTRResource{PTR: ptr},
+	}
+}
+
+func answer(hostname string, ip [4]byte, q dnsmessage.Question) (answers []dnsmessage.Resource, extra []dnsmessage.Resource) {
+	host := dnsmessage.MustNewName(hostname + ".local.")
+	name := strings.ToLower(q.Name.String())
+	all := q.Type == dnsmessage.TypeALL
+
+	if name == strings.ToLower(host.String()) {
+		if q.Type == dnsmessage.TypeA || all {
+			answers = append(answers, hostRecord(host, ip))
+		}
+
+		return
+	}
+
+	for service, port := range services() {
+		serviceName := dnsmessage.MustNewName(service + ".local.")
+		instance := dnsmessage.MustNewName(hostname + "." + service + ".local.")
+
+		switch name {
+		case serviceTypes:
+			if q.Type == dnsmessage.TypePTR || all {
+				answers = append(answers, ptrRecord(q.Name, serviceName))
+			}
+		case strings.ToLower(serviceName.String()):
+			if q.Type == dnsmessage.TypePTR || all {
+				answers = append(answers, ptrRecord(serviceName, instance))
+				extra = append(extra, srvRecord(host, instance, port), txtRecord(instance), hostRecord(host, ip))
+			}
+		case strings.ToLower(instance.String()):
+			if q.Type == dnsmessage.TypeSRV || all {
+				answers = append(answers, srvRecord(host, instance, port))
+				extra = append(extra, hostRecord(host, ip))
+			}
+
+			if q.Type == dnsmessage.TypeTXT || all {
+				answers = append(answers, txtRecord(instance))
+			}
+		}
+	}
+
+	return
+}
+
+// legacyRecords adapts records for legacy unicast responses, which must not
+// set the cache-flush bit (p15, 6.7. Legacy Unicast Responses, RFC6762).
+func legacyRecords(records []dnsmessage.Resource) {
+	for i := range records {
+		records[i].Header.Class &^= cacheFlush
+		records[i].Header.TTL = min(records[i].Header.TTL, legacyTTL)
+	}
+}
+
+func handleQuery(conn *gonet.UDPConn, hostname string, ip [4]byte, buf []byte, addr *net.UDPAddr) (err error) {
+	var query dnsmessage.Message
+	var res dnsmessage.Message
+
+	if err = query.Unpack(buf); err != nil || query.Header.Response {
+		return
+	}
+
+	// unicast responses are sent only when requested for all questions
+	unicast := len(query.Questions) > 0
+
+	for _, q := range query.Questions {
+		unicast = unicast && q.Class&unicastResponse != 0
+		answers, extra := answer(hostname, ip, q)
+		res.Answers = append(res.Answers, answers...)
+		res.Additionals = append(res.Additionals, extra...)
+	}
+
+	if len(res.Answers) == 0 {
+		return
+	}
+
+	res.Header = dnsmessage.Header{Response: true, Authoritative: true}
+	dst := &net.UDPAddr{IP: net.IP(mdnsGroup[:]), Port: mdnsPort}
+
+	switch {
+	case addr.Port != mdnsPort:
+		// p15, 6.7. Legacy Unicast Responses, RFC6762
+		res.Header.ID = query.Header.ID
+		res.Questions = query.Questions
+		legacyRecords(res.Answers)
+		legacyRecords(res.Additionals)
+		dst = addr
+	case unicast:
+		dst = addr
+	}
+
+	if buf, err = res.Pack(); err != nil {
+		return
+	}
+
+	_, err = conn.WriteTo(buf, dst)
+
+	return
+}
+
+func serveMDNS(conn *gonet.UDPConn, hostname string, ip [4]byte) {
+	buf := make([]byte, gnet.MTU)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+
+		if err != nil {
+			log.Printf("mDNS responder error, %v", err)
+			return
+		}
+
+		if err = handleQuery(conn, hostname, ip, buf[:n], addr.(*net.UDPAddr)); err != nil {
+			log.Printf("mDNS query error, %v", err)
+		}
+	}
+}
+
+// StartMDNS starts a multicast DNS (RFC6762) responder on the argument
+// interface, answering queries for the device host name and for all DNS-SD
+// (RFC6763) services registered with Advertise.
+func StartMDNS(iface *gnet.Interface) (err error) {
+	var ip [4]byte
+
+	s, nicID, err := gvisor(iface)
+
+	if err != nil {
+		return
+	}
+
+	if addr := net.ParseIP(IP).To4(); addr != nil {
+		copy(ip[:], addr)
+	} else {
+		return errors.New("invalid IP address")
+	}
+
+	if err := s.JoinGroup(ipv4.ProtocolNumber, nicID, tcpip.AddrFrom4(mdnsGroup)); err != nil {
+		return fmt.Errorf("could not join multicast group, %v", err)
+	}
+
+	laddr := &tcpip.FullAddress{
+		NIC:  nicID,
+		Port: mdnsPort,
+	}
+
+	var wq waiter.Queue
+
+	ep, tcpipErr := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+
+	if tcpipErr != nil {
+		return errors.New(tcpipErr.String())
+	}
+
+	// responses, multicast or unicast, are sent with IP TTL 255 as receivers
+	// discard those with a lower one
+	for _, opt := range []tcpip.SockOptInt{tcpip.MulticastTTLOption, tcpip.IPv4TTLOption} {
+		if tcpipErr = ep.SetSockOptInt(opt, mdnsIPTTL); tcpipErr != nil {
+			ep.Close()
+			return errors.New(tcpipErr.String())
+		}
+	}
+
+	if tcpipErr = ep.Bind(*laddr); tcpipErr != nil {
+		ep.Close()
+		return fmt.Errorf("could not bind, %s", tcpipErr)
+	}
+
+	conn := gonet.NewUDPConn(&wq, ep)
+
+	hostname := Hostname()
+	log.Printf("starting mDNS responder (%s.local) on NIC %d", hostname, nicID)
+
+	go serveMDNS(conn, hostname, ip)
+
+	return
+}
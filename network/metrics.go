@@ -0,0 +1,209 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"runtime/metrics"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/usbarmory/tamago/dma"
+
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Metrics represents a writer of metrics in Prometheus text exposition
+// format.
+type Metrics struct {
+	w    io.Writer
+	last string
+}
+
+var (
+	collectorsMutex sync.Mutex
+	collectors      []func(m *Metrics)
+)
+
+// RegisterMetrics adds a metrics collector to the /metrics endpoint.
+func RegisterMetrics(fn func(m *Metrics)) {
+	collectorsMutex.Lock()
+	defer collectorsMutex.Unlock()
+
+	collectors = append(collectors, fn)
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func (m *Metrics) write(typ string, name string, help string, value float64, labels []string) {
+	// samples of the same metric are expected to be written contiguously
+	if name != m.last {
+		fmt.Fprintf(m.w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+		fmt.Fprintf(m.w, "# TYPE %s %s\n", name, typ)
+		m.last = name
+	}
+
+	fmt.Fprint(m.w, name)
+
+	if len(labels) > 1 {
+		var l []string
+
+		for i := 0; i+1 < len(labels); i += 2 {
+			l = append(l, fmt.Sprintf(`%s="%s"`, labels[i], escapeLabel(labels[i+1])))
+		}
+
+		fmt.Fprintf(m.w, "{%s}", strings.Join(l, ","))
+	}
+
+	fmt.Fprintf(m.w, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// Gauge writes a gauge sample, labels are passed as name and value pairs.
+func (m *Metrics) Gauge(name string, help string, value float64, labels ...string) {
+	m.write("gauge", name, help, value, labels)
+}
+
+// Counter writes a counter sample, labels are passed as name and value pairs.
+func (m *Metrics) Counter(name string, help string, value float64, labels ...string) {
+	m.write("counter", name, help, value, labels)
+}
+
+// metricName converts a runtime/metrics name (e.g. /gc/heap/allocs:bytes) to
+// a Prometheus one (e.g. go_gc_heap_allocs_bytes).
+func metricName(name string) string {
+	return "go" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+
+		return '_'
+	}, name)
+}
+
+func runtimeMetrics(m *Metrics) {
+	var samples []metrics.Sample
+
+	desc := metrics.All()
+
+	for _, d := range desc {
+		samples = append(samples, metrics.Sample{Name: d.Name})
+	}
+
+	metrics.Read(samples)
+
+	for i, s := range samples {
+		var value float64
+
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			value = float64(s.Value.Uint64())
+		case metrics.KindFloat64:
+			value = s.Value.Float64()
+		default:
+			// histograms are not exported
+			continue
+		}
+
+		if desc[i].Cumulative {
+			m.Counter(metricName(s.Name), desc[i].Description, value)
+		} else {
+			m.Gauge(metricName(s.Name), desc[i].Description, value)
+		}
+	}
+}
+
+func dmaMetrics(m *Metrics) {
+	r := dma.Default()
+
+	if r == nil {
+		return
+	}
+
+	sum := func(blocks map[uint]uint) (t uint) {
+		for _, n := range blocks {
+			t += n
+		}
+
+		return
+	}
+
+	m.Gauge("tamago_dma_bytes", "Default DMA region allocation.", float64(sum(r.FreeBlocks())), "state", "free")
+	m.Gauge("tamago_dma_bytes", "Default DMA region allocation.", float64(sum(r.UsedBlocks())), "state", "used")
+}
+
+func nicMetrics(m *Metrics) {
+	var names []string
+
+	values := make(map[string][]counter)
+
+	for _, name := range slices.Sorted(maps.Keys(Interfaces)) {
+		if s, nicID, err := gvisor(Interfaces[name]); err == nil {
+			names = append(names, name)
+			values[name] = nicCounters(s, nicID)
+		}
+	}
+
+	if len(names) == 0 {
+		return
+	}
+
+	// group samples by metric rather than by interface
+	for i, c := range values[names[0]] {
+		name := "tamago_nic_" + strings.ReplaceAll(strings.ToLower(c.name), " ", "_") + "_total"
+
+		for _, iface := range names {
+			m.Counter(name, "Network interface "+c.name+".", float64(values[iface][i].value), "interface", iface)
+		}
+	}
+}
+
+func shellMetrics(m *Metrics) {
+	m.Gauge("tamago_ssh_sessions", "Active SSH connections.", float64(sshSessions.Load()))
+
+	calls := shell.Calls()
+
+	for _, name := range slices.Sorted(maps.Keys(calls)) {
+		m.Counter("tamago_shell_commands_total", "Shell command invocations.", float64(calls[name]), "command", name)
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	m := &Metrics{w: bw}
+
+	runtimeMetrics(m)
+	dmaMetrics(m)
+	nicMetrics(m)
+	shellMetrics(m)
+
+	collectorsMutex.Lock()
+	defer collectorsMutex.Unlock()
+
+	for _, fn := range collectors {
+		fn(m)
+	}
+}
+
+func init() {
+	http.HandleFunc("/metrics", metricsHandler)
+}
@@ -0,0 +1,241 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+type counter struct {
+	name  string
+	value uint64
+}
+
+var (
+	stackErrMutex sync.Mutex
+	stackErrors   = make(map[string]map[string]uint64)
+)
+
+func countStackErr(iface string, err error, tx bool) {
+	stackErrMutex.Lock()
+	defer stackErrMutex.Unlock()
+
+	if stackErrors[iface] == nil {
+		stackErrors[iface] = make(map[string]uint64)
+	}
+
+	dir := "rx"
+
+	if tx {
+		dir = "tx"
+	}
+
+	stackErrors[iface][fmt.Sprintf("%s: %v", dir, err)] += 1
+}
+
+func stackErrCounters(iface string) (c []counter) {
+	stackErrMutex.Lock()
+	defer stackErrMutex.Unlock()
+
+	for name, n := range stackErrors[iface] {
+		c = append(c, counter{name, n})
+	}
+
+	slices.SortFunc(c, func(a, b counter) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	return
+}
+
+func nicCounters(s *stack.Stack, nicID tcpip.NICID) []counter {
+	nic := s.NICInfo()[nicID].Stats
+	st := s.Stats()
+
+	return []counter{
+		{"RX packets", nic.Rx.Packets.Value()},
+		{"RX bytes", nic.Rx.Bytes.Value()},
+		{"RX errors", nic.MalformedL4RcvdPackets.Value() + st.IP.MalformedPacketsReceived.Value()},
+		{"RX dropped", nic.DisabledRx.Packets.Value() + st.DroppedPackets.Value()},
+		{"TX packets", nic.Tx.Packets.Value()},
+		{"TX bytes", nic.Tx.Bytes.Value()},
+		{"TX errors", st.IP.OutgoingPacketErrors.Value()},
+		{"TX dropped", nic.TxPacketsDroppedNoBufferSpace.Value()},
+	}
+}
+
+func protocolCounters(s *stack.Stack) []counter {
+	st := s.Stats()
+
+	return []counter{
+		{"IP packets received", st.IP.PacketsReceived.Value()},
+		{"IP packets delivered", st.IP.PacketsDelivered.Value()},
+		{"IP packets sent", st.IP.PacketsSent.Value()},
+		{"IP invalid destination", st.IP.InvalidDestinationAddressesReceived.Value()},
+		{"ICMP echo requests received", st.ICMP.V4.PacketsReceived.EchoRequest.Value()},
+		{"ICMP echo replies sent", st.ICMP.V4.PacketsSent.EchoReply.Value()},
+		{"TCP active openings", st.TCP.ActiveConnectionOpenings.Value()},
+		{"TCP passive openings", st.TCP.PassiveConnectionOpenings.Value()},
+		{"TCP established", st.TCP.CurrentEstablished.Value()},
+		{"TCP failed attempts", st.TCP.FailedConnectionAttempts.Value()},
+		{"TCP segments received", st.TCP.ValidSegmentsReceived.Value()},
+		{"TCP segments sent", st.TCP.SegmentsSent.Value()},
+		{"TCP retransmits", st.TCP.Retransmits.Value()},
+		{"TCP timeouts", st.TCP.Timeouts.Value()},
+		{"TCP resets sent", st.TCP.ResetsSent.Value()},
+		{"TCP resets received", st.TCP.ResetsReceived.Value()},
+		{"TCP checksum errors", st.TCP.ChecksumErrors.Value()},
+		{"UDP packets received", st.UDP.PacketsReceived.Value()},
+		{"UDP packets sent", st.UDP.PacketsSent.Value()},
+		{"UDP unknown port errors", st.UDP.UnknownPortErrors.Value()},
+		{"UDP receive buffer errors", st.UDP.ReceiveBufferErrors.Value()},
+		{"UDP checksum errors", st.UDP.ChecksumErrors.Value()},
+	}
+}
+
+func counters(name string) (c []counter) {
+	s, nicID, err := gvisor(Interfaces[name])
+
+	if err != nil {
+		return
+	}
+
+	c = append(c, nicCounters(s, nicID)...)
+	c = append(c, protocolCounters(s)...)
+	c = append(c, stackErrCounters(name)...)
+
+	return
+}
+
+func formatAddress(addr tcpip.Address, port uint16) string {
+	host := "*"
+	p := "*"
+
+	if addr.Len() > 0 && !addr.Unspecified() {
+		host = addr.String()
+	}
+
+	if port != 0 {
+		p = strconv.Itoa(int(port))
+	}
+
+	return net.JoinHostPort(host, p)
+}
+
+func endpoints(w *tabwriter.Writer, s *stack.Stack) {
+	for _, te := range s.RegisteredEndpoints() {
+		var proto string
+		var state string
+
+		ep, ok := te.(tcpip.Endpoint)
+
+		if !ok {
+			continue
+		}
+
+		info, ok := ep.Info().(*stack.TransportEndpointInfo)
+
+		if !ok {
+			continue
+		}
+
+		switch info.TransProto {
+		case tcp.ProtocolNumber:
+			proto = "tcp"
+			state = tcp.EndpointState(ep.State()).String()
+		case udp.ProtocolNumber:
+			proto = "udp"
+			state = transport.DatagramEndpointState(ep.State()).String()
+		default:
+			proto = strconv.Itoa(int(info.TransProto))
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", proto,
+			formatAddress(info.ID.LocalAddress, info.ID.LocalPort),
+			formatAddress(info.ID.RemoteAddress, info.ID.RemotePort),
+			state)
+	}
+}
+
+// Netstat returns the TCP/UDP endpoints and the interface, protocol and error
+// statistics of all network interfaces.
+//
+// A non-zero interval samples all statistics twice and reports their
+// differences over the interval.
+func Netstat(interval time.Duration) string {
+	var res bytes.Buffer
+	var names []string
+
+	for name := range Interfaces {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	prev := make(map[string]uint64)
+
+	if interval > 0 {
+		for _, name := range names {
+			for _, c := range counters(name) {
+				prev[name+c.name] = c.value
+			}
+		}
+
+		time.Sleep(interval)
+	}
+
+	for _, name := range names {
+		s, _, err := gvisor(Interfaces[name])
+
+		if err != nil {
+			fmt.Fprintf(&res, "%s: %v\n", name, err)
+			continue
+		}
+
+		fmt.Fprintf(&res, "%s\n\n", name)
+
+		w := tabwriter.NewWriter(&res, 0, 8, 2, ' ', 0)
+
+		if interval == 0 {
+			fmt.Fprintf(w, "Proto\tLocal Address\tForeign Address\tState\n")
+			endpoints(w, s)
+			w.Flush()
+			fmt.Fprintln(&res)
+		}
+
+		for _, c := range counters(name) {
+			if interval == 0 {
+				fmt.Fprintf(w, "%s\t%d\n", c.name, c.value)
+				continue
+			}
+
+			delta := c.value - prev[name+c.name]
+
+			fmt.Fprintf(w, "%s\t%d\t(+%d, %.1f/s)\n", c.name, c.value, delta, float64(delta)/interval.Seconds())
+		}
+
+		w.Flush()
+		fmt.Fprintln(&res)
+	}
+
+	return res.String()
+}
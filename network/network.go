@@ -8,6 +8,8 @@
 package network
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -15,6 +17,9 @@ import (
 	// maintained set of TLS roots for any potential TLS client requests
 	_ "golang.org/x/crypto/x509roots/fallback"
 
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
 	"github.com/usbarmory/go-net"
 	"github.com/usbarmory/tamago-example/shell"
 )
@@ -26,8 +31,14 @@ import (
 // For more advanced use cases gVisor supports sharing a single stack across
 // different NIC IDs and routing while this example simply clones interface
 // configuration and stack.
+//
+// Each interface MAC address is derived from the device unique ID, unless
+// overridden with MAC.
+//
+// The Resolver is either a plain DNS address or an encrypted resolver URI,
+// see SetResolver.
 var (
-	MAC      = "1a:55:89:a2:69:41"
+	MAC      = ""
 	Netmask  = "255.255.255.0"
 	CIDR     = "/24"
 	IP       = "10.0.0.1"
@@ -35,58 +46,174 @@ var (
 	Resolver = "8.8.8.8:53"
 )
 
+// interface names
+const (
+	ethName = "eth0"
+	usbName = "usb0"
+)
+
+// Interfaces holds all initialized network interfaces, indexed by name.
+var Interfaces = make(map[string]*gnet.Interface)
+
+// name of the interface hooked into the Go runtime
+var defaultInterface string
+
+// UniqueID returns the device unique identifier, used to derive stable MAC
+// addresses.
+var UniqueID func() []byte
+
+// deriveMAC returns a locally administered unicast MAC address, derived from
+// the device unique ID and the argument label to ensure uniqueness across
+// devices and interfaces.
+func deriveMAC(label string) (mac net.HardwareAddr) {
+	var id []byte
+
+	if UniqueID != nil {
+		id = UniqueID()
+	}
+
+	if len(id) == 0 {
+		log.Printf("no unique ID available, %s MAC address is not unique", label)
+	}
+
+	h := sha256.New()
+	h.Write([]byte("tamago-example/" + label + "/"))
+	h.Write(id)
+
+	mac = h.Sum(nil)[:6]
+	mac[0] = mac[0]&0xfc | 0x02
+
+	return
+}
+
+// deviceMAC returns the MAC address of the named interface, either set by the
+// MAC override or derived from the device unique ID.
+func deviceMAC(name string) (mac net.HardwareAddr, err error) {
+	if len(MAC) > 0 {
+		return net.ParseMAC(MAC)
+	}
+
+	return deriveMAC(name), nil
+}
+
+// Hostname returns the device host name, advertised by network services such
+// as the mDNS responder.
+var Hostname = func() string {
+	return "tamago"
+}
+
+// gvisor returns the gVisor stack, and its NIC identifier, backing the
+// argument interface.
+func gvisor(iface *gnet.Interface) (s *stack.Stack, nicID tcpip.NICID, err error) {
+	gs, ok := iface.Stack.(*gnet.GVisorStack)
+
+	if !ok || gs.Stack == nil {
+		return nil, 0, errors.New("unsupported network stack")
+	}
+
+	// each interface is assigned its own stack with a single NIC
+	for id := range gs.Stack.NICInfo() {
+		return gs.Stack, id, nil
+	}
+
+	return nil, 0, errors.New("no NIC found")
+}
+
 func bindServices(stack gnet.Stack, console *shell.Interface) (err error) {
 	// hook interface into Go runtime
-	net.SetDefaultNS([]string{Resolver})
 	net.SocketFunc = stack.Socket
 
-	if console != nil {
-		listenerSSH, err := net.Listen("tcp4", ":22")
+	if err = SetResolver(Resolver, ResolverName, ResolverPin); err != nil {
+		return fmt.Errorf("could not set resolver, %v", err)
+	}
 
-		if err != nil {
-			return fmt.Errorf("could not initialize SSH listener, %v", err)
+	if console != nil {
+		if err = startSSHService("ssh", "", console); err != nil {
+			return fmt.Errorf("could not start SSH server, %v", err)
 		}
 
-		StartSSHServer(listenerSSH, console)
+		SetupWebTerminal(console)
 	}
 
-	listenerHTTP, err := net.Listen("tcp4", ":80")
+	SetupStaticWebAssets(console.Banner)
+
+	serveHTTP, err := WebServer(IP, 80, false, nil)
 
 	if err != nil {
-		return fmt.Errorf("could not initialize HTTP listener, %v", err)
+		return fmt.Errorf("could not initialize HTTP server, %v", err)
 	}
 
-	listenerHTTPS, err := net.Listen("tcp4", ":443")
+	serveHTTPS, err := WebServer(IP, 443, true, nil)
 
 	if err != nil {
-		return fmt.Errorf("could not initialize HTTP listener, %v", err)
+		return fmt.Errorf("could not initialize HTTPS server, %v", err)
 	}
 
-	SetupStaticWebAssets(console.Banner)
+	if err = startService(&Service{Name: "http", Port: 80, DNSSD: "_http._tcp", Serve: serveHTTP}); err != nil {
+		return fmt.Errorf("could not start HTTP server, %v", err)
+	}
+
+	if err = startService(&Service{Name: "https", Port: 443, DNSSD: "_https._tcp", Serve: serveHTTPS}); err != nil {
+		return fmt.Errorf("could not start HTTPS server, %v", err)
+	}
 
-	StartWebServer(listenerHTTP, IP, 80, false)
-	StartWebServer(listenerHTTPS, IP, 443, true)
+	// iperf3 server, started on demand
+	if err = RegisterService(&Service{Name: "iperf3", Port: IperfPort, DNSSD: "_iperf3._tcp", Serve: serveIperf}); err != nil {
+		return fmt.Errorf("could not register iperf3 server, %v", err)
+	}
+
+	// allow parallel streams, without rate limiting, for throughput tests
+	FirewallLimit("iperf3", iperfMaxStreams+2, 0, 0, 0)
+
+	// TFTP server, started on demand (see the tftp command)
+	if err = RegisterService(&Service{Name: "tftp", Port: tftpPort, ServePacket: serveTFTP}); err != nil {
+		return fmt.Errorf("could not register TFTP server, %v", err)
+	}
 
 	return
 }
 
-func initStack(console *shell.Interface, dev gnet.NetworkDevice, services bool) (iface *gnet.Interface, err error) {
+func initStack(console *shell.Interface, dev gnet.NetworkDevice, mac net.HardwareAddr, services bool) (iface *gnet.Interface, err error) {
+	name := ethName
+
+	// Ethernet over USB is driven by its ECM endpoint
+	if dev == nil {
+		name = usbName
+	} else {
+		dev = &tapDevice{
+			NetworkDevice: dev,
+			name:          name,
+		}
+	}
+
 	iface = &gnet.Interface{
 		NetworkDevice: dev,
 	}
 
-	if err := iface.Init(IP+CIDR, MAC, Gateway); err != nil {
+	if err := iface.Init(IP+CIDR, mac.String(), Gateway); err != nil {
 		return nil, fmt.Errorf("could not initialize stack, %v", err)
 	}
 
+	log.Printf("%s MAC address %s", name, mac)
+
 	iface.HandleStackErr = func(err error, tx bool) {
+		countStackErr(name, err, tx)
 		log.Printf("network stack error (tx:%v), %v", tx, err)
 	}
 
 	iface.Stack.EnableICMP()
+	Interfaces[name] = iface
 
 	if services {
-		err = bindServices(iface.Stack, console)
+		defaultInterface = name
+
+		if err = bindServices(iface.Stack, console); err != nil {
+			return
+		}
+	}
+
+	if err := StartMDNS(iface); err != nil {
+		log.Printf("could not start mDNS responder on %s, %v", name, err)
 	}
 
 	return
@@ -0,0 +1,567 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/usbarmory/go-net"
+)
+
+// pcapng block types and options
+// (https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-03.html)
+const (
+	blockSHB = 0x0a0d0d0a
+	blockIDB = 0x00000001
+	blockEPB = 0x00000006
+
+	byteOrderMagic = 0x1a2b3c4d
+	linkTypeEther  = 1
+
+	optEnd    = 0
+	optIfName = 2
+	optFlags  = 2
+
+	flagInbound  = 1
+	flagOutbound = 2
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+
+	protoICMP = 1
+	protoTCP  = 6
+	protoUDP  = 17
+)
+
+// CaptureQueueSize represents the number of frames buffered between the
+// network data paths and the capture writer, frames exceeding it are dropped.
+// Each capture output buffers as many frames, outputs exceeding it are
+// closed.
+var CaptureQueueSize = 256
+
+// CaptureFilter represents a packet capture filter, empty fields match any
+// value.
+type CaptureFilter struct {
+	// Protocol is either "arp", "icmp", "tcp" or "udp"
+	Protocol string
+	// Port matches TCP or UDP source or destination port
+	Port uint16
+	// Host matches IPv4 source or destination address
+	Host net.IP
+}
+
+// ParseCaptureFilter parses a filter expression in the form
+// `(arp|icmp|tcp|udp)? (port <n>)? (host <ip>)?`, in any order.
+func ParseCaptureFilter(expr string) (f *CaptureFilter, err error) {
+	f = &CaptureFilter{}
+	args := strings.Fields(expr)
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "arp", "icmp", "tcp", "udp":
+			f.Protocol = args[i]
+		case "port", "host":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing %s value", args[i])
+			}
+
+			if args[i] == "host" {
+				if f.Host = net.ParseIP(args[i+1]).To4(); f.Host == nil {
+					return nil, fmt.Errorf("invalid host %s", args[i+1])
+				}
+			} else {
+				port, err := strconv.ParseUint(args[i+1], 10, 16)
+
+				if err != nil {
+					return nil, fmt.Errorf("invalid port, %v", err)
+				}
+
+				f.Port = uint16(port)
+			}
+
+			i++
+		default:
+			return nil, fmt.Errorf("invalid filter expression %q", args[i])
+		}
+	}
+
+	return
+}
+
+// String returns the filter expression.
+func (f *CaptureFilter) String() string {
+	var expr []string
+
+	if f.Protocol != "" {
+		expr = append(expr, f.Protocol)
+	}
+
+	if f.Port != 0 {
+		expr = append(expr, "port", strconv.Itoa(int(f.Port)))
+	}
+
+	if f.Host != nil {
+		expr = append(expr, "host", f.Host.String())
+	}
+
+	if len(expr) == 0 {
+		return "any"
+	}
+
+	return strings.Join(expr, " ")
+}
+
+// Match returns whether the argument Ethernet frame satisfies the filter.
+func (f *CaptureFilter) Match(frame []byte) bool {
+	if f == nil || (f.Protocol == "" && f.Port == 0 && f.Host == nil) {
+		return true
+	}
+
+	if len(frame) < 14 {
+		return false
+	}
+
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	ip := frame[14:]
+
+	if etherType == etherTypeARP {
+		return f.Protocol == "arp" && f.Port == 0 && (f.Host == nil ||
+			(len(ip) >= 28 && (f.Host.Equal(ip[14:18]) || f.Host.Equal(ip[24:28]))))
+	}
+
+	if etherType != etherTypeIPv4 || len(ip) < 20 || f.Protocol == "arp" {
+		return false
+	}
+
+	if f.Host != nil && !f.Host.Equal(ip[12:16]) && !f.Host.Equal(ip[16:20]) {
+		return false
+	}
+
+	proto := ip[9]
+
+	switch f.Protocol {
+	case "icmp":
+		return proto == protoICMP && f.Port == 0
+	case "tcp":
+		if proto != protoTCP {
+			return false
+		}
+	case "udp":
+		if proto != protoUDP {
+			return false
+		}
+	}
+
+	if f.Port == 0 {
+		return true
+	}
+
+	if proto != protoTCP && proto != protoUDP {
+		return false
+	}
+
+	ihl := int(ip[0]&0x0f) * 4
+
+	if len(ip) < ihl+4 {
+		return false
+	}
+
+	src := binary.BigEndian.Uint16(ip[ihl:])
+	dst := binary.BigEndian.Uint16(ip[ihl+2:])
+
+	return src == f.Port || dst == f.Port
+}
+
+type frame struct {
+	iface string
+	ts    time.Time
+	data  []byte
+	tx    bool
+}
+
+// captureSink represents a capture output, its queue is closed once removed.
+type captureSink struct {
+	queue chan []byte
+}
+
+type captureSession struct {
+	filter *CaptureFilter
+	queue  chan *frame
+	stop   chan struct{}
+
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// active packet capture, nil when not in progress
+var session atomic.Pointer[captureSession]
+
+// capture represents the packet capture outputs.
+var capture struct {
+	sync.Mutex
+
+	path   string
+	start  time.Time
+	ifaces []string
+	sinks  []*captureSink
+}
+
+func init() {
+	http.HandleFunc("/debug/pcap", captureHandler)
+}
+
+func pad(n int) int {
+	return (4 - n%4) % 4
+}
+
+func writeBlock(w io.Writer, blockType uint32, body []byte) (err error) {
+	buf := new(bytes.Buffer)
+	length := uint32(12 + len(body))
+
+	binary.Write(buf, binary.LittleEndian, blockType)
+	binary.Write(buf, binary.LittleEndian, length)
+	buf.Write(body)
+	binary.Write(buf, binary.LittleEndian, length)
+
+	_, err = w.Write(buf.Bytes())
+
+	return
+}
+
+func writeOption(buf *bytes.Buffer, code uint16, val []byte) {
+	binary.Write(buf, binary.LittleEndian, code)
+	binary.Write(buf, binary.LittleEndian, uint16(len(val)))
+	buf.Write(val)
+	buf.Write(make([]byte, pad(len(val))))
+}
+
+func writeHeader(w io.Writer, ifaces []string) (err error) {
+	shb := new(bytes.Buffer)
+
+	binary.Write(shb, binary.LittleEndian, uint32(byteOrderMagic))
+	binary.Write(shb, binary.LittleEndian, uint16(1)) // major version
+	binary.Write(shb, binary.LittleEndian, uint16(0)) // minor version
+	binary.Write(shb, binary.LittleEndian, int64(-1)) // unspecified section length
+
+	if err = writeBlock(w, blockSHB, shb.Bytes()); err != nil {
+		return
+	}
+
+	for _, name := range ifaces {
+		idb := new(bytes.Buffer)
+
+		binary.Write(idb, binary.LittleEndian, uint16(linkTypeEther))
+		binary.Write(idb, binary.LittleEndian, uint16(0)) // reserved
+		binary.Write(idb, binary.LittleEndian, uint32(gnet.EthernetMaximumSize+gnet.MTU))
+
+		writeOption(idb, optIfName, []byte(name))
+		writeOption(idb, optEnd, nil)
+
+		if err = writeBlock(w, blockIDB, idb.Bytes()); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func writePacket(w io.Writer, id int, f *frame) error {
+	epb := new(bytes.Buffer)
+	ts := uint64(f.ts.UnixMicro())
+	flags := make([]byte, 4)
+
+	if f.tx {
+		binary.LittleEndian.PutUint32(flags, flagOutbound)
+	} else {
+		binary.LittleEndian.PutUint32(flags, flagInbound)
+	}
+
+	binary.Write(epb, binary.LittleEndian, uint32(id))
+	binary.Write(epb, binary.LittleEndian, uint32(ts>>32))
+	binary.Write(epb, binary.LittleEndian, uint32(ts))
+	binary.Write(epb, binary.LittleEndian, uint32(len(f.data)))
+	binary.Write(epb, binary.LittleEndian, uint32(len(f.data)))
+	epb.Write(f.data)
+	epb.Write(make([]byte, pad(len(f.data))))
+
+	writeOption(epb, optFlags, flags)
+	writeOption(epb, optEnd, nil)
+
+	return writeBlock(w, blockEPB, epb.Bytes())
+}
+
+func writePackets(c *captureSession) {
+	for {
+		var f *frame
+
+		select {
+		case f = <-c.queue:
+		case <-c.stop:
+			return
+		}
+
+		capture.Lock()
+
+		id := slices.Index(capture.ifaces, f.iface)
+
+		if id < 0 {
+			capture.Unlock()
+			continue
+		}
+
+		buf := new(bytes.Buffer)
+		writePacket(buf, id, f)
+
+		// outputs are written by their own goroutines, never blocking
+		// the capture
+		for _, s := range slices.Clone(capture.sinks) {
+			select {
+			case s.queue <- buf.Bytes():
+			default:
+				log.Printf("packet capture output too slow, closing")
+				removeSink(s)
+			}
+		}
+
+		capture.Unlock()
+	}
+}
+
+// addSink adds a capture output, which must be served by serveSink, must be
+// called with capture locked.
+func addSink() (s *captureSink) {
+	hdr := new(bytes.Buffer)
+	writeHeader(hdr, capture.ifaces)
+
+	s = &captureSink{
+		queue: make(chan []byte, CaptureQueueSize+1),
+	}
+
+	s.queue <- hdr.Bytes()
+	capture.sinks = append(capture.sinks, s)
+
+	return
+}
+
+// removeSink removes a capture output, must be called with capture locked.
+func removeSink(s *captureSink) {
+	if i := slices.Index(capture.sinks, s); i >= 0 {
+		capture.sinks = slices.Delete(capture.sinks, i, i+1)
+		close(s.queue)
+	}
+}
+
+// serveSink writes a capture output until it is removed, a write error occurs
+// or the argument channel is closed.
+func serveSink(s *captureSink, w io.Writer, done <-chan struct{}) {
+	defer func() {
+		capture.Lock()
+		removeSink(s)
+		capture.Unlock()
+	}()
+
+	for {
+		select {
+		case buf, ok := <-s.queue:
+			if !ok {
+				return
+			}
+
+			if _, err := w.Write(buf); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Capture records an Ethernet frame, received or transmitted on the named
+// interface, if a packet capture is active and its filter is matched.
+//
+// The function is meant to be invoked from network data paths (including
+// interrupt handlers), therefore the frame is copied and queued without
+// blocking, it is dropped if the queue is full.
+func Capture(iface string, data []byte, tx bool) {
+	c := session.Load()
+
+	if c == nil || !c.filter.Match(data) {
+		return
+	}
+
+	f := &frame{
+		iface: iface,
+		ts:    time.Now(),
+		data:  bytes.Clone(data),
+		tx:    tx,
+	}
+
+	select {
+	case c.queue <- f:
+		c.packets.Add(1)
+		c.bytes.Add(uint64(len(data)))
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// StartCapture starts a packet capture on all network interfaces, frames
+// matching the filter are saved in pcapng format to the argument path (when
+// not empty) and streamed to /debug/pcap HTTP clients.
+func StartCapture(path string, filter *CaptureFilter) (err error) {
+	capture.Lock()
+	defer capture.Unlock()
+
+	if session.Load() != nil {
+		return errors.New("capture already in progress")
+	}
+
+	capture.ifaces = nil
+
+	for name := range Interfaces {
+		capture.ifaces = append(capture.ifaces, name)
+	}
+
+	slices.Sort(capture.ifaces)
+
+	if len(path) > 0 {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+		if err != nil {
+			return err
+		}
+
+		s := addSink()
+
+		go func() {
+			serveSink(s, f, nil)
+			f.Close()
+		}()
+	}
+
+	c := &captureSession{
+		filter: filter,
+		queue:  make(chan *frame, CaptureQueueSize),
+		stop:   make(chan struct{}),
+	}
+
+	capture.path = path
+	capture.start = time.Now()
+
+	go writePackets(c)
+	session.Store(c)
+
+	log.Printf("packet capture started (filter: %s)", filter)
+
+	return
+}
+
+// StopCapture stops an active packet capture, closing all its outputs.
+func StopCapture() (err error) {
+	capture.Lock()
+	defer capture.Unlock()
+
+	c := session.Swap(nil)
+
+	if c == nil {
+		return errors.New("no capture in progress")
+	}
+
+	close(c.stop)
+
+	// outputs are closed once their pending frames are written
+	for _, s := range slices.Clone(capture.sinks) {
+		removeSink(s)
+	}
+
+	log.Printf("packet capture stopped (%d packets, %d dropped)", c.packets.Load(), c.dropped.Load())
+
+	return
+}
+
+// CaptureStatus returns a description of the packet capture state.
+func CaptureStatus() string {
+	var res bytes.Buffer
+
+	capture.Lock()
+	defer capture.Unlock()
+
+	c := session.Load()
+
+	if c == nil {
+		return "no capture in progress"
+	}
+
+	fmt.Fprintf(&res, "Interfaces ...: %s\n", strings.Join(capture.ifaces, " "))
+	fmt.Fprintf(&res, "Filter .......: %s\n", c.filter)
+	fmt.Fprintf(&res, "File .........: %s\n", capture.path)
+	fmt.Fprintf(&res, "Outputs ......: %d\n", len(capture.sinks))
+	fmt.Fprintf(&res, "Duration .....: %s\n", time.Since(capture.start).Truncate(time.Second))
+	fmt.Fprintf(&res, "Packets ......: %d (%d bytes)\n", c.packets.Load(), c.bytes.Load())
+	fmt.Fprintf(&res, "Dropped ......: %d", c.dropped.Load())
+
+	return res.String()
+}
+
+type flushWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func (fw *flushWriter) Write(buf []byte) (n int, err error) {
+	n, err = fw.w.Write(buf)
+	fw.f.Flush()
+	return
+}
+
+// captureHandler streams the active packet capture in pcapng format, e.g.:
+//
+//	curl -sk https://10.0.0.1/debug/pcap | wireshark -k -i -
+func captureHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	capture.Lock()
+
+	if session.Load() == nil {
+		capture.Unlock()
+		http.Error(w, "no capture in progress", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	s := addSink()
+	capture.Unlock()
+
+	log.Printf("streaming packet capture to %s", r.RemoteAddr)
+
+	serveSink(s, &flushWriter{w: w, f: flusher}, r.Context().Done())
+}
@@ -0,0 +1,357 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+
+	"github.com/usbarmory/go-net"
+)
+
+const (
+	// traceroute destination port base
+	traceroutePort = 33434
+	// traceroute probes per hop
+	tracerouteProbes = 3
+)
+
+// PingTimeout represents the maximum time to wait for an ICMP reply.
+var PingTimeout = 1 * time.Second
+
+// icmpError represents an ICMP error received in response to a UDP probe.
+type icmpError struct {
+	from net.IP
+	typ  header.ICMPv4Type
+	code header.ICMPv4Code
+	dst  net.IP
+	port uint16
+	ts   time.Time
+}
+
+// active traceroute ICMP error receiver, nil when not in progress
+var icmpObserver atomic.Pointer[chan *icmpError]
+
+// observeICMP parses ICMP Time Exceeded and Destination Unreachable messages
+// for delivery to an active traceroute, as gVisor does not deliver them to UDP
+// endpoints.
+func observeICMP(frame []byte) {
+	ch := icmpObserver.Load()
+
+	if ch == nil || len(frame) < header.EthernetMinimumSize+header.IPv4MinimumSize {
+		return
+	}
+
+	if binary.BigEndian.Uint16(frame[12:14]) != uint16(header.IPv4ProtocolNumber) {
+		return
+	}
+
+	ip := header.IPv4(frame[header.EthernetMinimumSize:])
+
+	if !ip.IsValid(len(ip)) || ip.TransportProtocol() != header.ICMPv4ProtocolNumber {
+		return
+	}
+
+	msg := header.ICMPv4(ip.Payload())
+
+	if len(msg) < header.ICMPv4MinimumSize+header.IPv4MinimumSize+header.UDPMinimumSize {
+		return
+	}
+
+	if t := msg.Type(); t != header.ICMPv4TimeExceeded && t != header.ICMPv4DstUnreachable {
+		return
+	}
+
+	// the ICMP error payload holds the original IP header and the first
+	// 8 bytes of its payload
+	orig := header.IPv4(msg[header.ICMPv4MinimumSize:])
+	hlen := int(orig.HeaderLength())
+
+	if orig.TransportProtocol() != header.UDPProtocolNumber || len(orig) < hlen+header.UDPMinimumSize {
+		return
+	}
+
+	dst := orig.DestinationAddress().As4()
+	src := ip.SourceAddress().As4()
+
+	e := &icmpError{
+		from: net.IP(src[:]),
+		typ:  msg.Type(),
+		code: msg.Code(),
+		dst:  net.IP(dst[:]),
+		port: header.UDP(orig[hlen:]).DestinationPort(),
+		ts:   time.Now(),
+	}
+
+	select {
+	case *ch <- e:
+	default:
+	}
+}
+
+func lookupInterface() (iface string, err error) {
+	if _, ok := Interfaces[defaultInterface]; !ok {
+		return "", errors.New("no network interface available")
+	}
+
+	return defaultInterface, nil
+}
+
+func readEndpoint(ep tcpip.Endpoint, ch chan struct{}, buf *bytes.Buffer, deadline time.Time) (res tcpip.ReadResult, err error) {
+	for {
+		var tcpipErr tcpip.Error
+
+		buf.Reset()
+
+		if res, tcpipErr = ep.Read(buf, tcpip.ReadOptions{NeedRemoteAddr: true}); tcpipErr == nil {
+			return
+		}
+
+		if _, ok := tcpipErr.(*tcpip.ErrWouldBlock); !ok {
+			return res, errors.New(tcpipErr.String())
+		}
+
+		select {
+		case <-ch:
+		case <-time.After(time.Until(deadline)):
+			return res, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Ping sends ICMP echo requests to the argument address, reporting replies and
+// round-trip time statistics on the argument writer.
+func Ping(w io.Writer, addr net.IP, count int, size int, interval time.Duration) (err error) {
+	var wq waiter.Queue
+	var rtt []time.Duration
+
+	ip := addr.To4()
+
+	if ip == nil {
+		return errors.New("invalid IPv4 address")
+	}
+
+	if size < 0 || size > gnet.MTU-header.IPv4MinimumSize-header.ICMPv4MinimumSize {
+		return errors.New("invalid size")
+	}
+
+	name, err := lookupInterface()
+
+	if err != nil {
+		return
+	}
+
+	s, _, err := gvisor(Interfaces[name])
+
+	if err != nil {
+		return
+	}
+
+	ep, tcpipErr := s.NewEndpoint(icmp.ProtocolNumber4, ipv4.ProtocolNumber, &wq)
+
+	if tcpipErr != nil {
+		return errors.New(tcpipErr.String())
+	}
+	defer ep.Close()
+
+	ep.SocketOptions().SetReceiveTTL(true)
+
+	entry, ch := waiter.NewChannelEntry(waiter.ReadableEvents)
+	wq.EventRegister(&entry)
+	defer wq.EventUnregister(&entry)
+
+	dst := &tcpip.FullAddress{Addr: tcpip.AddrFromSlice(ip)}
+	buf := new(bytes.Buffer)
+
+	fmt.Fprintf(w, "PING %s: %d data bytes\n", ip, size)
+
+	for seq := 0; seq < count; seq++ {
+		req := header.ICMPv4(make([]byte, header.ICMPv4MinimumSize+size))
+		req.SetType(header.ICMPv4Echo)
+		req.SetSequence(uint16(seq))
+
+		start := time.Now()
+
+		if _, tcpipErr := ep.Write(bytes.NewReader(req), tcpip.WriteOptions{To: dst}); tcpipErr != nil {
+			return fmt.Errorf("could not send echo request, %s", tcpipErr)
+		}
+
+		for {
+			res, err := readEndpoint(ep, ch, buf, start.Add(PingTimeout))
+
+			if err != nil {
+				fmt.Fprintf(w, "request timeout for icmp_seq %d\n", seq)
+				break
+			}
+
+			reply := header.ICMPv4(buf.Bytes())
+
+			if len(reply) < header.ICMPv4MinimumSize || reply.Type() != header.ICMPv4EchoReply || int(reply.Sequence()) != seq {
+				continue
+			}
+
+			elapsed := time.Since(start)
+			rtt = append(rtt, elapsed)
+
+			fmt.Fprintf(w, "%d bytes from %s: icmp_seq=%d ttl=%d time=%.3f ms\n",
+				res.Total, res.RemoteAddr.Addr, seq, res.ControlMessages.TTL, float64(elapsed)/1e6)
+
+			break
+		}
+
+		if seq < count-1 {
+			time.Sleep(time.Until(start.Add(interval)))
+		}
+	}
+
+	fmt.Fprintf(w, "\n--- %s ping statistics ---\n", ip)
+	fmt.Fprintf(w, "%d packets transmitted, %d packets received, %.1f%% packet loss\n",
+		count, len(rtt), 100*float64(count-len(rtt))/float64(count))
+
+	if len(rtt) == 0 {
+		return
+	}
+
+	var sum time.Duration
+	var sq float64
+
+	for _, d := range rtt {
+		sum += d
+	}
+
+	avg := float64(sum) / float64(len(rtt))
+
+	for _, d := range rtt {
+		sq += (float64(d) - avg) * (float64(d) - avg)
+	}
+
+	fmt.Fprintf(w, "round-trip min/avg/max/stddev = %.3f/%.3f/%.3f/%.3f ms\n",
+		float64(slices.Min(rtt))/1e6, avg/1e6, float64(slices.Max(rtt))/1e6, math.Sqrt(sq/float64(len(rtt)))/1e6)
+
+	return
+}
+
+// Traceroute sends UDP probes with increasing TTL to the argument address,
+// reporting the gateways responding with ICMP errors on the argument writer.
+func Traceroute(w io.Writer, addr net.IP, maxHops int) (err error) {
+	var wq waiter.Queue
+
+	ip := addr.To4()
+
+	if ip == nil {
+		return errors.New("invalid IPv4 address")
+	}
+
+	name, err := lookupInterface()
+
+	if err != nil {
+		return
+	}
+
+	s, _, err := gvisor(Interfaces[name])
+
+	if err != nil {
+		return
+	}
+
+	ch := make(chan *icmpError, tracerouteProbes)
+
+	if !icmpObserver.CompareAndSwap(nil, &ch) {
+		return errors.New("traceroute already in progress")
+	}
+	defer icmpObserver.Store(nil)
+
+	ep, tcpipErr := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+
+	if tcpipErr != nil {
+		return errors.New(tcpipErr.String())
+	}
+	defer ep.Close()
+
+	fmt.Fprintf(w, "traceroute to %s, %d hops max\n", ip, maxHops)
+
+	probe := make([]byte, 32)
+	port := uint16(traceroutePort)
+
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		var from net.IP
+		var done bool
+
+		if tcpipErr := ep.SetSockOptInt(tcpip.IPv4TTLOption, ttl); tcpipErr != nil {
+			return errors.New(tcpipErr.String())
+		}
+
+		fmt.Fprintf(w, "%2d ", ttl)
+
+		for i := 0; i < tracerouteProbes; i++ {
+			port++
+
+			dst := &tcpip.FullAddress{Addr: tcpip.AddrFromSlice(ip), Port: port}
+			start := time.Now()
+
+			if _, tcpipErr := ep.Write(bytes.NewReader(probe), tcpip.WriteOptions{To: dst}); tcpipErr != nil {
+				return fmt.Errorf("could not send probe, %s", tcpipErr)
+			}
+
+			e := waitProbe(ch, ip, port, start.Add(PingTimeout))
+
+			if e == nil {
+				fmt.Fprint(w, " *")
+				continue
+			}
+
+			if !e.from.Equal(from) {
+				from = e.from
+				fmt.Fprintf(w, " %s", from)
+			}
+
+			fmt.Fprintf(w, "  %.3f ms", float64(e.ts.Sub(start))/1e6)
+
+			if e.typ == header.ICMPv4DstUnreachable {
+				done = true
+			}
+		}
+
+		fmt.Fprintln(w)
+
+		if done {
+			break
+		}
+	}
+
+	return
+}
+
+func waitProbe(ch chan *icmpError, dst net.IP, port uint16, deadline time.Time) *icmpError {
+	for {
+		select {
+		case e := <-ch:
+			if e.dst.Equal(dst) && e.port == port {
+				return e
+			}
+		case <-time.After(time.Until(deadline)):
+			return nil
+		}
+	}
+}
@@ -0,0 +1,653 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS resolver parameters
+const (
+	dnsTimeout = 5 * time.Second
+	// maximum DNS message size
+	dnsMaxMessage = 65535
+	// EDNS(0) UDP payload size
+	dnsMaxUDP = 1232
+
+	dnsCacheSize = 256
+	dnsMaxTTL    = 24 * time.Hour
+
+	dohContentType = "application/dns-message"
+)
+
+// ResolverName and ResolverPin optionally set the expected TLS server name
+// and base64 encoded SHA-256 SPKI pin (RFC 7469) of an encrypted Resolver.
+var (
+	ResolverName = ""
+	ResolverPin  = ""
+)
+
+// dnsResolver represents a DNS resolver transport, either plain (UDP with TCP
+// fallback), DNS-over-TLS (RFC 7858) or DNS-over-HTTPS (RFC 8484).
+type dnsResolver struct {
+	sync.Mutex
+
+	uri    string
+	scheme string
+	addr   string
+	pin    []byte
+
+	tlsConfig *tls.Config
+	client    *http.Client
+
+	// persistent DNS-over-TLS connection
+	conn *tls.Conn
+}
+
+type dnsCacheEntry struct {
+	msg    dnsmessage.Message
+	stored time.Time
+	expiry time.Time
+}
+
+// dnsCache represents a DNS response cache, honoring record TTLs.
+type dnsCache struct {
+	sync.Mutex
+
+	entries map[string]*dnsCacheEntry
+	hits    uint64
+	misses  uint64
+}
+
+var (
+	resolverMutex sync.Mutex
+	resolver      *dnsResolver
+
+	cache = &dnsCache{
+		entries: make(map[string]*dnsCacheEntry),
+	}
+)
+
+// SetResolver configures the DNS resolver used by the Go runtime, the URI
+// can be either a plain address (ip:port), a DNS-over-TLS address
+// (tls://ip[:port]) or a DNS-over-HTTPS URL (https://ip[:port]/path).
+//
+// Encrypted resolvers are authenticated against the argument server name,
+// or URI host if empty, and the optional base64 encoded SHA-256 hash of the
+// server (leaf) certificate public key. When a pin is set, it replaces certificate chain
+// and validity verification, allowing encrypted resolution before the clock
+// is set.
+func SetResolver(uri string, name string, pin string) (err error) {
+	r := &dnsResolver{
+		uri: uri,
+	}
+
+	if len(pin) > 0 {
+		if r.pin, err = base64.StdEncoding.DecodeString(pin); err != nil || len(r.pin) != sha256.Size {
+			return errors.New("invalid pin, expected base64 SHA-256 hash")
+		}
+	}
+
+	u, err := url.Parse(uri)
+
+	if err != nil || u.Host == "" {
+		// plain address
+		if _, _, err = net.SplitHostPort(uri); err != nil {
+			return fmt.Errorf("invalid resolver, %v", err)
+		}
+
+		u = &url.URL{Scheme: "udp", Host: uri}
+	}
+
+	if net.ParseIP(u.Hostname()) == nil {
+		// resolving the resolver itself would be circular
+		return errors.New("resolver host must be an IP address")
+	}
+
+	if len(name) == 0 {
+		name = u.Hostname()
+	}
+
+	r.tlsConfig = &tls.Config{
+		ServerName: name,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if r.pin != nil {
+		r.tlsConfig.InsecureSkipVerify = true
+		r.tlsConfig.VerifyConnection = r.verifyPin
+	}
+
+	r.scheme = u.Scheme
+	r.addr = u.Host
+
+	switch u.Scheme {
+	case "udp":
+		if u.Port() == "" {
+			r.addr = net.JoinHostPort(u.Hostname(), "53")
+		}
+	case "tls":
+		if u.Port() == "" {
+			r.addr = net.JoinHostPort(u.Hostname(), "853")
+		}
+	case "https":
+		if u.Port() == "" {
+			r.addr = net.JoinHostPort(u.Hostname(), "443")
+		}
+
+		r.client = &http.Client{
+			Timeout: dnsTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig:   r.tlsConfig,
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		}
+	default:
+		return fmt.Errorf("unsupported resolver scheme %s", u.Scheme)
+	}
+
+	resolverMutex.Lock()
+	defer resolverMutex.Unlock()
+
+	if resolver != nil {
+		resolver.close()
+	}
+
+	resolver = r
+	cache.flush()
+
+	// the Go runtime dials the configured resolver through dialResolver,
+	// the address is merely informative
+	net.SetDefaultNS([]string{r.addr})
+	net.DefaultResolver.PreferGo = true
+	net.DefaultResolver.Dial = dialResolver
+
+	return
+}
+
+// FlushDNSCache removes all cached DNS responses.
+func FlushDNSCache() {
+	cache.flush()
+}
+
+// ResolverStatus returns the current resolver configuration and cache
+// statistics.
+func ResolverStatus() string {
+	var buf bytes.Buffer
+
+	resolverMutex.Lock()
+	r := resolver
+	resolverMutex.Unlock()
+
+	if r == nil {
+		return "no resolver configured"
+	}
+
+	fmt.Fprintf(&buf, "resolver: %s", r.uri)
+
+	if r.scheme != "udp" {
+		fmt.Fprintf(&buf, " (server name %s", r.tlsConfig.ServerName)
+
+		if r.pin != nil {
+			fmt.Fprintf(&buf, ", pin %s", base64.StdEncoding.EncodeToString(r.pin))
+		}
+
+		fmt.Fprintf(&buf, ")")
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	fmt.Fprintf(&buf, "\ncache: %d entries, %d hits, %d misses", len(cache.entries), cache.hits, cache.misses)
+
+	return buf.String()
+}
+
+// verifyPin matches the pin against the leaf certificate public key, the only
+// one proven to be held by the server as the chain is not verified.
+func (r *dnsResolver) verifyPin(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("missing certificate")
+	}
+
+	h := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+
+	if subtle.ConstantTimeCompare(h[:], r.pin) != 1 {
+		return errors.New("certificate pin mismatch")
+	}
+
+	return nil
+}
+
+func (r *dnsResolver) close() {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+
+	if r.client != nil {
+		r.client.CloseIdleConnections()
+	}
+}
+
+func readStream(c net.Conn) (res []byte, err error) {
+	hdr := make([]byte, 2)
+
+	if _, err = io.ReadFull(c, hdr); err != nil {
+		return
+	}
+
+	res = make([]byte, binary.BigEndian.Uint16(hdr))
+	_, err = io.ReadFull(c, res)
+
+	return
+}
+
+func writeStream(c net.Conn, req []byte) (err error) {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(req)))
+	_, err = c.Write(append(buf, req...))
+	return
+}
+
+func (r *dnsResolver) exchangeTCP(ctx context.Context, req []byte) (res []byte, err error) {
+	var d net.Dialer
+
+	c, err := d.DialContext(ctx, "tcp", r.addr)
+
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	if err = writeStream(c, req); err != nil {
+		return
+	}
+
+	return readStream(c)
+}
+
+func (r *dnsResolver) exchangeUDP(ctx context.Context, req []byte) (res []byte, err error) {
+	var d net.Dialer
+
+	c, err := d.DialContext(ctx, "udp", r.addr)
+
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	if _, err = c.Write(req); err != nil {
+		return
+	}
+
+	buf := make([]byte, dnsMaxUDP)
+
+	for {
+		n, err := c.Read(buf)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// discard mismatching responses
+		if n < 12 || !bytes.Equal(buf[0:2], req[0:2]) {
+			continue
+		}
+
+		// retry truncated responses over TCP
+		if buf[2]&0x02 != 0 {
+			return r.exchangeTCP(ctx, req)
+		}
+
+		return buf[:n], nil
+	}
+}
+
+func (r *dnsResolver) exchangeTLS(ctx context.Context, req []byte) (res []byte, err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	// reuse the connection (RFC 7858 3.4.), redialing once on failure
+	for retry := 0; retry < 2; retry++ {
+		if r.conn == nil {
+			d := &tls.Dialer{Config: r.tlsConfig}
+			c, err := d.DialContext(ctx, "tcp", r.addr)
+
+			if err != nil {
+				return nil, err
+			}
+
+			r.conn = c.(*tls.Conn)
+		}
+
+		deadline, ok := ctx.Deadline()
+
+		if !ok {
+			deadline = time.Now().Add(dnsTimeout)
+		}
+
+		r.conn.SetDeadline(deadline)
+
+		if err = writeStream(r.conn, req); err == nil {
+			if res, err = readStream(r.conn); err == nil {
+				return
+			}
+		}
+
+		r.conn.Close()
+		r.conn = nil
+	}
+
+	return
+}
+
+func (r *dnsResolver) exchangeHTTPS(ctx context.Context, req []byte) (res []byte, err error) {
+	// a zero ID maximizes HTTP cache friendliness (RFC 8484 4.1.)
+	id := binary.BigEndian.Uint16(req)
+	req = bytes.Clone(req)
+	binary.BigEndian.PutUint16(req, 0)
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, r.uri, bytes.NewReader(req))
+
+	if err != nil {
+		return
+	}
+
+	httpReq.Header.Set("Content-Type", dohContentType)
+	httpReq.Header.Set("Accept", dohContentType)
+
+	httpRes, err := r.client.Do(httpReq)
+
+	if err != nil {
+		return
+	}
+	defer httpRes.Body.Close()
+
+	if httpRes.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server error, %s", httpRes.Status)
+	}
+
+	if ct := httpRes.Header.Get("Content-Type"); ct != dohContentType {
+		return nil, fmt.Errorf("DoH invalid content type %s", ct)
+	}
+
+	if res, err = io.ReadAll(io.LimitReader(httpRes.Body, dnsMaxMessage)); err != nil {
+		return
+	}
+
+	if len(res) < 12 {
+		return nil, errors.New("DoH invalid response")
+	}
+
+	binary.BigEndian.PutUint16(res, id)
+
+	return
+}
+
+func (r *dnsResolver) exchange(ctx context.Context, req []byte) (res []byte, err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dnsTimeout)
+		defer cancel()
+	}
+
+	switch r.scheme {
+	case "https":
+		return r.exchangeHTTPS(ctx, req)
+	case "tls":
+		return r.exchangeTLS(ctx, req)
+	default:
+		return r.exchangeUDP(ctx, req)
+	}
+}
+
+func cacheKey(q dnsmessage.Question) string {
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(q.Name.String()), q.Type, q.Class)
+}
+
+func (c *dnsCache) flush() {
+	c.Lock()
+	defer c.Unlock()
+
+	clear(c.entries)
+}
+
+// get returns a cached response, with the argument ID and TTLs reduced by the
+// time spent in cache.
+func (c *dnsCache) get(q dnsmessage.Question, id uint16) (res []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	key := cacheKey(q)
+	e, ok := c.entries[key]
+
+	if !ok || time.Now().After(e.expiry) {
+		delete(c.entries, key)
+		c.misses += 1
+		return
+	}
+
+	c.hits += 1
+
+	msg := e.msg
+	msg.ID = id
+	msg.Answers = slices.Clone(msg.Answers)
+	msg.Authorities = slices.Clone(msg.Authorities)
+
+	age := uint32(time.Since(e.stored).Seconds())
+
+	for _, rrs := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities} {
+		for i := range rrs {
+			rrs[i].Header.TTL -= min(age, rrs[i].Header.TTL)
+		}
+	}
+
+	res, _ = msg.Pack()
+
+	return
+}
+
+// put caches a response for the lowest TTL of its answer and authority
+// records, negative responses are cached for the SOA TTL (RFC 2308).
+func (c *dnsCache) put(q dnsmessage.Question, res []byte) {
+	var msg dnsmessage.Message
+
+	if err := msg.Unpack(res); err != nil || msg.Truncated {
+		return
+	}
+
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+
+	ttl := uint32(dnsMaxTTL.Seconds())
+	n := 0
+
+	for _, rrs := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities} {
+		for _, rr := range rrs {
+			ttl = min(ttl, rr.Header.TTL)
+			n++
+		}
+	}
+
+	if n == 0 || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.entries) >= dnsCacheSize {
+		var oldest string
+
+		for key, e := range c.entries {
+			if now.After(e.expiry) {
+				delete(c.entries, key)
+			} else if oldest == "" || e.expiry.Before(c.entries[oldest].expiry) {
+				oldest = key
+			}
+		}
+
+		if len(c.entries) >= dnsCacheSize {
+			delete(c.entries, oldest)
+		}
+	}
+
+	c.entries[cacheKey(q)] = &dnsCacheEntry{
+		msg:    msg,
+		stored: now,
+		expiry: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// dnsConn implements a net.Conn which serves the Go resolver stream
+// transport (RFC 1035 4.2.2) through the cache and configured resolver.
+type dnsConn struct {
+	ctx      context.Context
+	r        *dnsResolver
+	deadline time.Time
+
+	wbuf []byte
+	rbuf bytes.Buffer
+}
+
+// dialResolver replaces the Go runtime resolver dialer, the configured
+// resolver supersedes the argument address.
+func dialResolver(ctx context.Context, network, address string) (net.Conn, error) {
+	resolverMutex.Lock()
+	r := resolver
+	resolverMutex.Unlock()
+
+	if r == nil {
+		return nil, errors.New("no resolver configured")
+	}
+
+	return &dnsConn{ctx: ctx, r: r}, nil
+}
+
+func (c *dnsConn) query(req []byte) (res []byte, err error) {
+	var p dnsmessage.Parser
+
+	h, err := p.Start(req)
+
+	if err != nil {
+		return
+	}
+
+	q, err := p.Question()
+
+	if err != nil {
+		return
+	}
+
+	if res = cache.get(q, h.ID); res != nil {
+		return
+	}
+
+	ctx := c.ctx
+
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	if res, err = c.r.exchange(ctx, req); err != nil {
+		return
+	}
+
+	cache.put(q, res)
+
+	return
+}
+
+func (c *dnsConn) Write(b []byte) (n int, err error) {
+	c.wbuf = append(c.wbuf, b...)
+
+	for len(c.wbuf) >= 2 {
+		size := int(binary.BigEndian.Uint16(c.wbuf)) + 2
+
+		if len(c.wbuf) < size {
+			break
+		}
+
+		res, err := c.query(c.wbuf[2:size])
+
+		if err != nil {
+			return 0, err
+		}
+
+		c.wbuf = c.wbuf[size:]
+		c.rbuf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(res))))
+		c.rbuf.Write(res)
+	}
+
+	return len(b), nil
+}
+
+func (c *dnsConn) Read(b []byte) (int, error) {
+	return c.rbuf.Read(b)
+}
+
+func (c *dnsConn) Close() error {
+	return nil
+}
+
+func (c *dnsConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *dnsConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *dnsConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *dnsConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dnsConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
@@ -0,0 +1,351 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// scpSession represents a legacy SCP (`scp -O`) remote endpoint, acting as
+// sink (-t) or source (-f) on the root filesystem.
+type scpSession struct {
+	r *bufio.Reader
+	w io.Writer
+
+	recursive bool
+	targetDir bool
+}
+
+// ack sends an acknowledgment, or an error message, to the remote endpoint.
+func (s *scpSession) ack(err error) {
+	if err != nil {
+		fmt.Fprintf(s.w, "\x01scp: %v\n", err)
+		return
+	}
+
+	s.w.Write([]byte{0})
+}
+
+// wait waits for an acknowledgment from the remote endpoint.
+func (s *scpSession) wait() error {
+	b, err := s.r.ReadByte()
+
+	if err != nil {
+		return err
+	}
+
+	if b == 0 {
+		return nil
+	}
+
+	msg, _ := s.r.ReadString('\n')
+
+	return fmt.Errorf("remote error, %s", strings.TrimSpace(msg))
+}
+
+// parseHeader parses a `C` or `D` message (e.g. C0644 299 file.txt).
+func parseHeader(line string) (mode fs.FileMode, size int64, name string, err error) {
+	f := strings.SplitN(line[1:], " ", 3)
+
+	if len(f) != 3 {
+		return 0, 0, "", fmt.Errorf("invalid header %q", line)
+	}
+
+	m, err := strconv.ParseUint(f[0], 8, 32)
+
+	if err != nil {
+		return
+	}
+
+	if size, err = strconv.ParseInt(f[1], 10, 64); err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("invalid size %q", f[1])
+	}
+
+	name = f[2]
+
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("invalid name %q", name)
+	}
+
+	return fs.FileMode(m).Perm(), size, name, nil
+}
+
+func (s *scpSession) receiveFile(p string, mode fs.FileMode, size int64) (err error) {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	s.ack(nil)
+
+	if _, err = io.CopyN(f, s.r, size); err != nil {
+		return
+	}
+
+	return s.wait()
+}
+
+// sink receives files and directories to the argument target path.
+func (s *scpSession) sink(target string) (err error) {
+	fi, err := os.Stat(target)
+	isDir := err == nil && fi.IsDir()
+
+	if s.targetDir && !isDir {
+		err = fmt.Errorf("%s is not a directory", target)
+		s.ack(err)
+		return
+	}
+
+	// current directory, empty until the first directory is received
+	// when the target is not an existing one
+	var dirs []string
+
+	if isDir {
+		dirs = append(dirs, target)
+	}
+
+	s.ack(nil)
+
+	for {
+		line, err := s.r.ReadString('\n')
+
+		if err == io.EOF && line == "" {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+
+		if len(line) == 0 {
+			return errors.New("invalid message")
+		}
+
+		switch line[0] {
+		case 'C', 'D':
+			var p string
+
+			mode, size, name, err := parseHeader(line)
+
+			if err == nil {
+				if len(dirs) > 0 {
+					p = path.Join(dirs[len(dirs)-1], name)
+				} else {
+					p = target
+				}
+
+				if _, err = sftpPath(p); err != nil {
+					p = ""
+				}
+			}
+
+			switch {
+			case err != nil:
+			case line[0] == 'C':
+				err = s.receiveFile(p, mode, size)
+
+				if err == nil {
+					s.ack(nil)
+					continue
+				}
+			case !s.recursive:
+				err = errors.New("received directory without -r")
+			default:
+				if err = os.Mkdir(p, mode|0700); errors.Is(err, fs.ErrExist) {
+					err = nil
+				}
+
+				if err == nil {
+					dirs = append(dirs, p)
+					s.ack(nil)
+					continue
+				}
+			}
+
+			s.ack(err)
+			return err
+		case 'E':
+			if len(dirs) == 0 || (isDir && len(dirs) == 1) {
+				err = errors.New("unexpected end of directory")
+				s.ack(err)
+				return err
+			}
+
+			dirs = dirs[:len(dirs)-1]
+			s.ack(nil)
+		case 'T':
+			// modification times are not preserved
+			s.ack(nil)
+		case 0x01, 0x02:
+			return fmt.Errorf("remote error, %s", line[1:])
+		default:
+			err = fmt.Errorf("invalid message %q", line)
+			s.ack(err)
+			return err
+		}
+	}
+}
+
+func (s *scpSession) sendFile(p string, fi fs.FileInfo) (err error) {
+	f, err := os.Open(p)
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	fmt.Fprintf(s.w, "C%04o %d %s\n", fi.Mode().Perm(), fi.Size(), fi.Name())
+
+	if err = s.wait(); err != nil {
+		return
+	}
+
+	if _, err = io.CopyN(s.w, f, fi.Size()); err != nil {
+		return
+	}
+
+	s.ack(nil)
+
+	return s.wait()
+}
+
+func (s *scpSession) sendDir(p string, fi fs.FileInfo) (err error) {
+	entries, err := os.ReadDir(p)
+
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(s.w, "D%04o 0 %s\n", fi.Mode().Perm(), fi.Name())
+
+	if err = s.wait(); err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if PrivatePath(path.Join(p, e.Name())) {
+			continue
+		}
+
+		if err = s.send(path.Join(p, e.Name())); err != nil {
+			return
+		}
+	}
+
+	fmt.Fprint(s.w, "E\n")
+
+	return s.wait()
+}
+
+func (s *scpSession) send(p string) (err error) {
+	if p, err = sftpPath(p); err != nil {
+		return
+	}
+
+	fi, err := os.Stat(p)
+
+	switch {
+	case err != nil:
+		return
+	case fi.IsDir() && !s.recursive:
+		return fmt.Errorf("%s is a directory", p)
+	case fi.IsDir():
+		return s.sendDir(p, fi)
+	case !fi.Mode().IsRegular():
+		return fmt.Errorf("%s is not a regular file", p)
+	}
+
+	return s.sendFile(p, fi)
+}
+
+// source sends the argument files and directories.
+func (s *scpSession) source(paths []string) (err error) {
+	if err = s.wait(); err != nil {
+		return
+	}
+
+	for _, p := range paths {
+		if err = s.send(p); err != nil {
+			s.ack(err)
+			return
+		}
+	}
+
+	return
+}
+
+// serveSCP serves a legacy SCP `scp -t` (sink) or `scp -f` (source) command
+// over the argument connection, sink mode is refused when readOnly is set.
+func serveSCP(r io.Reader, w io.Writer, args []string, readOnly bool) (err error) {
+	var sink, source bool
+	var paths []string
+
+	s := &scpSession{
+		r: bufio.NewReader(r),
+		w: w,
+	}
+
+	for i, arg := range args {
+		if arg == "--" {
+			paths = append(paths, args[i+1:]...)
+			break
+		}
+
+		if !strings.HasPrefix(arg, "-") {
+			paths = append(paths, arg)
+			continue
+		}
+
+		for _, f := range arg[1:] {
+			switch f {
+			case 't':
+				sink = true
+			case 'f':
+				source = true
+			case 'r':
+				s.recursive = true
+			case 'd':
+				s.targetDir = true
+			case 'p', 'v', 'q':
+			default:
+				return fmt.Errorf("unsupported flag -%c", f)
+			}
+		}
+	}
+
+	switch {
+	case sink == source, len(paths) == 0:
+		return errors.New("usage: scp (-t|-f) [-r] [-d] <path>")
+	case sink && len(paths) > 1:
+		return errors.New("invalid target")
+	case sink && readOnly:
+		err = fmt.Errorf("%s, %v", paths[0], fs.ErrPermission)
+		s.ack(err)
+		return
+	case sink:
+		target, err := sftpPath(paths[0])
+
+		if err != nil {
+			return err
+		}
+
+		return s.sink(target)
+	}
+
+	return s.source(paths)
+}
@@ -0,0 +1,538 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+const (
+	serviceMaxBackoff = 30 * time.Second
+	// minimum uptime for a service to be considered stable after a restart
+	serviceStableTime = 1 * time.Minute
+)
+
+// Service states
+const (
+	ServiceStopped    = "stopped"
+	ServiceRunning    = "running"
+	ServiceRestarting = "restarting"
+)
+
+// ServeFunc represents a network daemon serving the argument listener, it must
+// return once the argument context is canceled (for graceful shutdown) or the
+// listener is closed.
+type ServeFunc func(ctx context.Context, l net.Listener) error
+
+// PacketServeFunc represents a datagram network daemon serving the argument
+// connection, it must return once the argument context is canceled or the
+// connection is closed.
+type PacketServeFunc func(ctx context.Context, conn net.PacketConn) error
+
+// Service represents a network daemon supervised by the service manager.
+type Service struct {
+	// Name is the service identifier
+	Name string
+	// Port is the TCP (or UDP, for ServePacket) listening port
+	Port uint16
+	// Interface is the name of the network interface the service is bound
+	// to, the interface hooked into the Go runtime is used when empty.
+	Interface string
+	// DNSSD is the optional DNS-SD service type advertised when running
+	DNSSD string
+
+	// Serve is the daemon service function
+	Serve ServeFunc
+	// ServePacket is the datagram daemon service function, used in place
+	// of Serve for UDP services.
+	ServePacket PacketServeFunc
+
+	sync.Mutex
+
+	state    string
+	listener io.Closer
+	cancel   context.CancelFunc
+	done     chan struct{}
+	started  time.Time
+	restarts int
+	lastErr  error
+}
+
+var (
+	serviceMutex sync.Mutex
+	daemons      = make(map[string]*Service)
+)
+
+// serviceInterfaceKey is the context key holding the name of the network
+// interface a service is bound to.
+type serviceInterfaceKey struct{}
+
+// serviceInterface returns the name of the network interface bound to the
+// service serving the argument context.
+func serviceInterface(ctx context.Context) string {
+	name, _ := ctx.Value(serviceInterfaceKey{}).(string)
+	return interfaceName(name)
+}
+
+// serviceListener wraps a gVisor TCP listener to unblock pending Accept calls
+// on Close.
+type serviceListener struct {
+	*gonet.TCPListener
+}
+
+func (l *serviceListener) Close() error {
+	l.TCPListener.Shutdown()
+	return l.TCPListener.Close()
+}
+
+// RegisterService adds a service to the service manager, the service is not
+// started.
+func RegisterService(s *Service) (err error) {
+	serviceMutex.Lock()
+	defer serviceMutex.Unlock()
+
+	if _, ok := daemons[s.Name]; ok {
+		return fmt.Errorf("service %s already registered", s.Name)
+	}
+
+	s.state = ServiceStopped
+	daemons[s.Name] = s
+
+	return
+}
+
+func lookupService(name string) (s *Service, err error) {
+	serviceMutex.Lock()
+	defer serviceMutex.Unlock()
+
+	if s = daemons[name]; s == nil {
+		return nil, fmt.Errorf("unknown service %s", name)
+	}
+
+	return
+}
+
+func interfaceName(name string) string {
+	if len(name) == 0 {
+		return defaultInterface
+	}
+
+	return name
+}
+
+func listenTCP(name string, port uint16) (l net.Listener, err error) {
+	iface, ok := Interfaces[name]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown interface %s", name)
+	}
+
+	stack, nicID, err := gvisor(iface)
+
+	if err != nil {
+		return
+	}
+
+	addr := tcpip.FullAddress{
+		NIC:  nicID,
+		Port: port,
+	}
+
+	listener, err := gonet.ListenTCP(stack, addr, ipv4.ProtocolNumber)
+
+	if err != nil {
+		return
+	}
+
+	return &serviceListener{listener}, nil
+}
+
+func listenUDP(name string, port uint16) (conn net.PacketConn, err error) {
+	iface, ok := Interfaces[name]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown interface %s", name)
+	}
+
+	stack, nicID, err := gvisor(iface)
+
+	if err != nil {
+		return
+	}
+
+	addr := &tcpip.FullAddress{
+		NIC:  nicID,
+		Port: port,
+	}
+
+	return gonet.DialUDP(stack, addr, nil, ipv4.ProtocolNumber)
+}
+
+// listen returns the service listener (or datagram connection), filtered by
+// the service firewall.
+func (s *Service) listen(iface string, port uint16) (l io.Closer, err error) {
+	if s.ServePacket != nil {
+		conn, err := listenUDP(iface, port)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return newFirewallPacketConn(s.Name, iface, conn), nil
+	}
+
+	listener, err := listenTCP(iface, port)
+
+	if err != nil {
+		return
+	}
+
+	return newFirewallListener(s.Name, iface, listener), nil
+}
+
+func (s *Service) setState(state string, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.state = state
+
+	if err != nil {
+		s.lastErr = err
+	}
+}
+
+// serve runs the service function, recovering from any panic.
+func (s *Service) serve(ctx context.Context, l io.Closer) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic, %v", r)
+		}
+	}()
+
+	if conn, ok := l.(net.PacketConn); ok {
+		return s.ServePacket(ctx, conn)
+	}
+
+	return s.Serve(ctx, l.(net.Listener))
+}
+
+// supervise runs the service until its context is canceled, restarting it
+// with exponential backoff whenever it fails.
+func (s *Service) supervise(ctx context.Context, done chan struct{}) {
+	var backoff time.Duration
+
+	defer close(done)
+
+	for {
+		var uptime time.Duration
+
+		s.Lock()
+		iface := interfaceName(s.Interface)
+		port := s.Port
+		s.Unlock()
+
+		l, err := s.listen(iface, port)
+
+		if err == nil {
+			start := time.Now()
+
+			s.Lock()
+			s.listener = l
+			s.started = start
+			s.state = ServiceRunning
+			s.Unlock()
+
+			if len(s.DNSSD) > 0 {
+				Advertise(s.DNSSD, port)
+			}
+
+			log.Printf("service %s started on port %d", s.Name, port)
+
+			err = s.serve(context.WithValue(ctx, serviceInterfaceKey{}, iface), l)
+			uptime = time.Since(start)
+			l.Close()
+
+			if len(s.DNSSD) > 0 {
+				Withdraw(s.DNSSD)
+			}
+		}
+
+		if ctx.Err() != nil {
+			s.setState(ServiceStopped, nil)
+			return
+		}
+
+		if err == nil {
+			err = errors.New("returned unexpectedly")
+		}
+
+		log.Printf("service %s failed, %v", s.Name, err)
+
+		s.Lock()
+		s.state = ServiceRestarting
+		s.lastErr = err
+		s.restarts += 1
+		s.Unlock()
+
+		if uptime > serviceStableTime {
+			backoff = 0
+		}
+
+		backoff = min(max(2*backoff, time.Second), serviceMaxBackoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			s.setState(ServiceStopped, nil)
+			return
+		}
+	}
+}
+
+func (s *Service) start() (err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.cancel != nil {
+		return fmt.Errorf("service %s already started", s.Name)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.lastErr = nil
+
+	go s.supervise(ctx, s.done)
+
+	return
+}
+
+func (s *Service) stop() (err error) {
+	s.Lock()
+	cancel := s.cancel
+	done := s.done
+	listener := s.listener
+	s.Unlock()
+
+	if cancel == nil {
+		return fmt.Errorf("service %s not started", s.Name)
+	}
+
+	// give the service a chance to shutdown gracefully, before forcing
+	// its listener closure
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(ShutdownTimeout):
+		if listener != nil {
+			listener.Close()
+		}
+
+		<-done
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.cancel = nil
+	s.listener = nil
+
+	log.Printf("service %s stopped", s.Name)
+
+	return
+}
+
+func startService(s *Service) (err error) {
+	if err = RegisterService(s); err != nil {
+		return
+	}
+
+	return s.start()
+}
+
+func startSSHService(name string, iface string, console *shell.Interface) (err error) {
+	serve, err := SSHServer(console)
+
+	if err != nil {
+		return
+	}
+
+	s := &Service{
+		Name:      name,
+		Port:      22,
+		Interface: iface,
+		Serve:     serve,
+	}
+
+	// DNS-SD records are only advertised for the default interface
+	if len(iface) == 0 {
+		s.DNSSD = "_ssh._tcp"
+	}
+
+	return startService(s)
+}
+
+// StartService starts a registered service.
+func StartService(name string) (err error) {
+	s, err := lookupService(name)
+
+	if err != nil {
+		return
+	}
+
+	return s.start()
+}
+
+// StopService gracefully stops a registered service.
+func StopService(name string) (err error) {
+	s, err := lookupService(name)
+
+	if err != nil {
+		return
+	}
+
+	return s.stop()
+}
+
+// RestartService stops, if running, and starts a registered service.
+func RestartService(name string) (err error) {
+	s, err := lookupService(name)
+
+	if err != nil {
+		return
+	}
+
+	s.stop()
+
+	return s.start()
+}
+
+// BindService changes the port and interface of a registered service, a
+// running service is restarted to apply the change.
+func BindService(name string, iface string, port uint16) (err error) {
+	s, err := lookupService(name)
+
+	if err != nil {
+		return
+	}
+
+	if _, ok := Interfaces[iface]; len(iface) > 0 && !ok {
+		return fmt.Errorf("unknown interface %s", iface)
+	}
+
+	s.Lock()
+	running := s.cancel != nil
+	s.Interface = iface
+	s.Port = port
+	s.Unlock()
+
+	if !running {
+		return
+	}
+
+	return RestartService(name)
+}
+
+// ServiceStatus represents the status of a registered service.
+type ServiceStatus struct {
+	Name      string        `json:"name"`
+	Interface string        `json:"interface"`
+	Port      uint16        `json:"port"`
+	State     string        `json:"state"`
+	Uptime    time.Duration `json:"uptime_ns"`
+	Restarts  int           `json:"restarts"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+// ServiceList returns the status of all registered services, sorted by name.
+func ServiceList() (list []ServiceStatus) {
+	var names []string
+
+	serviceMutex.Lock()
+
+	for name := range daemons {
+		names = append(names, name)
+	}
+
+	serviceMutex.Unlock()
+
+	slices.Sort(names)
+
+	for _, name := range names {
+		s, _ := lookupService(name)
+
+		s.Lock()
+
+		st := ServiceStatus{
+			Name:      s.Name,
+			Interface: interfaceName(s.Interface),
+			Port:      s.Port,
+			State:     s.state,
+			Restarts:  s.restarts,
+		}
+
+		if s.state == ServiceRunning {
+			st.Uptime = time.Since(s.started)
+		}
+
+		if s.lastErr != nil {
+			st.LastError = s.lastErr.Error()
+		}
+
+		s.Unlock()
+
+		list = append(list, st)
+	}
+
+	return
+}
+
+// Services returns the status of all registered services.
+func Services() string {
+	var buf bytes.Buffer
+
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Name\tInterface\tPort\tState\tUptime\tRestarts\tLast error\n")
+
+	for _, s := range ServiceList() {
+		uptime := "-"
+		lastErr := "-"
+
+		if s.State == ServiceRunning {
+			uptime = s.Uptime.Truncate(time.Second).String()
+		}
+
+		if s.LastError != "" {
+			lastErr = s.LastError
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%d\t%s\n", s.Name, s.Interface, s.Port, s.State, uptime, s.Restarts, lastErr)
+	}
+
+	w.Flush()
+
+	return buf.String()
+}
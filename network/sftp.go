@@ -0,0 +1,783 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// SFTP protocol version 3
+// (https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02)
+const sftpVersion = 3
+
+// SFTP packet types
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpRead     = 5
+	sshFxpWrite    = 6
+	sshFxpLstat    = 7
+	sshFxpFstat    = 8
+	sshFxpSetstat  = 9
+	sshFxpFsetstat = 10
+	sshFxpOpendir  = 11
+	sshFxpReaddir  = 12
+	sshFxpRemove   = 13
+	sshFxpMkdir    = 14
+	sshFxpRmdir    = 15
+	sshFxpRealpath = 16
+	sshFxpStat     = 17
+	sshFxpRename   = 18
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpData     = 103
+	sshFxpName     = 104
+	sshFxpAttrs    = 105
+)
+
+// SFTP status codes
+const (
+	sshFxOK               = 0
+	sshFxEOF              = 1
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxFailure          = 4
+	sshFxBadMessage       = 5
+	sshFxOpUnsupported    = 8
+)
+
+// SFTP file attribute flags
+const (
+	sshFileXferAttrSize        = 0x00000001
+	sshFileXferAttrUIDGID      = 0x00000002
+	sshFileXferAttrPermissions = 0x00000004
+	sshFileXferAttrACModTime   = 0x00000008
+	sshFileXferAttrExtended    = 0x80000000
+)
+
+// SFTP open flags
+const (
+	sshFxfRead   = 0x00000001
+	sshFxfWrite  = 0x00000002
+	sshFxfAppend = 0x00000004
+	sshFxfCreat  = 0x00000008
+	sshFxfTrunc  = 0x00000010
+	sshFxfExcl   = 0x00000020
+)
+
+const (
+	// maximum packet size, large enough for 256 KiB writes
+	sftpMaxPacket = 256*1024 + 1024
+	// maximum read size
+	sftpMaxRead = 256 * 1024
+	// maximum number of open handles per session
+	sftpMaxHandles = 64
+	// maximum number of directory entries per SSH_FXP_NAME
+	sftpMaxEntries = 64
+)
+
+var errBadMessage = errors.New("bad message")
+
+// sftpAttrs represents SFTP file attributes.
+type sftpAttrs struct {
+	flags uint32
+	size  uint64
+	uid   uint32
+	gid   uint32
+	perm  uint32
+	atime uint32
+	mtime uint32
+}
+
+// sftpHandle represents an open file or directory.
+type sftpHandle struct {
+	file   *os.File
+	append bool
+	// directory entries have been returned
+	done bool
+}
+
+type sftpServer struct {
+	rw       io.ReadWriter
+	readOnly bool
+
+	handles map[string]*sftpHandle
+	next    uint64
+}
+
+// sftpPacket represents an incoming SFTP packet payload.
+type sftpPacket struct {
+	buf []byte
+	err error
+}
+
+func (p *sftpPacket) byte() (v byte) {
+	if len(p.buf) < 1 {
+		p.err = errBadMessage
+		return
+	}
+
+	v, p.buf = p.buf[0], p.buf[1:]
+
+	return
+}
+
+func (p *sftpPacket) uint32() (v uint32) {
+	if len(p.buf) < 4 {
+		p.err = errBadMessage
+		return
+	}
+
+	v, p.buf = binary.BigEndian.Uint32(p.buf), p.buf[4:]
+
+	return
+}
+
+func (p *sftpPacket) uint64() (v uint64) {
+	if len(p.buf) < 8 {
+		p.err = errBadMessage
+		return
+	}
+
+	v, p.buf = binary.BigEndian.Uint64(p.buf), p.buf[8:]
+
+	return
+}
+
+func (p *sftpPacket) bytes() (v []byte) {
+	n := p.uint32()
+
+	if p.err != nil || uint32(len(p.buf)) < n {
+		p.err = errBadMessage
+		return
+	}
+
+	v, p.buf = p.buf[:n], p.buf[n:]
+
+	return
+}
+
+func (p *sftpPacket) string() string {
+	return string(p.bytes())
+}
+
+func (p *sftpPacket) attrs() (a sftpAttrs) {
+	a.flags = p.uint32()
+
+	if a.flags&sshFileXferAttrSize != 0 {
+		a.size = p.uint64()
+	}
+
+	if a.flags&sshFileXferAttrUIDGID != 0 {
+		a.uid = p.uint32()
+		a.gid = p.uint32()
+	}
+
+	if a.flags&sshFileXferAttrPermissions != 0 {
+		a.perm = p.uint32()
+	}
+
+	if a.flags&sshFileXferAttrACModTime != 0 {
+		a.atime = p.uint32()
+		a.mtime = p.uint32()
+	}
+
+	if a.flags&sshFileXferAttrExtended != 0 {
+		n := p.uint32()
+
+		for i := uint32(0); i < n && p.err == nil; i++ {
+			p.bytes()
+			p.bytes()
+		}
+	}
+
+	return
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func appendAttrs(b []byte, fi fs.FileInfo) []byte {
+	mode := uint32(fi.Mode().Perm())
+
+	// POSIX file type bits
+	switch {
+	case fi.IsDir():
+		mode |= 0040000
+	case fi.Mode()&fs.ModeSymlink != 0:
+		mode |= 0120000
+	default:
+		mode |= 0100000
+	}
+
+	mtime := uint32(fi.ModTime().Unix())
+
+	b = binary.BigEndian.AppendUint32(b, sshFileXferAttrSize|sshFileXferAttrUIDGID|sshFileXferAttrPermissions|sshFileXferAttrACModTime)
+	b = binary.BigEndian.AppendUint64(b, uint64(fi.Size()))
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, mode)
+	b = binary.BigEndian.AppendUint32(b, mtime)
+	b = binary.BigEndian.AppendUint32(b, mtime)
+
+	return b
+}
+
+// longName returns an `ls -l` style directory entry.
+func longName(fi fs.FileInfo) string {
+	return fmt.Sprintf("%s %4d %-8d %-8d %8d %s %s", fi.Mode(), 1, 0, 0, fi.Size(),
+		fi.ModTime().Format("Jan _2 15:04"), fi.Name())
+}
+
+// sftpPath resolves the argument path, relative paths are relative to the
+// filesystem root.
+func sftpPath(p string) (string, error) {
+	p = path.Clean("/" + p)
+
+	// ACME account and certificate keys, as well as SSH authorized keys,
+	// are never served or modified
+	if PrivatePath(p) {
+		return "", os.ErrPermission
+	}
+
+	return p, nil
+}
+
+func (s *sftpServer) send(typ byte, id uint32, payload []byte) (err error) {
+	buf := make([]byte, 0, 9+len(payload))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(5+len(payload)))
+	buf = append(buf, typ)
+	buf = binary.BigEndian.AppendUint32(buf, id)
+	buf = append(buf, payload...)
+
+	_, err = s.rw.Write(buf)
+
+	return
+}
+
+func (s *sftpServer) status(id uint32, err error) error {
+	code := uint32(sshFxOK)
+	msg := "OK"
+
+	switch {
+	case err == nil:
+	case errors.Is(err, io.EOF):
+		code = sshFxEOF
+		msg = "EOF"
+	case errors.Is(err, fs.ErrNotExist):
+		code = sshFxNoSuchFile
+		msg = "no such file"
+	case errors.Is(err, fs.ErrPermission):
+		code = sshFxPermissionDenied
+		msg = "permission denied"
+	case errors.Is(err, errBadMessage):
+		code = sshFxBadMessage
+		msg = err.Error()
+	case errors.Is(err, errors.ErrUnsupported):
+		code = sshFxOpUnsupported
+		msg = "operation unsupported"
+	default:
+		code = sshFxFailure
+		msg = err.Error()
+	}
+
+	b := binary.BigEndian.AppendUint32(nil, code)
+	b = appendString(b, msg)
+	b = appendString(b, "")
+
+	return s.send(sshFxpStatus, id, b)
+}
+
+func (s *sftpServer) handle(h string) (*sftpHandle, error) {
+	if f, ok := s.handles[h]; ok {
+		return f, nil
+	}
+
+	return nil, errors.New("invalid handle")
+}
+
+func (s *sftpServer) open(id uint32, f *os.File, append bool) error {
+	if len(s.handles) >= sftpMaxHandles {
+		f.Close()
+		return s.status(id, errors.New("too many open handles"))
+	}
+
+	h := strconv.FormatUint(s.next, 16)
+	s.next++
+	s.handles[h] = &sftpHandle{file: f, append: append}
+
+	return s.send(sshFxpHandle, id, appendString(nil, h))
+}
+
+func (s *sftpServer) setstat(p string, f *os.File, a sftpAttrs) (err error) {
+	if a.flags&sshFileXferAttrSize != 0 {
+		if f != nil {
+			err = f.Truncate(int64(a.size))
+		} else {
+			err = os.Truncate(p, int64(a.size))
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	if a.flags&sshFileXferAttrPermissions != 0 {
+		if err = os.Chmod(p, fs.FileMode(a.perm).Perm()); err != nil {
+			return
+		}
+	}
+
+	if a.flags&sshFileXferAttrACModTime != 0 {
+		err = os.Chtimes(p, time.Unix(int64(a.atime), 0), time.Unix(int64(a.mtime), 0))
+	}
+
+	return
+}
+
+func (s *sftpServer) name(id uint32, p string, fi fs.FileInfo) error {
+	b := binary.BigEndian.AppendUint32(nil, 1)
+	b = appendString(b, p)
+
+	if fi != nil {
+		b = appendString(b, longName(fi))
+		b = appendAttrs(b, fi)
+	} else {
+		b = appendString(b, p)
+		b = binary.BigEndian.AppendUint32(b, 0)
+	}
+
+	return s.send(sshFxpName, id, b)
+}
+
+func (s *sftpServer) readdir(id uint32, h *sftpHandle) error {
+	if h.done {
+		return s.status(id, io.EOF)
+	}
+
+	entries, err := h.file.ReadDir(sftpMaxEntries)
+
+	if len(entries) == 0 {
+		h.done = true
+
+		if err == nil {
+			err = io.EOF
+		}
+
+		return s.status(id, err)
+	}
+
+	var n uint32
+	var b []byte
+
+	for _, e := range entries {
+		if PrivatePath(path.Join(h.file.Name(), e.Name())) {
+			continue
+		}
+
+		fi, err := e.Info()
+
+		if err != nil {
+			continue
+		}
+
+		b = appendString(b, fi.Name())
+		b = appendString(b, longName(fi))
+		b = appendAttrs(b, fi)
+		n++
+	}
+
+	return s.send(sshFxpName, id, append(binary.BigEndian.AppendUint32(nil, n), b...))
+}
+
+func (s *sftpServer) request(typ byte, id uint32, p *sftpPacket) error {
+	if s.readOnly {
+		switch typ {
+		case sshFxpWrite, sshFxpSetstat, sshFxpFsetstat, sshFxpRemove,
+			sshFxpRmdir, sshFxpMkdir, sshFxpRename:
+			return s.status(id, fs.ErrPermission)
+		}
+	}
+
+	switch typ {
+	case sshFxpOpen:
+		name := p.string()
+		pflags := p.uint32()
+		a := p.attrs()
+
+		if p.err != nil {
+			return s.status(id, p.err)
+		}
+
+		name, err := sftpPath(name)
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		if s.readOnly && pflags&(sshFxfWrite|sshFxfAppend|sshFxfCreat|sshFxfTrunc) != 0 {
+			return s.status(id, fs.ErrPermission)
+		}
+
+		var flag int
+
+		switch {
+		case pflags&sshFxfRead != 0 && pflags&sshFxfWrite != 0:
+			flag = os.O_RDWR
+		case pflags&sshFxfWrite != 0:
+			flag = os.O_WRONLY
+		default:
+			flag = os.O_RDONLY
+		}
+
+		if pflags&sshFxfAppend != 0 {
+			flag |= os.O_APPEND
+		}
+
+		if pflags&sshFxfCreat != 0 {
+			flag |= os.O_CREATE
+		}
+
+		if pflags&sshFxfTrunc != 0 {
+			flag |= os.O_TRUNC
+		}
+
+		if pflags&sshFxfExcl != 0 {
+			flag |= os.O_EXCL
+		}
+
+		perm := fs.FileMode(0600)
+
+		if a.flags&sshFileXferAttrPermissions != 0 {
+			perm = fs.FileMode(a.perm).Perm()
+		}
+
+		f, err := os.OpenFile(name, flag, perm)
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		return s.open(id, f, flag&os.O_APPEND != 0)
+	case sshFxpOpendir:
+		name, err := sftpPath(p.string())
+
+		if p.err != nil {
+			return s.status(id, p.err)
+		}
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		f, err := os.Open(name)
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		if fi, err := f.Stat(); err != nil || !fi.IsDir() {
+			f.Close()
+			return s.status(id, fmt.Errorf("%s is not a directory", name))
+		}
+
+		return s.open(id, f, false)
+	case sshFxpClose:
+		h := p.string()
+		f, err := s.handle(h)
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		delete(s.handles, h)
+
+		return s.status(id, f.file.Close())
+	case sshFxpRead:
+		h := p.string()
+		off := p.uint64()
+		n := min(p.uint32(), sftpMaxRead)
+
+		if p.err != nil {
+			return s.status(id, p.err)
+		}
+
+		f, err := s.handle(h)
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		buf := make([]byte, n)
+		read, err := f.file.ReadAt(buf, int64(off))
+
+		if read == 0 && err != nil {
+			return s.status(id, err)
+		}
+
+		return s.send(sshFxpData, id, appendString(nil, string(buf[:read])))
+	case sshFxpWrite:
+		h := p.string()
+		off := p.uint64()
+		data := p.bytes()
+
+		if p.err != nil {
+			return s.status(id, p.err)
+		}
+
+		f, err := s.handle(h)
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		// offsets are ignored on files opened for appending
+		if f.append {
+			_, err = f.file.Write(data)
+		} else {
+			_, err = f.file.WriteAt(data, int64(off))
+		}
+
+		return s.status(id, err)
+	case sshFxpLstat, sshFxpStat:
+		name, err := sftpPath(p.string())
+
+		if p.err != nil {
+			return s.status(id, p.err)
+		}
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		var fi fs.FileInfo
+
+		if typ == sshFxpLstat {
+			fi, err = os.Lstat(name)
+		} else {
+			fi, err = os.Stat(name)
+		}
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		return s.send(sshFxpAttrs, id, appendAttrs(nil, fi))
+	case sshFxpFstat:
+		f, err := s.handle(p.string())
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		fi, err := f.file.Stat()
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		return s.send(sshFxpAttrs, id, appendAttrs(nil, fi))
+	case sshFxpSetstat:
+		name, err := sftpPath(p.string())
+		a := p.attrs()
+
+		if p.err != nil {
+			return s.status(id, p.err)
+		}
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		return s.status(id, s.setstat(name, nil, a))
+	case sshFxpFsetstat:
+		f, err := s.handle(p.string())
+		a := p.attrs()
+
+		if p.err != nil {
+			return s.status(id, p.err)
+		}
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		return s.status(id, s.setstat(f.file.Name(), f.file, a))
+	case sshFxpReaddir:
+		f, err := s.handle(p.string())
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		return s.readdir(id, f)
+	case sshFxpRemove, sshFxpRmdir:
+		name, err := sftpPath(p.string())
+
+		if p.err != nil {
+			return s.status(id, p.err)
+		}
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		if name == "/" {
+			return s.status(id, fs.ErrPermission)
+		}
+
+		fi, err := os.Lstat(name)
+
+		switch {
+		case err != nil:
+		case typ == sshFxpRemove && fi.IsDir():
+			err = fmt.Errorf("%s is a directory", name)
+		case typ == sshFxpRmdir && !fi.IsDir():
+			err = fmt.Errorf("%s is not a directory", name)
+		default:
+			err = os.Remove(name)
+		}
+
+		return s.status(id, err)
+	case sshFxpMkdir:
+		name, err := sftpPath(p.string())
+		a := p.attrs()
+
+		if p.err != nil {
+			return s.status(id, p.err)
+		}
+
+		if err != nil {
+			return s.status(id, err)
+		}
+
+		perm := fs.FileMode(0700)
+
+		if a.flags&sshFileXferAttrPermissions != 0 {
+			perm = fs.FileMode(a.perm).Perm()
+		}
+
+		return s.status(id, os.Mkdir(name, perm))
+	case sshFxpRealpath:
+		name := path.Clean("/" + p.string())
+
+		if p.err != nil {
+			return s.status(id, p.err)
+		}
+
+		return s.name(id, name, nil)
+	case sshFxpRename:
+		oldName, err1 := sftpPath(p.string())
+		newName, err2 := sftpPath(p.string())
+
+		if p.err != nil {
+			return s.status(id, p.err)
+		}
+
+		if err := errors.Join(err1, err2); err != nil {
+			return s.status(id, err)
+		}
+
+		// SFTPv3 renames do not overwrite existing files
+		if _, err := os.Lstat(newName); err == nil {
+			return s.status(id, fs.ErrExist)
+		}
+
+		return s.status(id, os.Rename(oldName, newName))
+	}
+
+	// symbolic links and extensions are not supported
+	return s.status(id, errors.ErrUnsupported)
+}
+
+func (s *sftpServer) read() (*sftpPacket, error) {
+	var hdr [4]byte
+
+	if _, err := io.ReadFull(s.rw, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[:])
+
+	if n == 0 || n > sftpMaxPacket {
+		return nil, fmt.Errorf("invalid packet length %d", n)
+	}
+
+	buf := make([]byte, n)
+
+	if _, err := io.ReadFull(s.rw, buf); err != nil {
+		return nil, err
+	}
+
+	return &sftpPacket{buf: buf}, nil
+}
+
+// serveSFTP serves the SFTP protocol, on the root filesystem, over the
+// argument connection, optionally restricted to read operations.
+func serveSFTP(rw io.ReadWriter, readOnly bool) (err error) {
+	s := &sftpServer{
+		rw:       rw,
+		readOnly: readOnly,
+		handles:  make(map[string]*sftpHandle),
+	}
+
+	defer func() {
+		for _, h := range s.handles {
+			h.file.Close()
+		}
+	}()
+
+	p, err := s.read()
+
+	if err != nil {
+		return
+	}
+
+	if typ := p.byte(); typ != sshFxpInit {
+		return fmt.Errorf("unexpected packet type %d", typ)
+	}
+
+	// the version takes the place of the request identifier, no
+	// extensions are advertised
+	if err = s.send(sshFxpVersion, sftpVersion, nil); err != nil {
+		return
+	}
+
+	for {
+		if p, err = s.read(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return
+		}
+
+		typ := p.byte()
+		id := p.uint32()
+
+		if p.err != nil {
+			return p.err
+		}
+
+		if err = s.request(typ, id, p); err != nil {
+			log.Printf("sftp: %v", err)
+			return
+		}
+	}
+}
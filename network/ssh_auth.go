@@ -0,0 +1,522 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHPrivilege represents the privilege level of an SSH session.
+type SSHPrivilege int
+
+const (
+	// SSHDenied denies access.
+	SSHDenied SSHPrivilege = iota
+	// SSHReadOnly allows SSHReadOnlyCommands and file downloads.
+	SSHReadOnly
+	// SSHAdmin allows all commands and file transfers.
+	SSHAdmin
+)
+
+var sshPrivileges = map[SSHPrivilege]string{
+	SSHDenied:   "deny",
+	SSHReadOnly: "readonly",
+	SSHAdmin:    "admin",
+}
+
+func (p SSHPrivilege) String() string {
+	return sshPrivileges[p]
+}
+
+// ParseSSHPrivilege returns the privilege level for the argument name.
+func ParseSSHPrivilege(name string) (SSHPrivilege, error) {
+	for p, s := range sshPrivileges {
+		if s == name {
+			return p, nil
+		}
+	}
+
+	return SSHDenied, fmt.Errorf("invalid privilege level %q", name)
+}
+
+// SSHAuthorizedKeysPath represents the OpenSSH authorized_keys file, read on
+// each authentication attempt, which complements the keys set with
+// SetSSHAuthorizedKeys.
+//
+// Besides plain keys, `cert-authority` entries are supported to authorize
+// user certificates. The `principals` option binds plain keys to principals,
+// and restricts those accepted from certificates, see SetSSHPrincipal.
+var SSHAuthorizedKeysPath = "/.ssh/authorized_keys"
+
+// SSHReadOnlyCommands represents the console commands allowed with
+// SSHReadOnly privilege.
+var SSHReadOnlyCommands = []string{
+	"build",
+	"dns",
+	"exit, quit",
+	"help",
+	"info",
+	"ls",
+	"netstat",
+	"ping",
+	"uptime",
+}
+
+// SSHMaxAuthFailures represents the number of failed password attempts,
+// from a remote host, which trigger its lockout for SSHLockoutTime (failures
+// older than SSHLockoutTime are forgotten).
+var (
+	SSHMaxAuthFailures = 5
+	SSHLockoutTime     = 5 * time.Minute
+)
+
+const (
+	// permissions extension for the session privilege level
+	sshPrivilegeExtension = "privilege@tamago"
+	// maximum number of remote hosts tracked for failed password attempts
+	sshMaxFailureHosts = 1024
+)
+
+var (
+	sshAuthMutex sync.Mutex
+
+	// authorized keys set at runtime (or build time)
+	sshAuthKeys []byte
+
+	// user certificate authorities
+	sshAuthCAs []ssh.PublicKey
+
+	// password authentication user and password hash
+	sshAuthUser string
+	sshAuthHash []byte
+
+	// principal to privilege level mapping, credentials without
+	// principals are granted the `*` level
+	sshPrincipals = map[string]SSHPrivilege{
+		"admin": SSHAdmin,
+		"*":     SSHReadOnly,
+	}
+
+	// failed password attempts by remote host
+	sshFailures = make(map[string]*sshFailure)
+)
+
+type sshFailure struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// expired returns whether the failure entry no longer affects its host.
+func (f *sshFailure) expired(now time.Time) bool {
+	if !f.until.IsZero() {
+		return now.After(f.until)
+	}
+
+	return now.Sub(f.last) > SSHLockoutTime
+}
+
+// purgeSSHFailures removes expired entries and, when still at capacity,
+// evicts the least recently failed one, must be called with sshAuthMutex
+// locked.
+func purgeSSHFailures(now time.Time) {
+	var oldest string
+
+	for host, f := range sshFailures {
+		if f.expired(now) {
+			delete(sshFailures, host)
+			continue
+		}
+
+		if len(oldest) == 0 || f.last.Before(sshFailures[oldest].last) {
+			oldest = host
+		}
+	}
+
+	if len(sshFailures) >= sshMaxFailureHosts {
+		delete(sshFailures, oldest)
+	}
+}
+
+// sshAuthorizedKey represents an authorized_keys entry.
+type sshAuthorizedKey struct {
+	key        ssh.PublicKey
+	authority  bool
+	principals []string
+}
+
+// SetSSHAuthorizedKeys sets the authorized keys, in OpenSSH authorized_keys
+// format, in addition to the ones in SSHAuthorizedKeysPath.
+func SetSSHAuthorizedKeys(buf []byte) (err error) {
+	if _, err = parseAuthorizedKeys(buf); err != nil {
+		return
+	}
+
+	sshAuthMutex.Lock()
+	defer sshAuthMutex.Unlock()
+
+	sshAuthKeys = buf
+
+	return
+}
+
+// SetSSHUserCAs sets the certificate authorities for OpenSSH user
+// certificates authentication, for any principal.
+func SetSSHUserCAs(keys []ssh.PublicKey) {
+	sshAuthMutex.Lock()
+	defer sshAuthMutex.Unlock()
+
+	sshAuthCAs = keys
+}
+
+// SetSSHPassword sets the password (and keyboard-interactive) authentication
+// credentials, an empty password disables this method.
+func SetSSHPassword(user string, password string) {
+	sshAuthMutex.Lock()
+	defer sshAuthMutex.Unlock()
+
+	if len(password) == 0 {
+		sshAuthUser = ""
+		sshAuthHash = nil
+		return
+	}
+
+	h := sha256.Sum256([]byte(password))
+	sshAuthUser = user
+	sshAuthHash = h[:]
+}
+
+// SetSSHPrincipal maps the argument principal to a privilege level.
+//
+// Principals are bound to credentials, as certificate principals, through the
+// `principals` option of authorized keys entries or as password user, the
+// client user name selects one of them. The `*` principal applies to
+// credentials without principals and to principals without a mapping
+// (read-only by default), `admin` is mapped to SSHAdmin by default.
+func SetSSHPrincipal(principal string, p SSHPrivilege) {
+	sshAuthMutex.Lock()
+	defer sshAuthMutex.Unlock()
+
+	sshPrincipals[principal] = p
+}
+
+// SSHAuthStatus returns the SSH server authentication configuration.
+func SSHAuthStatus() string {
+	var s strings.Builder
+
+	sshAuthMutex.Lock()
+	defer sshAuthMutex.Unlock()
+
+	keys, _ := parseAuthorizedKeys(sshAuthKeys)
+	fmt.Fprintf(&s, "authorized keys: %d\n", len(keys))
+
+	if buf, err := os.ReadFile(SSHAuthorizedKeysPath); err == nil {
+		keys, err = parseAuthorizedKeys(buf)
+		fmt.Fprintf(&s, "authorized keys (%s): %d", SSHAuthorizedKeysPath, len(keys))
+
+		if err != nil {
+			fmt.Fprintf(&s, " (%v)", err)
+		}
+
+		fmt.Fprintln(&s)
+	}
+
+	fmt.Fprintf(&s, "user certificate authorities: %d\n", len(sshAuthCAs))
+
+	for _, ca := range sshAuthCAs {
+		fmt.Fprintf(&s, "  %s\n", ssh.FingerprintSHA256(ca))
+	}
+
+	if sshAuthHash != nil {
+		fmt.Fprintf(&s, "password: user %s\n", sshAuthUser)
+	} else {
+		fmt.Fprintf(&s, "password: disabled\n")
+	}
+
+	var principals []string
+
+	for principal := range sshPrincipals {
+		principals = append(principals, principal)
+	}
+
+	sort.Strings(principals)
+
+	fmt.Fprintf(&s, "principals:")
+
+	for _, principal := range principals {
+		fmt.Fprintf(&s, " %s=%s", principal, sshPrincipals[principal])
+	}
+
+	return s.String()
+}
+
+// parseAuthorizedKeys parses entries in OpenSSH authorized_keys format,
+// entries with unsupported options are rejected as their restrictions cannot
+// be honored.
+func parseAuthorizedKeys(buf []byte) (keys []sshAuthorizedKey, err error) {
+	for i, line := range bytes.Split(buf, []byte("\n")) {
+		var k sshAuthorizedKey
+		var options []string
+
+		if line = bytes.TrimSpace(line); len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		if k.key, _, options, _, err = ssh.ParseAuthorizedKey(line); err != nil {
+			return nil, fmt.Errorf("line %d, %v", i+1, err)
+		}
+
+		supported := true
+
+		for _, opt := range options {
+			name, value, _ := strings.Cut(opt, "=")
+
+			switch strings.ToLower(name) {
+			case "cert-authority":
+				k.authority = true
+			case "principals":
+				k.principals = strings.Split(strings.Trim(value, `"`), ",")
+			default:
+				supported = false
+			}
+		}
+
+		if !supported {
+			log.Printf("ssh: skipping key on line %d, unsupported options", i+1)
+			continue
+		}
+
+		keys = append(keys, k)
+	}
+
+	return
+}
+
+// authorizedKeys returns all authorized_keys entries.
+func authorizedKeys() (keys []sshAuthorizedKey) {
+	sshAuthMutex.Lock()
+	keys, _ = parseAuthorizedKeys(sshAuthKeys)
+	cas := sshAuthCAs
+	sshAuthMutex.Unlock()
+
+	for _, ca := range cas {
+		keys = append(keys, sshAuthorizedKey{key: ca, authority: true})
+	}
+
+	buf, err := os.ReadFile(SSHAuthorizedKeysPath)
+
+	if err != nil {
+		return
+	}
+
+	fileKeys, err := parseAuthorizedKeys(buf)
+
+	if err != nil {
+		log.Printf("ssh: invalid %s, %v", SSHAuthorizedKeysPath, err)
+	}
+
+	return append(keys, fileKeys...)
+}
+
+// sshPermissions returns the session permissions for a credential bound to
+// the argument principals, among which the argument user name must be, a
+// credential without principals is granted the `*` privilege level.
+func sshPermissions(principals []string, user string) (*ssh.Permissions, error) {
+	principal := "*"
+
+	if len(principals) > 0 {
+		if !slices.Contains(principals, user) {
+			return nil, fmt.Errorf("user %s not among credential principals", user)
+		}
+
+		principal = user
+	}
+
+	sshAuthMutex.Lock()
+	p, ok := sshPrincipals[principal]
+
+	if !ok {
+		p = sshPrincipals["*"]
+	}
+	sshAuthMutex.Unlock()
+
+	if p == SSHDenied {
+		return nil, fmt.Errorf("principal %s denied", principal)
+	}
+
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			sshPrivilegeExtension: p.String(),
+		},
+	}, nil
+}
+
+// sshPrivilege returns the privilege level of an authenticated connection.
+func sshPrivilege(conn *ssh.ServerConn) SSHPrivilege {
+	if conn.Permissions == nil {
+		return SSHDenied
+	}
+
+	p, _ := ParseSSHPrivilege(conn.Permissions.Extensions[sshPrivilegeExtension])
+
+	return p
+}
+
+func publicKeyCallback(conn ssh.ConnMetadata, key ssh.PublicKey) (perm *ssh.Permissions, err error) {
+	keys := authorizedKeys()
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		checker := &ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				for _, k := range keys {
+					if !k.authority || !bytes.Equal(k.key.Marshal(), auth.Marshal()) {
+						continue
+					}
+
+					if k.principals == nil || slices.Contains(k.principals, conn.User()) {
+						return true
+					}
+				}
+
+				return false
+			},
+		}
+
+		// certificate validity and principals, matching the user name,
+		// are verified by the checker
+		if _, err = checker.Authenticate(conn, key); err != nil {
+			return
+		}
+
+		return sshPermissions(cert.ValidPrincipals, conn.User())
+	}
+
+	err = errors.New("unknown public key")
+
+	// the privilege level is bound to the key entry principals
+	for _, k := range keys {
+		if k.authority || !bytes.Equal(k.key.Marshal(), key.Marshal()) {
+			continue
+		}
+
+		if perm, err = sshPermissions(k.principals, conn.User()); err == nil {
+			return
+		}
+	}
+
+	return nil, err
+}
+
+// remoteHost returns the host of the argument connection remote address.
+func remoteHost(conn ssh.ConnMetadata) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
+
+func passwordCallback(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	host := remoteHost(conn)
+	now := time.Now()
+
+	sshAuthMutex.Lock()
+	user, hash := sshAuthUser, sshAuthHash
+	f := sshFailures[host]
+	locked := f != nil && now.Before(f.until)
+	sshAuthMutex.Unlock()
+
+	if locked {
+		return nil, fmt.Errorf("%s locked out", host)
+	}
+
+	if hash == nil {
+		return nil, errors.New("password authentication disabled")
+	}
+
+	h := sha256.Sum256(password)
+
+	// both comparisons are evaluated to avoid leaking valid user names
+	userOK := subtle.ConstantTimeCompare([]byte(conn.User()), []byte(user))
+	passOK := subtle.ConstantTimeCompare(h[:], hash)
+
+	if userOK&passOK == 1 {
+		sshAuthMutex.Lock()
+		delete(sshFailures, host)
+		sshAuthMutex.Unlock()
+
+		// the password is bound to its configured user
+		return sshPermissions([]string{user}, conn.User())
+	}
+
+	sshAuthMutex.Lock()
+	defer sshAuthMutex.Unlock()
+
+	// failures are counted afresh once a lockout expires
+	if f = sshFailures[host]; f == nil || f.expired(now) {
+		purgeSSHFailures(now)
+		f = &sshFailure{}
+		sshFailures[host] = f
+	}
+
+	f.last = now
+
+	if f.count += 1; f.count >= SSHMaxAuthFailures {
+		log.Printf("ssh: %s locked out for %v after %d failed attempts", host, SSHLockoutTime, f.count)
+		f.count = 0
+		f.until = now.Add(SSHLockoutTime)
+	}
+
+	return nil, errors.New("invalid credentials")
+}
+
+func keyboardInteractiveCallback(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	sshAuthMutex.Lock()
+	enabled := sshAuthHash != nil
+	sshAuthMutex.Unlock()
+
+	if !enabled {
+		return nil, errors.New("password authentication disabled")
+	}
+
+	answers, err := client(conn.User(), "", []string{"Password: "}, []bool{false})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(answers) != 1 {
+		return nil, errors.New("invalid answers")
+	}
+
+	return passwordCallback(conn, []byte(answers[0]))
+}
+
+// sshAuthConfig returns an SSH server configuration which authenticates
+// clients with authorized keys, user certificates or password.
+func sshAuthConfig() *ssh.ServerConfig {
+	return &ssh.ServerConfig{
+		PublicKeyCallback:           publicKeyCallback,
+		PasswordCallback:            passwordCallback,
+		KeyboardInteractiveCallback: keyboardInteractiveCallback,
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package network
+
+import (
+	"io"
+	"sync"
+)
+
+// sessionLog mirrors log messages to the registered session terminals.
+type sessionLog struct {
+	sync.Mutex
+	writers map[io.Writer]bool
+}
+
+var sessions = &sessionLog{
+	writers: make(map[io.Writer]bool),
+}
+
+// SessionLog is a log writer which mirrors messages to all active interactive
+// SSH sessions, meant to be combined with the other log outputs (e.g.
+// io.MultiWriter(os.Stdout, network.Syslog, network.SessionLog)).
+var SessionLog io.Writer = sessions
+
+// Write copies a log message to all registered sessions, write errors are
+// ignored as each session is removed on its termination.
+func (l *sessionLog) Write(buf []byte) (n int, err error) {
+	l.Lock()
+	defer l.Unlock()
+
+	for w := range l.writers {
+		w.Write(buf)
+	}
+
+	return len(buf), nil
+}
+
+func (l *sessionLog) add(w io.Writer) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.writers[w] = true
+}
+
+func (l *sessionLog) remove(w io.Writer) {
+	l.Lock()
+	defer l.Unlock()
+
+	delete(l.writers, w)
+}
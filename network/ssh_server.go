@@ -6,15 +6,16 @@
 package network
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -26,9 +27,13 @@ import (
 // DefaultDeadline represents the SSH server connection deadline.
 var DefaultDeadline = 30 * time.Second
 
+// number of active SSH connections
+var sshSessions atomic.Int64
+
 func handleTerminal(conn ssh.Channel, console *shell.Interface) {
-	log.SetOutput(io.MultiWriter(os.Stdout, console.Log, console.Terminal))
-	defer log.SetOutput(os.Stdout)
+	// mirror log messages to the session (see SessionLog)
+	sessions.add(console.Terminal)
+	defer sessions.remove(console.Terminal)
 
 	console.Start(true)
 
@@ -36,7 +41,98 @@ func handleTerminal(conn ssh.Channel, console *shell.Interface) {
 	conn.Close()
 }
 
-func handleChannel(newChannel ssh.NewChannel, console *shell.Interface) {
+// exitStatus sends the argument command exit status and closes the channel.
+func exitStatus(conn ssh.Channel, err error) {
+	var status uint32
+
+	if err != nil {
+		status = 1
+	}
+
+	// p13, 6.10.  Returning Exit Status, RFC4254
+	conn.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+	conn.Close()
+}
+
+// exitSignal sends the argument signal, which terminated a command, and closes
+// the channel.
+func exitSignal(conn ssh.Channel, signal string, msg string) {
+	// p13, 6.10.  Returning Exit Status, RFC4254
+	conn.SendRequest("exit-signal", false, ssh.Marshal(struct {
+		Signal     string
+		CoreDumped bool
+		Message    string
+		Language   string
+	}{signal, false, msg, ""}))
+	conn.Close()
+}
+
+// handleExec executes an individual command, its result is written on the
+// channel standard output (or on the terminal when a pseudo-terminal was
+// requested) and errors on its standard error.
+func handleExec(conn ssh.Channel, console *shell.Interface, cmd string, pty bool) {
+	c := *console
+
+	// standard input is available to commands which read it
+	c.ReadWriter = conn
+
+	if pty {
+		c.Output = c.Terminal
+	} else {
+		c.Output = conn
+		c.Terminal = nil
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("ssh command %q panic, %v", cmd, err)
+			exitSignal(conn, "ABRT", fmt.Sprintf("%v", err))
+		}
+	}()
+
+	res, err := c.Run(cmd)
+
+	if len(res) > 0 {
+		fmt.Fprintln(c.Output, res)
+	}
+
+	// the exit command (io.EOF) terminates successfully
+	if err == io.EOF {
+		err = nil
+	}
+
+	if err != nil {
+		fmt.Fprintf(conn.Stderr(), "command error, %v\n", err)
+	}
+
+	exitStatus(conn, err)
+}
+
+func handleSCP(conn ssh.Channel, args []string, readOnly bool) {
+	log.Printf("starting scp %s", strings.Join(args, " "))
+
+	err := serveSCP(conn, conn, args, readOnly)
+
+	if err != nil {
+		log.Printf("scp error, %v", err)
+	}
+
+	exitStatus(conn, err)
+}
+
+func handleSFTP(conn ssh.Channel, readOnly bool) {
+	log.Printf("starting sftp session")
+
+	err := serveSFTP(conn, readOnly)
+
+	if err != nil {
+		log.Printf("sftp error, %v", err)
+	}
+
+	exitStatus(conn, err)
+}
+
+func handleChannel(newChannel ssh.NewChannel, console *shell.Interface, readOnly bool) {
 	if t := newChannel.ChannelType(); t != "session" {
 		newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
 		return
@@ -49,18 +145,63 @@ func handleChannel(newChannel ssh.NewChannel, console *shell.Interface) {
 		return
 	}
 
-	console.Terminal = term.NewTerminal(conn, "")
+	// each channel is served by its own session
+	c := *console
+	c.Terminal = term.NewTerminal(conn, "")
+	console = &c
 
 	go func() {
+		var pty, started bool
+
 		for req := range requests {
 			reqSize := len(req.Payload)
 
+			switch req.Type {
+			case "exec", "subsystem", "shell":
+				// p10, 6.5.  Starting a Shell or a Command, RFC4254
+				if started {
+					req.Reply(false, nil)
+					continue
+				}
+			}
+
 			switch req.Type {
 			case "exec":
-				console.Exec(req.Payload[4:])
-				conn.Close()
-				return
+				var exec struct {
+					Command string
+				}
+
+				if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+					log.Printf("malformed exec request")
+					req.Reply(false, nil)
+					continue
+				}
+
+				started = true
+				req.Reply(true, nil)
+
+				// legacy SCP transfers
+				if args := strings.Fields(exec.Command); len(args) > 0 && args[0] == "scp" {
+					go handleSCP(conn, args[1:], readOnly)
+					continue
+				}
+
+				go handleExec(conn, console, exec.Command, pty)
+			case "subsystem":
+				var subsystem struct {
+					Name string
+				}
+
+				if err := ssh.Unmarshal(req.Payload, &subsystem); err != nil || subsystem.Name != "sftp" {
+					req.Reply(false, nil)
+					continue
+				}
+
+				started = true
+				req.Reply(true, nil)
+				go handleSFTP(conn, readOnly)
 			case "shell":
+				started = true
 				go handleTerminal(conn, console)
 				req.Reply(true, nil)
 			case "pty-req":
@@ -81,6 +222,7 @@ func handleChannel(newChannel ssh.NewChannel, console *shell.Interface) {
 				h := binary.BigEndian.Uint32(req.Payload[4+termVariableSize+4:])
 
 				console.Terminal.SetSize(int(w), int(h))
+				pty = true
 
 				req.Reply(true, nil)
 			case "window-change":
@@ -99,9 +241,9 @@ func handleChannel(newChannel ssh.NewChannel, console *shell.Interface) {
 	}()
 }
 
-func handleChannels(chans <-chan ssh.NewChannel, console *shell.Interface) {
+func handleChannels(chans <-chan ssh.NewChannel, console *shell.Interface, readOnly bool) {
 	for newChannel := range chans {
-		go handleChannel(newChannel, console)
+		go handleChannel(newChannel, console, readOnly)
 	}
 }
 
@@ -116,17 +258,45 @@ func handleConn(conn net.Conn, console *shell.Interface, srv *ssh.ServerConfig)
 	// remove timeout
 	conn.SetDeadline(time.Time{})
 
-	log.Printf("new ssh connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
+	privilege := sshPrivilege(sshConn)
+
+	log.Printf("new ssh connection from %s (%s), user %s (%s)",
+		sshConn.RemoteAddr(), sshConn.ClientVersion(), sshConn.User(), privilege)
+
+	// each connection has its own console, restricted according to its
+	// privilege level
+	c := *console
+
+	if privilege != SSHAdmin {
+		c.Allow = func(name string) bool {
+			return slices.Contains(SSHReadOnlyCommands, name)
+		}
+	}
+
+	sshSessions.Add(1)
+
+	go func() {
+		sshConn.Wait()
+		sshSessions.Add(-1)
+	}()
 
 	go ssh.DiscardRequests(reqs)
-	go handleChannels(chans, console)
+	go handleChannels(chans, &c, privilege != SSHAdmin)
 }
 
-func accept(listener net.Listener, console *shell.Interface, srv *ssh.ServerConfig) {
+func accept(ctx context.Context, listener net.Listener, console *shell.Interface, srv *ssh.ServerConfig) error {
 	for {
 		conn, err := listener.Accept()
 
+		if ctx.Err() != nil {
+			return nil
+		}
+
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
 			log.Printf("error accepting connection, %v", err)
 			continue
 		}
@@ -136,25 +306,50 @@ func accept(listener net.Listener, console *shell.Interface, srv *ssh.ServerConf
 	}
 }
 
-func StartSSHServer(listener net.Listener, console *shell.Interface) {
-	srv := &ssh.ServerConfig{
-		NoClientAuth: true,
-	}
+// SSHServer returns a service function serving the argument console over SSH,
+// with the device host key, to clients authenticated as configured with
+// SetSSHAuthorizedKeys, SetSSHUserCAs and SetSSHPassword.
+func SSHServer(console *shell.Interface) (serve func(context.Context, net.Listener) error, err error) {
+	srv := sshAuthConfig()
 
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer, err := SSHHostKey()
 
 	if err != nil {
-		log.Fatal("private key generation error: ", err)
+		return nil, fmt.Errorf("host key error, %v", err)
 	}
 
-	signer, err := ssh.NewSignerFromKey(key)
+	srv.AddHostKey(signer)
+
+	log.Printf("ssh server host key %s", ssh.FingerprintSHA256(signer.PublicKey()))
+
+	serve = func(ctx context.Context, listener net.Listener) error {
+		// unblock Accept on shutdown
+		stop := context.AfterFunc(ctx, func() {
+			listener.Close()
+		})
+		defer stop()
+
+		return accept(ctx, listener, console, srv)
+	}
+
+	return
+}
+
+// StartSSHServer starts an SSH server on the argument listener.
+func StartSSHServer(listener net.Listener, console *shell.Interface) (err error) {
+	serve, err := SSHServer(console)
 
 	if err != nil {
-		log.Fatal("key conversion error: ", err)
+		return
 	}
 
-	srv.AddHostKey(signer)
+	log.Printf("starting ssh server at %s", listener.Addr())
+
+	go func() {
+		if err := serve(context.Background(), listener); err != nil {
+			log.Printf("ssh server at %s returned, %v", listener.Addr(), err)
+		}
+	}()
 
-	log.Printf("starting ssh server (%s) at %s", ssh.FingerprintSHA256(signer.PublicKey()), listener.Addr())
-	go accept(listener, console, srv)
+	return
 }
@@ -8,9 +8,16 @@
 package network
 
 import (
+	"io"
 	"log"
 )
 
+var Hostname func() string
+
+var UniqueID func() []byte
+
+var Syslog io.Writer = io.Discard
+
 func Init(_ any, _ bool, _ bool, _ any) (_ any) {
 	log.Fatal("unsupported")
 	return
@@ -0,0 +1,349 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// p11, 6.2.1. PRI, RFC5424 (facility user, severity informational)
+	syslogPriority = 1*8 + 6
+	syslogApp      = "tamago-example"
+
+	// p15, 6.3.2. SD-ID, RFC5424 (32473 is reserved for documentation)
+	syslogSDID = "tamago@32473"
+
+	// largest UDP message fitting an unfragmented IPv4 datagram
+	syslogMaxUDPSize = 1400
+
+	syslogMaxBackoff = 30 * time.Second
+)
+
+var (
+	// SyslogBufferSize represents the maximum number of log messages
+	// buffered for forwarding, the oldest messages are dropped on overflow.
+	SyslogBufferSize = 1024
+	// SyslogRate represents the default rate limit of forwarded messages
+	// per second.
+	SyslogRate = 50
+)
+
+type syslogEntry struct {
+	seq uint64
+	ts  time.Time
+	msg string
+}
+
+type syslogForwarder struct {
+	sync.Mutex
+
+	queue  []syslogEntry
+	notify chan struct{}
+	seq    uint64
+
+	uri     *url.URL
+	cancel  context.CancelFunc
+	done    chan struct{}
+	conn    net.Conn
+	sent    uint64
+	dropped uint64
+	lastErr error
+}
+
+var forwarder = &syslogForwarder{
+	notify: make(chan struct{}, 1),
+}
+
+// Syslog is a log writer which buffers messages for forwarding to a remote
+// syslog server (see StartSyslog).
+//
+// Messages are buffered, up to SyslogBufferSize, also before the forwarder is
+// started to allow delivery of boot time logs.
+var Syslog io.Writer = forwarder
+
+// Write buffers a log message, it never blocks.
+func (f *syslogForwarder) Write(buf []byte) (n int, err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.seq += 1
+
+	for _, line := range strings.Split(strings.TrimRight(string(buf), "\n"), "\n") {
+		if len(f.queue) >= SyslogBufferSize {
+			f.queue = f.queue[1:]
+			f.dropped += 1
+		}
+
+		f.queue = append(f.queue, syslogEntry{seq: f.seq, ts: time.Now(), msg: line})
+	}
+
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+
+	return len(buf), nil
+}
+
+func (f *syslogForwarder) peek() (e syslogEntry, ok bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	if len(f.queue) == 0 {
+		return
+	}
+
+	return f.queue[0], true
+}
+
+func (f *syslogForwarder) pop(e syslogEntry) {
+	f.Lock()
+	defer f.Unlock()
+
+	// the entry might have been dropped on overflow
+	if len(f.queue) > 0 && f.queue[0] == e {
+		f.queue = f.queue[1:]
+		f.sent += 1
+	}
+}
+
+func (f *syslogForwarder) setError(err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.lastErr = err
+}
+
+func escapeSDParam(s string) string {
+	// p16, 6.3.3. SD-PARAM, RFC5424
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+// format returns an RFC5424 syslog message.
+func (e syslogEntry) format(hostname string, target string) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s - - ", syslogPriority,
+		e.ts.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), hostname, syslogApp)
+
+	fmt.Fprintf(&buf, `[%s target="%s" goos="%s" goarch="%s"]`, syslogSDID,
+		escapeSDParam(target), runtime.GOOS, runtime.GOARCH)
+
+	fmt.Fprintf(&buf, `[meta sequenceId="%d"] %s`, e.seq%(1<<31), e.msg)
+
+	return buf.Bytes()
+}
+
+func dialSyslog(ctx context.Context, uri *url.URL) (conn net.Conn, err error) {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+
+	switch uri.Scheme {
+	case "udp", "tcp":
+		return d.DialContext(ctx, uri.Scheme+"4", uri.Host)
+	case "tls":
+		td := &tls.Dialer{
+			NetDialer: d,
+			Config:    &tls.Config{ServerName: uri.Hostname()},
+		}
+
+		return td.DialContext(ctx, "tcp4", uri.Host)
+	}
+
+	return nil, errors.New("invalid scheme")
+}
+
+func (f *syslogForwarder) send(conn net.Conn, scheme string, msg []byte) (err error) {
+	switch scheme {
+	case "udp":
+		if len(msg) > syslogMaxUDPSize {
+			msg = msg[:syslogMaxUDPSize]
+		}
+	default:
+		// p3, 3.4.1. Octet Counting, RFC6587
+		msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	}
+
+	_, err = conn.Write(msg)
+
+	return
+}
+
+func (f *syslogForwarder) run(ctx context.Context, uri *url.URL, hostname string, target string, limiter *rate.Limiter) {
+	var conn net.Conn
+	var backoff time.Duration
+
+	defer close(f.done)
+
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		e, ok := f.peek()
+
+		if !ok {
+			select {
+			case <-f.notify:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if conn == nil {
+			c, err := dialSyslog(ctx, uri)
+
+			if err != nil {
+				f.setError(err)
+				backoff = min(max(2*backoff, time.Second), syslogMaxBackoff)
+
+				select {
+				case <-time.After(backoff):
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			conn = c
+			backoff = 0
+
+			f.Lock()
+			f.conn = conn
+			f.Unlock()
+		}
+
+		if err := limiter.Wait(ctx); err != nil {
+			return
+		}
+
+		if err := f.send(conn, uri.Scheme, e.format(hostname, target)); err != nil {
+			f.setError(err)
+			conn.Close()
+			conn = nil
+
+			f.Lock()
+			f.conn = nil
+			f.Unlock()
+
+			continue
+		}
+
+		f.pop(e)
+	}
+}
+
+// StartSyslog starts forwarding log messages to a remote syslog server in
+// RFC5424 format, the argument URI selects the transport (e.g.
+// udp://10.0.0.2:514, tcp://10.0.0.2:601, tls://logs.example.com:6514).
+//
+// The board target name is included in the structured data of each message,
+// forwarding is rate limited to the argument number of messages per second.
+func StartSyslog(uri string, target string, limit int) (err error) {
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+	default:
+		return errors.New("unsupported scheme, must be udp, tcp or tls")
+	}
+
+	if u.Port() == "" {
+		return errors.New("missing port")
+	}
+
+	if limit <= 0 {
+		limit = SyslogRate
+	}
+
+	StopSyslog()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	limiter := rate.NewLimiter(rate.Limit(limit), limit)
+
+	f := forwarder
+	f.Lock()
+	f.uri = u
+	f.cancel = cancel
+	f.done = make(chan struct{})
+	f.lastErr = nil
+	f.Unlock()
+
+	go f.run(ctx, u, Hostname(), target, limiter)
+
+	return
+}
+
+// StopSyslog stops log forwarding, pending messages remain buffered.
+func StopSyslog() {
+	f := forwarder
+
+	f.Lock()
+	cancel := f.cancel
+	done := f.done
+	f.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	<-done
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.cancel = nil
+	f.uri = nil
+	f.conn = nil
+}
+
+// SyslogStatus returns the log forwarder status.
+func SyslogStatus() string {
+	var res bytes.Buffer
+
+	f := forwarder
+	f.Lock()
+	defer f.Unlock()
+
+	if f.uri == nil {
+		fmt.Fprintf(&res, "forwarding: stopped\n")
+	} else {
+		fmt.Fprintf(&res, "forwarding: %s (connected: %v)\n", f.uri, f.conn != nil)
+	}
+
+	fmt.Fprintf(&res, "buffered:   %d\n", len(f.queue))
+	fmt.Fprintf(&res, "sent:       %d\n", f.sent)
+	fmt.Fprintf(&res, "dropped:    %d\n", f.dropped)
+
+	if f.lastErr != nil {
+		fmt.Fprintf(&res, "last error: %v\n", f.lastErr)
+	}
+
+	return res.String()
+}
@@ -0,0 +1,33 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"github.com/usbarmory/go-net"
+)
+
+// tapDevice wraps a network device to inspect its transmitted frames.
+type tapDevice struct {
+	gnet.NetworkDevice
+	name string
+}
+
+func (d *tapDevice) Transmit(buf []byte) error {
+	tap(d.name, buf, true)
+	return d.NetworkDevice.Transmit(buf)
+}
+
+// tap inspects all Ethernet frames received or transmitted on the named
+// interface, it is invoked from interrupt handlers and must not block.
+func tap(iface string, frame []byte, tx bool) {
+	Capture(iface, frame, tx)
+
+	if !tx {
+		observeICMP(frame)
+	}
+}
@@ -0,0 +1,578 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/usbarmory/go-net"
+)
+
+const tftpPort = 69
+
+// p2, 5. TFTP Packets, RFC1350
+const (
+	opRRQ   = 1
+	opWRQ   = 2
+	opDATA  = 3
+	opACK   = 4
+	opERROR = 5
+	// p2, Packet Formats, RFC2347
+	opOACK = 6
+)
+
+// p8, Error Codes, RFC1350
+const (
+	errUndefined    = 0
+	errNotFound     = 1
+	errAccess       = 2
+	errIllegalOp    = 4
+	errUnknownTID   = 5
+	errOptionRefuse = 8
+)
+
+const (
+	// p5, Appendix, RFC1350
+	defaultBlockSize = 512
+	// p2, Block Size Option, RFC2348
+	minBlockSize = 8
+	// largest block fitting an unfragmented IPv4 datagram
+	maxBlockSize = gnet.MTU - header.IPv4MinimumSize - header.UDPMinimumSize - 4
+)
+
+var (
+	// TFTPRoot represents the filesystem directory served by the TFTP
+	// server.
+	TFTPRoot = "/tftp"
+	// TFTPWritable represents whether the TFTP server accepts files.
+	TFTPWritable = false
+	// TFTPTimeout represents the TFTP retransmission timeout.
+	TFTPTimeout = 1 * time.Second
+	// TFTPRetries represents the number of TFTP retransmissions before a
+	// transfer is aborted.
+	TFTPRetries = 5
+)
+
+// tftpConn represents a TFTP transfer with a remote transfer identifier (TID).
+type tftpConn struct {
+	conn    net.PacketConn
+	peer    *net.UDPAddr
+	blksize int
+	buf     []byte
+
+	// lock peer port on first reply (client mode)
+	lockTID bool
+}
+
+func tftpPacket(op uint16, fields ...string) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, op)
+
+	for _, f := range fields {
+		buf = append(buf, f...)
+		buf = append(buf, 0)
+	}
+
+	return buf
+}
+
+func tftpBlock(op uint16, block uint16, data []byte) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, op)
+	buf = binary.BigEndian.AppendUint16(buf, block)
+
+	return append(buf, data...)
+}
+
+func tftpError(code uint16, msg string) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, opERROR)
+	buf = binary.BigEndian.AppendUint16(buf, code)
+	buf = append(buf, msg...)
+
+	return append(buf, 0)
+}
+
+// parseFields parses RRQ/WRQ and OACK packet fields (after the opcode).
+func parseFields(buf []byte) (fields []string) {
+	for len(buf) > 0 {
+		i := bytes.IndexByte(buf, 0)
+
+		if i < 0 {
+			break
+		}
+
+		fields = append(fields, string(buf[:i]))
+		buf = buf[i+1:]
+	}
+
+	return
+}
+
+func parseOptions(fields []string) map[string]string {
+	opts := make(map[string]string)
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		opts[strings.ToLower(fields[i])] = fields[i+1]
+	}
+
+	return opts
+}
+
+func (c *tftpConn) send(pkt []byte) (err error) {
+	_, err = c.conn.WriteTo(pkt, c.peer)
+	return
+}
+
+// exchange transmits a packet and waits for a reply accepted by the argument
+// function, retransmitting on timeout.
+func (c *tftpConn) exchange(pkt []byte, accept func(op uint16, payload []byte) bool) (op uint16, payload []byte, err error) {
+	for retry := 0; retry <= TFTPRetries; retry++ {
+		if err = c.send(pkt); err != nil {
+			return
+		}
+
+		deadline := time.Now().Add(TFTPTimeout)
+
+		for {
+			c.conn.SetReadDeadline(deadline)
+
+			n, addr, err := c.conn.ReadFrom(c.buf)
+
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			} else if err != nil {
+				return 0, nil, err
+			}
+
+			from, ok := addr.(*net.UDPAddr)
+
+			if !ok || !from.IP.Equal(c.peer.IP) {
+				continue
+			}
+
+			if c.lockTID {
+				c.peer = from
+				c.lockTID = false
+			} else if from.Port != c.peer.Port {
+				c.conn.WriteTo(tftpError(errUnknownTID, "unknown transfer ID"), from)
+				continue
+			}
+
+			if n < 4 {
+				continue
+			}
+
+			op = binary.BigEndian.Uint16(c.buf)
+			payload = c.buf[2:n]
+
+			if op == opERROR {
+				return 0, nil, fmt.Errorf("remote error %d, %s", binary.BigEndian.Uint16(payload), strings.TrimRight(string(payload[2:]), "\x00"))
+			}
+
+			if accept(op, payload) {
+				return op, payload, nil
+			}
+		}
+	}
+
+	return 0, nil, errors.New("transfer timeout")
+}
+
+// sendData transmits the argument reader as DATA blocks starting from block
+// number 1.
+func (c *tftpConn) sendData(r io.Reader) (n int64, err error) {
+	data := make([]byte, c.blksize)
+
+	for block := uint16(1); ; block++ {
+		size, err := io.ReadFull(r, data)
+
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			c.send(tftpError(errUndefined, err.Error()))
+			return n, err
+		}
+
+		ack := func(op uint16, payload []byte) bool {
+			return op == opACK && binary.BigEndian.Uint16(payload) == block
+		}
+
+		if _, _, err = c.exchange(tftpBlock(opDATA, block, data[:size]), ack); err != nil {
+			return n, err
+		}
+
+		n += int64(size)
+
+		if size < c.blksize {
+			return n, nil
+		}
+	}
+}
+
+// recvData acknowledges the argument packet and receives DATA blocks, starting
+// from the argument block number, into the argument writer.
+func (c *tftpConn) recvData(w io.Writer, pkt []byte, block uint16) (n int64, err error) {
+	for {
+		expected := block
+
+		data := func(op uint16, payload []byte) bool {
+			return op == opDATA && binary.BigEndian.Uint16(payload) == expected
+		}
+
+		_, payload, err := c.exchange(pkt, data)
+
+		if err != nil {
+			return n, err
+		}
+
+		payload = payload[2:]
+
+		if _, err = w.Write(payload); err != nil {
+			c.send(tftpError(errUndefined, err.Error()))
+			return n, err
+		}
+
+		n += int64(len(payload))
+		pkt = tftpBlock(opACK, block, nil)
+
+		if len(payload) < c.blksize {
+			// final acknowledgment
+			return n, c.send(pkt)
+		}
+
+		block++
+	}
+}
+
+// negotiate applies RFC2347 options, returning the accepted ones.
+func (c *tftpConn) negotiate(opts map[string]string, size int64) (accepted []string) {
+	if v, ok := opts["blksize"]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= minBlockSize {
+			c.blksize = min(n, maxBlockSize)
+			accepted = append(accepted, "blksize", strconv.Itoa(c.blksize))
+		}
+	}
+
+	if _, ok := opts["tsize"]; ok && size >= 0 {
+		accepted = append(accepted, "tsize", strconv.FormatInt(size, 10))
+	}
+
+	return
+}
+
+// tftpPath returns the path of the argument file name under TFTPRoot, private
+// paths (see PrivatePath) are never served.
+func tftpPath(name string) (string, error) {
+	p := path.Join(TFTPRoot, path.Clean("/"+name))
+
+	if PrivatePath(p) {
+		return "", os.ErrPermission
+	}
+
+	return p, nil
+}
+
+func handleTFTPRequest(s *stack.Stack, nicID tcpip.NICID, op uint16, fields []string, peer *net.UDPAddr) (err error) {
+	var size int64 = -1
+	var f *os.File
+
+	// each transfer is served from a new transfer identifier
+	conn, err := gonet.DialUDP(s, &tcpip.FullAddress{NIC: nicID}, nil, ipv4.ProtocolNumber)
+
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	c := &tftpConn{
+		conn:    conn,
+		peer:    peer,
+		blksize: defaultBlockSize,
+		buf:     make([]byte, gnet.MTU),
+	}
+
+	if len(fields) < 2 {
+		return c.send(tftpError(errIllegalOp, "malformed request"))
+	}
+
+	name, err := tftpPath(fields[0])
+
+	if err != nil {
+		return c.send(tftpError(errAccess, "access violation"))
+	}
+
+	opts := parseOptions(fields[2:])
+
+	if mode := strings.ToLower(fields[1]); mode != "octet" {
+		return c.send(tftpError(errIllegalOp, "unsupported mode"))
+	}
+
+	switch op {
+	case opRRQ:
+		if f, err = os.Open(name); err != nil {
+			return c.send(tftpError(errNotFound, "file not found"))
+		}
+
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			size = fi.Size()
+		} else {
+			f.Close()
+			return c.send(tftpError(errNotFound, "file not found"))
+		}
+	case opWRQ:
+		if !TFTPWritable {
+			return c.send(tftpError(errAccess, "read-only server"))
+		}
+
+		if v, ok := opts["tsize"]; ok {
+			size, _ = strconv.ParseInt(v, 10, 64)
+		}
+
+		if f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			return c.send(tftpError(errAccess, err.Error()))
+		}
+	}
+	defer f.Close()
+
+	accepted := c.negotiate(opts, size)
+	start := time.Now()
+	dir := "sent"
+
+	var n int64
+
+	switch {
+	case op == opRRQ && len(accepted) > 0:
+		ack := func(op uint16, payload []byte) bool {
+			return op == opACK && binary.BigEndian.Uint16(payload) == 0
+		}
+
+		if _, _, err = c.exchange(tftpPacket(opOACK, accepted...), ack); err != nil {
+			return
+		}
+
+		fallthrough
+	case op == opRRQ:
+		n, err = c.sendData(f)
+	case op == opWRQ && len(accepted) > 0:
+		dir = "received"
+		n, err = c.recvData(f, tftpPacket(opOACK, accepted...), 1)
+	case op == opWRQ:
+		dir = "received"
+		n, err = c.recvData(f, tftpBlock(opACK, 0, nil), 1)
+	}
+
+	if err != nil {
+		return
+	}
+
+	log.Printf("tftp: %s %s %s (%d bytes, %v)", peer, dir, name, n, time.Since(start))
+
+	return
+}
+
+// serveTFTP serves TFTP (RFC1350) requests, for files under TFTPRoot, with
+// support for the blksize (RFC2348) and tsize (RFC2349) options.
+func serveTFTP(ctx context.Context, conn net.PacketConn) (err error) {
+	name := serviceInterface(ctx)
+	iface, ok := Interfaces[name]
+
+	if !ok {
+		return fmt.Errorf("unknown interface %s", name)
+	}
+
+	s, nicID, err := gvisor(iface)
+
+	if err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(TFTPRoot, 0700); err != nil {
+		return
+	}
+
+	// unblock ReadFrom on shutdown
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	buf := make([]byte, gnet.MTU)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		peer, ok := addr.(*net.UDPAddr)
+
+		if !ok || n < 2 {
+			continue
+		}
+
+		op := binary.BigEndian.Uint16(buf)
+
+		if op != opRRQ && op != opWRQ {
+			conn.WriteTo(tftpError(errIllegalOp, "illegal operation"), peer)
+			continue
+		}
+
+		fields := parseFields(buf[2:n])
+
+		go func() {
+			if err := handleTFTPRequest(s, nicID, op, fields, peer); err != nil {
+				log.Printf("tftp: %s transfer error, %v", peer, err)
+			}
+		}()
+	}
+}
+
+func dialTFTP(server net.IP) (c *tftpConn, err error) {
+	name, err := lookupInterface()
+
+	if err != nil {
+		return
+	}
+
+	s, nicID, err := gvisor(Interfaces[name])
+
+	if err != nil {
+		return
+	}
+
+	conn, err := gonet.DialUDP(s, &tcpip.FullAddress{NIC: nicID}, nil, ipv4.ProtocolNumber)
+
+	if err != nil {
+		return
+	}
+
+	c = &tftpConn{
+		conn:    conn,
+		peer:    &net.UDPAddr{IP: server, Port: tftpPort},
+		blksize: defaultBlockSize,
+		buf:     make([]byte, gnet.MTU),
+		lockTID: true,
+	}
+
+	return
+}
+
+func (c *tftpConn) applyOACK(payload []byte) (err error) {
+	opts := parseOptions(parseFields(payload))
+
+	if v, ok := opts["blksize"]; ok {
+		n, err := strconv.Atoi(v)
+
+		if err != nil || n < minBlockSize || n > maxBlockSize {
+			c.send(tftpError(errOptionRefuse, "invalid blksize"))
+			return errors.New("invalid blksize option")
+		}
+
+		c.blksize = n
+	}
+
+	return
+}
+
+// TFTPGet retrieves a file from a TFTP server into the argument writer.
+func TFTPGet(server net.IP, name string, w io.Writer) (n int64, err error) {
+	c, err := dialTFTP(server)
+
+	if err != nil {
+		return
+	}
+	defer c.conn.Close()
+
+	rrq := tftpPacket(opRRQ, name, "octet", "blksize", strconv.Itoa(maxBlockSize), "tsize", "0")
+
+	reply := func(op uint16, payload []byte) bool {
+		return op == opOACK || (op == opDATA && binary.BigEndian.Uint16(payload) == 1)
+	}
+
+	op, payload, err := c.exchange(rrq, reply)
+
+	if err != nil {
+		return
+	}
+
+	if op == opOACK {
+		if err = c.applyOACK(payload); err != nil {
+			return
+		}
+
+		return c.recvData(w, tftpBlock(opACK, 0, nil), 1)
+	}
+
+	// server ignored options, first block already received
+	payload = payload[2:]
+
+	if _, err = w.Write(payload); err != nil {
+		return
+	}
+
+	n = int64(len(payload))
+	ack := tftpBlock(opACK, 1, nil)
+
+	if len(payload) < c.blksize {
+		return n, c.send(ack)
+	}
+
+	m, err := c.recvData(w, ack, 2)
+
+	return n + m, err
+}
+
+// TFTPPut transmits the argument reader, of the argument size, to a TFTP
+// server.
+func TFTPPut(server net.IP, name string, r io.Reader, size int64) (n int64, err error) {
+	c, err := dialTFTP(server)
+
+	if err != nil {
+		return
+	}
+	defer c.conn.Close()
+
+	wrq := tftpPacket(opWRQ, name, "octet", "blksize", strconv.Itoa(maxBlockSize), "tsize", strconv.FormatInt(size, 10))
+
+	reply := func(op uint16, payload []byte) bool {
+		return op == opOACK || (op == opACK && binary.BigEndian.Uint16(payload) == 0)
+	}
+
+	op, payload, err := c.exchange(wrq, reply)
+
+	if err != nil {
+		return
+	}
+
+	if op == opOACK {
+		if err = c.applyOACK(payload); err != nil {
+			return
+		}
+	}
+
+	return c.sendData(r)
+}
@@ -9,7 +9,9 @@ package network
 
 import (
 	"log"
+	"net"
 	"runtime/goos"
+	"time"
 
 	"github.com/usbarmory/tamago/amd64"
 	"github.com/usbarmory/tamago/soc/intel/ioapic"
@@ -21,6 +23,24 @@ import (
 // redirection vector for IOAPIC IRQ to CPU IRQ
 const vector = 32
 
+// virtioMAC returns the MAC address assigned by the host in the VirtIO network
+// device configuration, unless overridden by MAC.
+func virtioMAC(dev *vnet.Net) net.HardwareAddr {
+	if len(MAC) > 0 {
+		if mac, err := net.ParseMAC(MAC); err == nil {
+			return mac
+		}
+
+		log.Printf("invalid MAC address %s, ignored", MAC)
+	}
+
+	if mac := dev.Config().MAC; mac != [6]byte{} {
+		return net.HardwareAddr(mac[:])
+	}
+
+	return deriveMAC(ethName)
+}
+
 func startInterruptHandler(dev *vnet.Net, iface *gnet.Interface, cpu *amd64.CPU, ioapic *ioapic.IOAPIC) {
 	if dev == nil || iface == nil {
 		return
@@ -40,13 +60,18 @@ func startInterruptHandler(dev *vnet.Net, iface *gnet.Interface, cpu *amd64.CPU,
 	buf := make([]byte, size)
 
 	isr := func(irq int) {
+		defer accountISR(time.Now())
+
 		switch irq {
 		case vector:
 			for {
-				if n, err := dev.ReceiveWithHeader(buf); err != nil || n == 0 {
+				n, err := dev.ReceiveWithHeader(buf)
+
+				if err != nil || n == 0 {
 					return
 				}
 
+				tap(ethName, buf[dev.HeaderLength:n], false)
 				iface.Stack.RecvInboundPacket(buf[dev.HeaderLength:])
 			}
 		default:
@@ -60,6 +85,8 @@ func startInterruptHandler(dev *vnet.Net, iface *gnet.Interface, cpu *amd64.CPU,
 			return
 		}
 
+		defer accountIdle(time.Now())
+
 		cpu.SetAlarm(pollUntil)
 		cpu.WaitInterrupt()
 		cpu.SetAlarm(0)
@@ -0,0 +1,206 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package network
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// SensitiveRoutes represents the web server route prefixes which require
+// authentication, in addition to all static files other than the index page.
+var SensitiveRoutes = []string{
+	"/debug/",
+	"/dav/",
+	"/terminal/",
+}
+
+var errUnauthorized = errors.New("unauthorized")
+
+var (
+	webAuthMutex sync.Mutex
+
+	// HTTP Basic authentication user and password hash
+	webAuthUser string
+	webAuthHash []byte
+
+	// HTTP Bearer token hash
+	webAuthToken []byte
+
+	// TLS client certificate authorities
+	webAuthCAs *x509.CertPool
+)
+
+// SetWebBasicAuth sets the HTTP Basic authentication credentials for
+// sensitive web routes, an empty password disables this method.
+func SetWebBasicAuth(user string, password string) {
+	webAuthMutex.Lock()
+	defer webAuthMutex.Unlock()
+
+	if len(password) == 0 {
+		webAuthUser = ""
+		webAuthHash = nil
+		return
+	}
+
+	h := sha256.Sum256([]byte(password))
+	webAuthUser = user
+	webAuthHash = h[:]
+}
+
+// SetWebBearerToken sets the HTTP Bearer authentication token for sensitive
+// web routes, an empty token disables this method.
+func SetWebBearerToken(token string) {
+	webAuthMutex.Lock()
+	defer webAuthMutex.Unlock()
+
+	if len(token) == 0 {
+		webAuthToken = nil
+		return
+	}
+
+	h := sha256.Sum256([]byte(token))
+	webAuthToken = h[:]
+}
+
+// SetWebClientCAs sets the certificate authorities for TLS client certificate
+// authentication on sensitive web routes, a nil pool disables this method.
+func SetWebClientCAs(pool *x509.CertPool) {
+	webAuthMutex.Lock()
+	defer webAuthMutex.Unlock()
+
+	webAuthCAs = pool
+}
+
+// WebAuthStatus returns the enabled authentication methods for sensitive web
+// routes.
+func WebAuthStatus() string {
+	var methods []string
+
+	webAuthMutex.Lock()
+	defer webAuthMutex.Unlock()
+
+	if webAuthHash != nil {
+		methods = append(methods, fmt.Sprintf("basic (user %s)", webAuthUser))
+	}
+
+	if webAuthToken != nil {
+		methods = append(methods, "bearer")
+	}
+
+	if webAuthCAs != nil {
+		methods = append(methods, "client certificate")
+	}
+
+	if len(methods) == 0 {
+		return "sensitive routes disabled (no authentication method set)"
+	}
+
+	return fmt.Sprintf("sensitive routes %s authenticated with: %s",
+		strings.Join(SensitiveRoutes, " "), strings.Join(methods, ", "))
+}
+
+func webAuthenticate(r *http.Request) (err error) {
+	webAuthMutex.Lock()
+	user, hash, token, pool := webAuthUser, webAuthHash, webAuthToken, webAuthCAs
+	webAuthMutex.Unlock()
+
+	if hash == nil && token == nil && pool == nil {
+		return errors.New("authentication not configured")
+	}
+
+	if r.TLS == nil {
+		return errors.New("HTTPS required")
+	}
+
+	if pool != nil && len(r.TLS.PeerCertificates) > 0 {
+		intermediates := x509.NewCertPool()
+
+		for _, cert := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		opts := x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+
+		if _, err = r.TLS.PeerCertificates[0].Verify(opts); err == nil {
+			return
+		}
+	}
+
+	if hash != nil {
+		if u, password, ok := r.BasicAuth(); ok {
+			h := sha256.Sum256([]byte(password))
+
+			if u == user && subtle.ConstantTimeCompare(h[:], hash) == 1 {
+				return nil
+			}
+		}
+	}
+
+	if token != nil {
+		if t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			h := sha256.Sum256([]byte(t))
+
+			if subtle.ConstantTimeCompare(h[:], token) == 1 {
+				return nil
+			}
+		}
+	}
+
+	return errUnauthorized
+}
+
+// sensitive returns whether the argument request targets a sensitive route.
+func sensitive(mux *http.ServeMux, r *http.Request) bool {
+	p := path.Clean("/" + r.URL.Path)
+
+	for _, prefix := range SensitiveRoutes {
+		if strings.HasPrefix(p+"/", prefix) {
+			return true
+		}
+	}
+
+	// static files, other than the index page, are served on the root
+	// pattern
+	if _, pattern := mux.Handler(r); pattern == "/" {
+		return p != "/" && p != "/index.html"
+	}
+
+	return false
+}
+
+// WebAuth returns a handler which requires authentication, on sensitive
+// routes, before passing requests to the argument multiplexer.
+func WebAuth(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sensitive(mux, r) {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		switch err := webAuthenticate(r); err {
+		case nil:
+			mux.ServeHTTP(w, r)
+		case errUnauthorized:
+			w.Header().Add("WWW-Authenticate", `Basic realm="tamago", charset="UTF-8"`)
+			w.Header().Add("WWW-Authenticate", `Bearer realm="tamago"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		default:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		}
+	})
+}
@@ -6,80 +6,26 @@
 package network
 
 import (
-	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/sha256"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
 	"fmt"
 	"html"
 	"log"
-	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"time"
-)
-
-func generateTLSCerts(address net.IP) ([]byte, []byte, error) {
-	TLSCert := new(bytes.Buffer)
-	TLSKey := new(bytes.Buffer)
-
-	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<63-1))
-
-	log.Printf("generating TLS keypair IP: %s, Serial: %X", address.String(), serial)
-
-	validFrom, _ := time.Parse(time.RFC3339, "1981-01-07T00:00:00Z")
-	validUntil, _ := time.Parse(time.RFC3339, "2031-01-07T00:00:00Z")
-
-	certTemplate := x509.Certificate{
-		SerialNumber: serial,
-		Subject: pkix.Name{
-			Organization:       []string{"TamaGo Example"},
-			OrganizationalUnit: []string{"TamaGo test certificates"},
-			CommonName:         address.String(),
-		},
-		IPAddresses:        []net.IP{address},
-		SignatureAlgorithm: x509.ECDSAWithSHA256,
-		PublicKeyAlgorithm: x509.ECDSA,
-		NotBefore:          validFrom,
-		NotAfter:           validUntil,
-		SubjectKeyId:       []byte{1, 2, 3, 4, 5},
-		KeyUsage:           x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-	}
 
-	caTemplate := certTemplate
-	caTemplate.SerialNumber = serial
-	caTemplate.SubjectKeyId = []byte{1, 2, 3, 4, 6}
-	caTemplate.BasicConstraintsValid = true
-	caTemplate.IsCA = true
-	caTemplate.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign
-	caTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
-
-	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	pub := &priv.PublicKey
-	cert, err := x509.CreateCertificate(rand.Reader, &certTemplate, &caTemplate, pub, priv)
-
-	if err != nil {
-		return nil, nil, err
-	}
-
-	pem.Encode(TLSCert, &pem.Block{Type: "CERTIFICATE", Bytes: cert})
-	ecb, _ := x509.MarshalECPrivateKey(priv)
-	pem.Encode(TLSKey, &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecb})
-
-	h := sha256.New()
-	h.Write(cert)
+	"golang.org/x/crypto/acme"
+)
 
-	log.Printf("SHA-256 fingerprint: % X", h.Sum(nil))
+// CertificateFunc represents a TLS certificate source (see
+// tls.Config.GetCertificate).
+type CertificateFunc func(*tls.ClientHelloInfo) (*tls.Certificate, error)
 
-	return TLSCert.Bytes(), TLSKey.Bytes(), nil
-}
+// ShutdownTimeout represents the maximum time allowed for a graceful server
+// shutdown.
+var ShutdownTimeout = 5 * time.Second
 
 func flushingHandler(h http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -102,52 +48,116 @@ func SetupStaticWebAssets(banner string) {
 	fmt.Fprintf(file, "<p>%s</p><ul>", html.EscapeString(banner))
 	fmt.Fprintf(file, `<li><a href="%s">%s</a></li>`, "/tamago-example.log", "/tamago-example.log")
 	fmt.Fprintf(file, `<li><a href="%s">%s</a></li>`, "/dir", "/dir")
+	fmt.Fprintf(file, `<li><a href="%s">%s</a></li>`, "/dav/", "/dav/")
 	fmt.Fprintf(file, `<li><a href="%s">%s</a></li>`, "/debug/pprof", "/debug/pprof")
 	fmt.Fprintf(file, `<li><a href="%s">%s</a></li>`, "/debug/statsviz", "/debug/statsviz")
+	fmt.Fprintf(file, `<li><a href="%s">%s</a></li>`, "/debug/pcap", "/debug/pcap")
+	fmt.Fprintf(file, `<li><a href="%s">%s</a></li>`, "/metrics", "/metrics")
+	fmt.Fprintf(file, `<li><a href="%s">%s</a></li>`, "/terminal", "/terminal")
+	fmt.Fprintf(file, `<li><a href="%s">%s</a></li>`, "/api/v1/openapi.json", "/api/v1/openapi.json")
 	fmt.Fprint(file, "</ul></body></html>")
 
 	static := http.FileServer(http.Dir("/"))
-	staticHandler := flushingHandler(static)
-	http.Handle("/", http.StripPrefix("/", staticHandler))
-}
+	staticHandler := http.StripPrefix("/", flushingHandler(static))
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// ACME account and certificate keys, as well as SSH authorized
+		// keys, are never served
+		if PrivatePath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
 
-func StartWebServer(listener net.Listener, addr string, port uint16, https bool) {
-	var err error
+		staticHandler.ServeHTTP(w, r)
+	})
+}
 
-	srv := &http.Server{
-		Addr: addr + ":" + fmt.Sprintf("%d", port),
-	}
+// WebServer returns a service function serving HTTP, or HTTPS, on the argument
+// address.
+//
+// HTTPS certificates are obtained from the argument source or, when nil,
+// through ACME (see StartACME) with a fallback on a certificate issued by the
+// device local certificate authority.
+func WebServer(addr string, port uint16, https bool, source CertificateFunc) (serve func(context.Context, net.Listener) error, err error) {
+	var TLSConfig *tls.Config
 
 	if https {
-		TLSCert, TLSKey, err := generateTLSCerts(net.ParseIP(addr))
+		if source == nil {
+			certificate, err := TLSCertificate(net.ParseIP(addr))
 
-		if err != nil {
-			log.Fatal("TLS cert|key error: ", err)
-		}
-
-		log.Printf("generated TLS certificate:\n%s", TLSCert)
-		log.Printf("generated TLS key:\n%s", TLSKey)
-
-		certificate, err := tls.X509KeyPair(TLSCert, TLSKey)
+			if err != nil {
+				return nil, fmt.Errorf("TLS certificate error, %v", err)
+			}
 
-		if err != nil {
-			log.Fatal("X509KeyPair error: ", err)
+			source = acmeCertificate(func(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return &certificate, nil
+			})
 		}
 
-		srv.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{certificate},
+		TLSConfig = &tls.Config{
+			GetCertificate: source,
+			// TLS-ALPN-01 challenges are answered by the ACME source
+			NextProtos: []string{"h2", "http/1.1", acme.ALPNProto},
+			// client certificates are verified by WebAuth
+			ClientAuth: tls.RequestClientCert,
 		}
 	}
 
-	log.Printf("starting web server at %s:%d", addr, port)
+	serve = func(ctx context.Context, listener net.Listener) (err error) {
+		// a server cannot be reused after shutdown
+		srv := &http.Server{
+			Addr:      addr + ":" + fmt.Sprintf("%d", port),
+			Handler:   WebAuth(http.DefaultServeMux),
+			TLSConfig: TLSConfig,
+		}
+
+		shutdown := make(chan struct{})
+
+		stop := context.AfterFunc(ctx, func() {
+			defer close(shutdown)
+
+			ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+			defer cancel()
+
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+			}
+		})
 
-	go func() {
 		if https {
 			err = srv.ServeTLS(listener, "", "")
 		} else {
 			err = srv.Serve(listener)
 		}
 
-		log.Fatal("server returned unexpectedly ", err)
+		if !stop() {
+			// wait for graceful shutdown completion
+			<-shutdown
+			return nil
+		}
+
+		return
+	}
+
+	return
+}
+
+// StartWebServer starts an HTTP, or HTTPS, server on the argument listener,
+// see WebServer for the certificate source.
+func StartWebServer(listener net.Listener, addr string, port uint16, https bool, source CertificateFunc) (err error) {
+	serve, err := WebServer(addr, port, https, source)
+
+	if err != nil {
+		return
+	}
+
+	log.Printf("starting web server at %s:%d", addr, port)
+
+	go func() {
+		if err := serve(context.Background(), listener); err != nil {
+			log.Printf("web server at %s:%d returned, %v", addr, port, err)
+		}
 	}()
+
+	return
 }
@@ -0,0 +1,128 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/coder/websocket"
+	"golang.org/x/term"
+
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+// webTerminalPage is a self-contained terminal emulator page, without any
+// third-party dependency, attaching to the console WebSocket.
+//
+//go:embed web_terminal.html
+var webTerminalPage string
+
+// webTerminal implements an io.ReadWriter over a WebSocket connection, binary
+// messages carry terminal data while text messages carry resize events.
+type webTerminal struct {
+	ctx  context.Context
+	conn *websocket.Conn
+
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+type webTerminalSize struct {
+	Cols int `json:"cols"`
+	Rows int `json:"rows"`
+}
+
+func (t *webTerminal) Read(p []byte) (int, error) {
+	return t.r.Read(p)
+}
+
+func (t *webTerminal) Write(p []byte) (n int, err error) {
+	if err = t.conn.Write(t.ctx, websocket.MessageBinary, p); err != nil {
+		return
+	}
+
+	return len(p), nil
+}
+
+// receive forwards terminal input and resize events from the WebSocket
+// connection.
+func (t *webTerminal) receive(console *shell.Interface) {
+	defer t.w.Close()
+
+	for {
+		typ, buf, err := t.conn.Read(t.ctx)
+
+		if err != nil {
+			return
+		}
+
+		switch typ {
+		case websocket.MessageBinary:
+			if _, err = t.w.Write(buf); err != nil {
+				return
+			}
+		case websocket.MessageText:
+			var size webTerminalSize
+
+			if err = json.Unmarshal(buf, &size); err != nil || size.Cols <= 0 || size.Rows <= 0 {
+				log.Printf("malformed web terminal resize event")
+				continue
+			}
+
+			console.Terminal.SetSize(size.Cols, size.Rows)
+		}
+	}
+}
+
+func serveWebTerminal(console *shell.Interface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the Origin header is verified against the request Host
+		conn, err := websocket.Accept(w, r, nil)
+
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+
+		log.Printf("new web terminal connection from %s", r.RemoteAddr)
+
+		pr, pw := io.Pipe()
+
+		t := &webTerminal{
+			ctx:  r.Context(),
+			conn: conn,
+			r:    pr,
+			w:    pw,
+		}
+
+		// each connection is served by its own session
+		c := *console
+		c.ReadWriter = t
+		c.Terminal = term.NewTerminal(t, "")
+
+		go t.receive(&c)
+		c.Start(true)
+
+		log.Printf("closing web terminal connection")
+		conn.Close(websocket.StatusNormalClosure, "")
+	}
+}
+
+// SetupWebTerminal registers the web terminal routes, serving the argument
+// console, these are authenticated by WebAuth as sensitive routes.
+func SetupWebTerminal(console *shell.Interface) {
+	http.HandleFunc("/terminal", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, webTerminalPage)
+	})
+
+	http.HandleFunc("/terminal/ws", serveWebTerminal(console))
+}
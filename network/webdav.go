@@ -0,0 +1,107 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+
+	"golang.org/x/net/webdav"
+)
+
+// WebDAVPrefix represents the web server route for WebDAV access to the root
+// filesystem, which is listed in SensitiveRoutes.
+const WebDAVPrefix = "/dav"
+
+// webdavFS implements webdav.FileSystem on the root filesystem, other than
+// private paths (see PrivatePath).
+type webdavFS struct {
+	webdav.Dir
+}
+
+// webdavFile hides private paths from directory listings.
+type webdavFile struct {
+	webdav.File
+	name string
+}
+
+func (f webdavFile) Readdir(count int) ([]fs.FileInfo, error) {
+	entries, err := f.File.Readdir(count)
+
+	entries = slices.DeleteFunc(entries, func(e fs.FileInfo) bool {
+		return PrivatePath(path.Join(f.name, e.Name()))
+	})
+
+	return entries, err
+}
+
+func (fs webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if PrivatePath(name) {
+		return os.ErrPermission
+	}
+
+	return fs.Dir.Mkdir(ctx, name, perm)
+}
+
+func (fs webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if PrivatePath(name) {
+		return nil, os.ErrPermission
+	}
+
+	f, err := fs.Dir.OpenFile(ctx, name, flag, perm)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return webdavFile{f, name}, nil
+}
+
+func (fs webdavFS) RemoveAll(ctx context.Context, name string) error {
+	if PrivatePath(name) {
+		return os.ErrPermission
+	}
+
+	return fs.Dir.RemoveAll(ctx, name)
+}
+
+func (fs webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	if PrivatePath(oldName) || PrivatePath(newName) {
+		return os.ErrPermission
+	}
+
+	return fs.Dir.Rename(ctx, oldName, newName)
+}
+
+func (fs webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if PrivatePath(name) {
+		return nil, os.ErrPermission
+	}
+
+	return fs.Dir.Stat(ctx, name)
+}
+
+func init() {
+	h := &webdav.Handler{
+		Prefix:     WebDAVPrefix,
+		FileSystem: webdavFS{webdav.Dir("/")},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("webdav: %s %s, %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	http.Handle(WebDAVPrefix+"/", h)
+}
@@ -0,0 +1,729 @@
+// Copyright (c) The TamaGo Authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build imx8mpevk || mx6ullevk || usbarmory || cloud_hypervisor || firecracker || microvm || gcp
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/device"
+	"github.com/tailscale/wireguard-go/tun"
+
+	"github.com/usbarmory/tamago-example/shell"
+)
+
+const (
+	wgName       = "wg0"
+	wgNICID      = 1
+	wgDefaultMTU = 1420
+	wgQueueSize  = 1024
+)
+
+// WireGuardPeer represents a WireGuard peer configuration.
+type WireGuardPeer struct {
+	// PublicKey is the peer Curve25519 public key
+	PublicKey []byte
+	// PresharedKey is an optional symmetric key
+	PresharedKey []byte
+	// Endpoint is the optional peer address (host:port)
+	Endpoint string
+	// AllowedIPs are the tunnel addresses routed to, and accepted from,
+	// the peer.
+	AllowedIPs []netip.Prefix
+	// Keepalive is the persistent keepalive interval (0 to disable)
+	Keepalive time.Duration
+}
+
+// WireGuardConfig represents a WireGuard interface configuration.
+type WireGuardConfig struct {
+	// PrivateKey is the interface Curve25519 private key
+	PrivateKey []byte
+	// Address is the tunnel interface address
+	Address netip.Prefix
+	// ListenPort is the UDP port, a random one is used when zero.
+	ListenPort uint16
+	// MTU is the tunnel MTU
+	MTU int
+
+	Peers []WireGuardPeer
+}
+
+func parseKey(s string) (key []byte, err error) {
+	if key, err = base64.StdEncoding.DecodeString(s); err != nil {
+		return
+	}
+
+	if len(key) != curve25519.ScalarSize {
+		return nil, errors.New("invalid key length")
+	}
+
+	return
+}
+
+// ParseWireGuardConfig parses a WireGuard configuration in wg-quick format.
+func ParseWireGuardConfig(buf []byte) (cfg *WireGuardConfig, err error) {
+	var section string
+	var peer *WireGuardPeer
+
+	cfg = &WireGuardConfig{
+		MTU: wgDefaultMTU,
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(strings.Trim(line, "[]"))
+
+			switch section {
+			case "interface":
+			case "peer":
+				cfg.Peers = append(cfg.Peers, WireGuardPeer{})
+				peer = &cfg.Peers[len(cfg.Peers)-1]
+			default:
+				return nil, fmt.Errorf("line %d, invalid section %s", n, section)
+			}
+
+			continue
+		}
+
+		key, val, ok := strings.Cut(line, "=")
+
+		if !ok {
+			return nil, fmt.Errorf("line %d, invalid syntax", n)
+		}
+
+		key = strings.ToLower(strings.TrimSpace(key))
+		val = strings.TrimSpace(val)
+
+		switch section + "/" + key {
+		case "interface/privatekey":
+			cfg.PrivateKey, err = parseKey(val)
+		case "interface/address":
+			// only the first IPv4 address is supported
+			addr, _, _ := strings.Cut(val, ",")
+			cfg.Address, err = netip.ParsePrefix(strings.TrimSpace(addr))
+		case "interface/listenport":
+			var port uint64
+			port, err = strconv.ParseUint(val, 10, 16)
+			cfg.ListenPort = uint16(port)
+		case "interface/mtu":
+			cfg.MTU, err = strconv.Atoi(val)
+		case "peer/publickey":
+			peer.PublicKey, err = parseKey(val)
+		case "peer/presharedkey":
+			peer.PresharedKey, err = parseKey(val)
+		case "peer/endpoint":
+			peer.Endpoint = val
+		case "peer/allowedips":
+			for _, s := range strings.Split(val, ",") {
+				var prefix netip.Prefix
+
+				if prefix, err = netip.ParsePrefix(strings.TrimSpace(s)); err != nil {
+					break
+				}
+
+				peer.AllowedIPs = append(peer.AllowedIPs, prefix)
+			}
+		case "peer/persistentkeepalive":
+			var sec int
+			sec, err = strconv.Atoi(val)
+			peer.Keepalive = time.Duration(sec) * time.Second
+		default:
+			// ignore wg-quick host settings (e.g. DNS, PostUp)
+			if section != "interface" {
+				return nil, fmt.Errorf("line %d, invalid key %s", n, key)
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d, invalid %s, %v", n, key, err)
+		}
+	}
+
+	switch {
+	case cfg.PrivateKey == nil:
+		return nil, errors.New("missing private key")
+	case !cfg.Address.IsValid() || !cfg.Address.Addr().Is4():
+		return nil, errors.New("missing or invalid IPv4 address")
+	case cfg.MTU < 576 || cfg.MTU > 65535:
+		return nil, errors.New("invalid MTU")
+	}
+
+	for i, p := range cfg.Peers {
+		if p.PublicKey == nil {
+			return nil, fmt.Errorf("missing public key for peer %d", i+1)
+		}
+	}
+
+	return
+}
+
+func resolveEndpoint(endpoint string) (addr netip.AddrPort, err error) {
+	host, port, err := net.SplitHostPort(endpoint)
+
+	if err != nil {
+		return
+	}
+
+	ip, err := netip.ParseAddr(host)
+
+	if err != nil {
+		ips, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip4", host)
+
+		if err != nil {
+			return addr, err
+		}
+
+		ip = ips[0]
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+
+	if err != nil {
+		return
+	}
+
+	return netip.AddrPortFrom(ip.Unmap(), uint16(p)), nil
+}
+
+// uapi returns the configuration in WireGuard cross-platform userspace API
+// format.
+func (cfg *WireGuardConfig) uapi() (string, error) {
+	var buf strings.Builder
+
+	fmt.Fprintf(&buf, "private_key=%x\n", cfg.PrivateKey)
+	fmt.Fprintf(&buf, "listen_port=%d\n", cfg.ListenPort)
+	fmt.Fprintf(&buf, "replace_peers=true\n")
+
+	for _, p := range cfg.Peers {
+		fmt.Fprintf(&buf, "public_key=%x\n", p.PublicKey)
+
+		if p.PresharedKey != nil {
+			fmt.Fprintf(&buf, "preshared_key=%x\n", p.PresharedKey)
+		}
+
+		if len(p.Endpoint) > 0 {
+			addr, err := resolveEndpoint(p.Endpoint)
+
+			if err != nil {
+				return "", fmt.Errorf("invalid endpoint %s, %v", p.Endpoint, err)
+			}
+
+			fmt.Fprintf(&buf, "endpoint=%s\n", addr)
+		}
+
+		fmt.Fprintf(&buf, "persistent_keepalive_interval=%d\n", int(p.Keepalive.Seconds()))
+		fmt.Fprintf(&buf, "replace_allowed_ips=true\n")
+
+		for _, prefix := range p.AllowedIPs {
+			fmt.Fprintf(&buf, "allowed_ip=%s\n", prefix)
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// WireGuardKeyPair generates a WireGuard key pair, returned in base64 format.
+func WireGuardKeyPair() (privateKey string, publicKey string, err error) {
+	key := make([]byte, curve25519.ScalarSize)
+
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+
+	// clamp as per Curve25519 private key requirements
+	key[0] &= 248
+	key[31] = (key[31] & 127) | 64
+
+	pub, err := curve25519.X25519(key, curve25519.Basepoint)
+
+	if err != nil {
+		return
+	}
+
+	return base64.StdEncoding.EncodeToString(key), base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// wgEndpoint represents a WireGuard peer UDP address.
+type wgEndpoint netip.AddrPort
+
+func (e wgEndpoint) ClearSrc()           {}
+func (e wgEndpoint) SrcToString() string { return "" }
+func (e wgEndpoint) DstToString() string { return netip.AddrPort(e).String() }
+func (e wgEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
+func (e wgEndpoint) DstIP() netip.Addr   { return netip.AddrPort(e).Addr() }
+
+func (e wgEndpoint) DstToBytes() []byte {
+	b, _ := netip.AddrPort(e).MarshalBinary()
+	return b
+}
+
+// wgBind implements a WireGuard UDP transport on the gVisor stack of the
+// interface hooked into the Go runtime.
+type wgBind struct {
+	sync.Mutex
+	conn *gonet.UDPConn
+}
+
+func (b *wgBind) Open(port uint16) (fns []conn.ReceiveFunc, actualPort uint16, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.conn != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	name, err := lookupInterface()
+
+	if err != nil {
+		return
+	}
+
+	s, nicID, err := gvisor(Interfaces[name])
+
+	if err != nil {
+		return
+	}
+
+	c, err := gonet.DialUDP(s, &tcpip.FullAddress{NIC: nicID, Port: port}, nil, ipv4.ProtocolNumber)
+
+	if err != nil {
+		return
+	}
+
+	if addr, ok := c.LocalAddr().(*net.UDPAddr); ok {
+		actualPort = uint16(addr.Port)
+	}
+
+	b.conn = c
+
+	recv := func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		n, addr, err := c.ReadFrom(bufs[0])
+
+		if err != nil {
+			// reads without deadline only fail on closure
+			return 0, net.ErrClosed
+		}
+
+		sizes[0] = n
+		eps[0] = wgEndpoint(addr.(*net.UDPAddr).AddrPort())
+
+		return 1, nil
+	}
+
+	return []conn.ReceiveFunc{recv}, actualPort, nil
+}
+
+func (b *wgBind) Close() (err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.conn != nil {
+		err = b.conn.Close()
+		b.conn = nil
+	}
+
+	return
+}
+
+func (b *wgBind) Send(bufs [][]byte, ep conn.Endpoint, offset int) (err error) {
+	b.Lock()
+	c := b.conn
+	b.Unlock()
+
+	if c == nil {
+		return net.ErrClosed
+	}
+
+	dst, ok := ep.(wgEndpoint)
+
+	if !ok {
+		return errors.New("invalid endpoint type")
+	}
+
+	addr := net.UDPAddrFromAddrPort(netip.AddrPort(dst))
+
+	for _, buf := range bufs {
+		if _, err = c.WriteTo(buf[offset:], addr); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (b *wgBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addr, err := netip.ParseAddrPort(s)
+	return wgEndpoint(netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())), err
+}
+
+func (b *wgBind) SetMark(mark uint32) error { return nil }
+func (b *wgBind) BatchSize() int            { return 1 }
+
+// wgTun implements a WireGuard TUN device on a dedicated gVisor stack.
+type wgTun struct {
+	ep       *channel.Endpoint
+	stack    *stack.Stack
+	mtu      int
+	events   chan tun.Event
+	incoming chan *buffer.View
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newWGTun(addr netip.Addr, mtu int) (t *wgTun, err error) {
+	t = &wgTun{
+		ep: channel.New(wgQueueSize, uint32(mtu), ""),
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+			HandleLocal:        true,
+		}),
+		mtu:      mtu,
+		events:   make(chan tun.Event, 1),
+		incoming: make(chan *buffer.View, wgQueueSize),
+		closed:   make(chan struct{}),
+	}
+
+	t.ep.AddNotify(t)
+
+	if err := t.stack.CreateNIC(wgNICID, t.ep); err != nil {
+		return nil, fmt.Errorf("could not create NIC, %v", err)
+	}
+
+	protoAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFromSlice(addr.AsSlice()).WithPrefix(),
+	}
+
+	if err := t.stack.AddProtocolAddress(wgNICID, protoAddr, stack.AddressProperties{}); err != nil {
+		return nil, fmt.Errorf("could not add address, %v", err)
+	}
+
+	// peer routing is enforced by WireGuard allowed IPs
+	t.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: wgNICID})
+	t.events <- tun.EventUp
+
+	return
+}
+
+// WriteNotify queues outbound packets from the stack for encryption.
+func (t *wgTun) WriteNotify() {
+	pkt := t.ep.Read()
+
+	if pkt == nil {
+		return
+	}
+
+	view := pkt.ToView()
+	pkt.DecRef()
+
+	select {
+	case t.incoming <- view:
+	case <-t.closed:
+		view.Release()
+	}
+}
+
+func (t *wgTun) Read(bufs [][]byte, sizes []int, offset int) (n int, err error) {
+	select {
+	case view := <-t.incoming:
+		defer view.Release()
+
+		if sizes[0], err = view.Read(bufs[0][offset:]); err != nil {
+			return
+		}
+
+		return 1, nil
+	case <-t.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (t *wgTun) Write(bufs [][]byte, offset int) (int, error) {
+	for _, buf := range bufs {
+		packet := buf[offset:]
+
+		if len(packet) == 0 || packet[0]>>4 != header.IPv4Version {
+			continue
+		}
+
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: buffer.MakeWithData(packet),
+		})
+
+		t.ep.InjectInbound(header.IPv4ProtocolNumber, pkt)
+		pkt.DecRef()
+	}
+
+	return len(bufs), nil
+}
+
+func (t *wgTun) Close() error {
+	t.once.Do(func() {
+		close(t.closed)
+		t.stack.RemoveNIC(wgNICID)
+		t.ep.Close()
+		close(t.events)
+	})
+
+	return nil
+}
+
+func (t *wgTun) File() *os.File           { return nil }
+func (t *wgTun) MTU() (int, error)        { return t.mtu, nil }
+func (t *wgTun) Name() (string, error)    { return wgName, nil }
+func (t *wgTun) Events() <-chan tun.Event { return t.events }
+func (t *wgTun) BatchSize() int           { return 1 }
+
+// wireGuard represents a running WireGuard tunnel.
+type wireGuard struct {
+	dev    *device.Device
+	tun    *wgTun
+	addr   netip.Prefix
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var (
+	wgMutex  sync.Mutex
+	wgTunnel *wireGuard
+)
+
+func (w *wireGuard) serve(ctx context.Context, name string, port uint16, serve ServeFunc) (err error) {
+	addr := tcpip.FullAddress{
+		NIC:  wgNICID,
+		Port: port,
+	}
+
+	l, err := gonet.ListenTCP(w.tun.stack, addr, ipv4.ProtocolNumber)
+
+	if err != nil {
+		return
+	}
+
+	listener := &serviceListener{l}
+
+	w.wg.Add(1)
+
+	go func() {
+		defer w.wg.Done()
+		defer listener.Close()
+
+		if err := serve(ctx, listener); err != nil && ctx.Err() == nil {
+			log.Printf("wg: %s server returned, %v", name, err)
+		}
+	}()
+
+	log.Printf("wg: %s server started at %s:%d", name, w.addr.Addr(), port)
+
+	return
+}
+
+// StartWireGuard brings up a WireGuard tunnel on the gVisor stack of the
+// interface hooked into the Go runtime, exposing SSH and HTTP servers on the
+// tunnel address.
+func StartWireGuard(cfg *WireGuardConfig, console *shell.Interface) (err error) {
+	wgMutex.Lock()
+	defer wgMutex.Unlock()
+
+	if wgTunnel != nil {
+		return errors.New("tunnel already started")
+	}
+
+	uapi, err := cfg.uapi()
+
+	if err != nil {
+		return
+	}
+
+	t, err := newWGTun(cfg.Address.Addr(), cfg.MTU)
+
+	if err != nil {
+		return
+	}
+
+	logger := &device.Logger{
+		Verbosef: device.DiscardLogf,
+		Errorf: func(format string, args ...any) {
+			log.Printf("wg: %s", fmt.Sprintf(format, args...))
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := &wireGuard{
+		dev:    device.NewDevice(t, &wgBind{}, logger),
+		tun:    t,
+		addr:   cfg.Address,
+		cancel: cancel,
+	}
+
+	defer func() {
+		if err != nil {
+			w.close()
+		}
+	}()
+
+	if err = w.dev.IpcSet(uapi); err != nil {
+		return fmt.Errorf("invalid configuration, %v", err)
+	}
+
+	if err = w.dev.Up(); err != nil {
+		return
+	}
+
+	serveSSH, err := SSHServer(console)
+
+	if err != nil {
+		return
+	}
+
+	serveHTTP, err := WebServer(cfg.Address.Addr().String(), 80, false, nil)
+
+	if err != nil {
+		return
+	}
+
+	if err = w.serve(ctx, "ssh", 22, serveSSH); err != nil {
+		return
+	}
+
+	if err = w.serve(ctx, "http", 80, serveHTTP); err != nil {
+		return
+	}
+
+	wgTunnel = w
+
+	log.Printf("wg: %s up at %s", wgName, cfg.Address)
+
+	return
+}
+
+func (w *wireGuard) close() {
+	w.cancel()
+
+	w.wg.Wait()
+	w.dev.Close()
+}
+
+// StopWireGuard tears down the WireGuard tunnel.
+func StopWireGuard() (err error) {
+	wgMutex.Lock()
+	defer wgMutex.Unlock()
+
+	if wgTunnel == nil {
+		return errors.New("tunnel not started")
+	}
+
+	wgTunnel.close()
+	wgTunnel = nil
+
+	log.Printf("wg: %s down", wgName)
+
+	return
+}
+
+func formatKey(s string) string {
+	key, err := hex.DecodeString(s)
+
+	if err != nil {
+		return s
+	}
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// WireGuardStatus returns the WireGuard tunnel and peers status.
+func WireGuardStatus() (string, error) {
+	var buf bytes.Buffer
+
+	wgMutex.Lock()
+	defer wgMutex.Unlock()
+
+	if wgTunnel == nil {
+		return "", errors.New("tunnel not started")
+	}
+
+	conf, err := wgTunnel.dev.IpcGet()
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(conf, "\n") {
+		key, val, _ := strings.Cut(line, "=")
+
+		switch key {
+		case "private_key":
+			priv, _ := hex.DecodeString(val)
+			pub, _ := curve25519.X25519(priv, curve25519.Basepoint)
+			fmt.Fprintf(&buf, "interface: %s %s\n", wgName, wgTunnel.addr)
+			fmt.Fprintf(&buf, "  public key: %s\n", base64.StdEncoding.EncodeToString(pub))
+		case "listen_port":
+			fmt.Fprintf(&buf, "  listening port: %s\n", val)
+		case "public_key":
+			fmt.Fprintf(&buf, "peer: %s\n", formatKey(val))
+		case "endpoint":
+			fmt.Fprintf(&buf, "  endpoint: %s\n", val)
+		case "allowed_ip":
+			fmt.Fprintf(&buf, "  allowed ip: %s\n", val)
+		case "last_handshake_time_sec":
+			if handshake, _ := strconv.ParseInt(val, 10, 64); handshake > 0 {
+				ago := time.Since(time.Unix(handshake, 0)).Truncate(time.Second)
+				fmt.Fprintf(&buf, "  latest handshake: %v ago\n", ago)
+			}
+		case "rx_bytes":
+			fmt.Fprintf(&buf, "  received: %s bytes\n", val)
+		case "tx_bytes":
+			fmt.Fprintf(&buf, "  sent: %s bytes\n", val)
+		case "persistent_keepalive_interval":
+			if val != "0" {
+				fmt.Fprintf(&buf, "  keepalive: every %ss\n", val)
+			}
+		}
+	}
+
+	return buf.String(), nil
+}
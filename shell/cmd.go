@@ -8,8 +8,11 @@ package shell
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"regexp"
 	"sort"
+	"strings"
+	"sync"
 	"text/tabwriter"
 )
 
@@ -34,22 +37,78 @@ type Cmd struct {
 	// Help defines the Help() command description field.
 	Help string
 
+	// Terminal, when set, restricts the command to interfaces with an
+	// interactive VT100 terminal.
+	Terminal bool
+
 	// Fn defines the command handler.
 	Fn CmdFn
 }
 
 var cmds = make(map[string]*Cmd)
 
+var (
+	callsMutex sync.Mutex
+	calls      = make(map[string]uint64)
+)
+
 // Add registers a terminal interface command.
 func Add(cmd Cmd) {
 	cmds[cmd.Name] = &cmd
 }
 
+// Commands returns all registered commands, sorted by name.
+func Commands() (c []Cmd) {
+	var names []string
+
+	for name := range cmds {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		c = append(c, *cmds[name])
+	}
+
+	return
+}
+
+// Calls returns the number of invocations of each command.
+func Calls() map[string]uint64 {
+	callsMutex.Lock()
+	defer callsMutex.Unlock()
+
+	c := make(map[string]uint64, len(calls))
+
+	for name, n := range calls {
+		c[name] = n
+	}
+
+	return c
+}
+
+func countCall(name string) {
+	callsMutex.Lock()
+	defer callsMutex.Unlock()
+
+	calls[name] += 1
+}
+
 // Confirm displays the argument prompt and waits for a "y" or "n" answer which
 // is converted as return value.
+//
+// Without a VT100 terminal the answer is read from the interface ReadWriter,
+// when available.
 func (c *Interface) Confirm(msg string) bool {
 	if c.Terminal == nil {
-		return false
+		if c.ReadWriter == nil {
+			return false
+		}
+
+		fmt.Fprint(c.Output, msg)
+
+		return readInput(c.ReadWriter) == "y"
 	}
 
 	c.Terminal.SetPrompt(msg)
@@ -64,6 +123,26 @@ func (c *Interface) Confirm(msg string) bool {
 	return input == "y"
 }
 
+// readInput reads a line, one byte at a time to avoid consuming any further
+// input.
+func readInput(r io.Reader) string {
+	var line []byte
+
+	b := make([]byte, 1)
+
+	for {
+		n, err := r.Read(b)
+
+		if err != nil || n == 1 && b[0] == '\n' {
+			break
+		}
+
+		line = append(line, b[:n]...)
+	}
+
+	return strings.TrimSuffix(string(line), "\r")
+}
+
 // Help returns a formatted string with instructions for all registered
 // commands.
 func Help(c *Interface, _ []string) (_ string, _ error) {
@@ -38,12 +38,16 @@ type Interface struct {
 	Output io.Writer
 	// Terminal represents the VT100 terminal output
 	Terminal *term.Terminal
+
+	// Allow, when set, restricts the commands which can be executed
+	Allow func(name string) bool
 }
 
-func (c *Interface) handleLine(line string) (err error) {
+// Run executes an individual command, returning its result rather than
+// printing it on the interface output.
+func (c *Interface) Run(line string) (res string, err error) {
 	var match *Cmd
 	var arg []string
-	var res string
 
 	for _, cmd := range cmds {
 		if cmd.Pattern == nil {
@@ -59,10 +63,26 @@ func (c *Interface) handleLine(line string) (err error) {
 	}
 
 	if match == nil {
-		return errors.New("unknown command, type `help`")
+		return "", errors.New("unknown command, type `help`")
+	}
+
+	if c.Allow != nil && !c.Allow(match.Name) {
+		return "", errors.New("permission denied")
+	}
+
+	if match.Terminal && c.Terminal == nil {
+		return "", errors.New("interactive terminal required")
 	}
 
-	if res, err = match.Fn(c, arg); err != nil {
+	countCall(match.Name)
+
+	return match.Fn(c, arg)
+}
+
+func (c *Interface) handleLine(line string) (err error) {
+	res, err := c.Run(line)
+
+	if err != nil {
 		return
 	}
 